@@ -2,19 +2,22 @@
   'use strict';
   const Message = function() {
     this.body = ''
-    this.username = ''
+  };
+
+  const Credentials = function() {
+    this.name = ''
+    this.password = ''
   };
 
   Vue.component('message', {
-    // Tutorial 1-1. ユーザー名を表示しよう
-    props: ['id', 'body', 'username', 'removeMessage', 'updateMessage'],
+    props: ['id', 'body', 'username', 'editable', 'removeMessage', 'updateMessage'],
     data() {
       return {
         editing: false,
         editedBody: null,
+        etag: null,
       }
     },
-    // Tutorial 1-1. ユーザー名を表示しよう
     template: `
     <div class="message">
       <div v-if="editing">
@@ -26,8 +29,8 @@
       </div>
       <div class="message-body" v-else>
         <span>{{ body }} - {{ username }}</span>
-        <span class="action-button u-pull-right" v-on:click="edit">&#9998;</span>
-        <span class="action-button u-pull-right" v-on:click="remove">&#10007;</span>
+        <span class="action-button u-pull-right" v-if="editable" v-on:click="edit">&#9998;</span>
+        <span class="action-button u-pull-right" v-if="editable" v-on:click="remove">&#10007;</span>
       </div>
     </div>
   `,
@@ -36,15 +39,20 @@
         this.removeMessage(this.id)
       },
       edit() {
-        this.editing = true
-        this.editedBody = this.body
+        // 編集開始時点のETagを覚えておき、他の人が先に編集していたら保存時に412を受け取る
+        fetch(`/api/messages/${this.id}`).then(response => {
+          this.etag = response.headers.get('ETag')
+          this.editing = true
+          this.editedBody = this.body
+        })
       },
       cancelEdit() {
         this.editing = false
         this.editedBody = null
+        this.etag = null
       },
       doneEdit() {
-        this.updateMessage({id: this.id, body: this.editedBody})
+        this.updateMessage({id: this.id, body: this.editedBody}, this.etag)
           .then(response => {
             this.cancelEdit()
           })
@@ -55,22 +63,144 @@
   const app = new Vue({
     el: '#app',
     data: {
+      channels: [],
+      channelId: 1,
       messages: [],
-      newMessage: new Message()
+      nextCursor: null,
+      newMessage: new Message(),
+      currentUser: null,
+      credentials: new Credentials()
     },
     created() {
+      this.getCurrentUser();
+      this.getChannels();
       this.getMessages();
+      this.connectStream();
     },
     methods: {
+      getCurrentUser() {
+        fetch('/api/me', {credentials: 'same-origin'}).then(response => response.json()).then(data => {
+          this.currentUser = data.result;
+        });
+      },
+      login() {
+        this.authenticate('/api/login')
+      },
+      signUp() {
+        this.authenticate('/api/users')
+      },
+      authenticate(url) {
+        fetch(url, {
+          method: 'POST',
+          credentials: 'same-origin',
+          body: JSON.stringify(this.credentials)
+        })
+          .then(response => response.json())
+          .then(response => {
+            if (response.error) {
+              alert(response.error.message);
+              return;
+            }
+            this.currentUser = response.result;
+            this.credentials = new Credentials();
+          });
+      },
+      logout() {
+        fetch('/api/logout', {method: 'POST', credentials: 'same-origin'}).then(() => {
+          this.currentUser = null;
+        });
+      },
+      canModify(message) {
+        if (!this.currentUser) {
+          return false
+        }
+        return this.currentUser.admin || message.user_id === this.currentUser.id
+      },
+      getChannels() {
+        fetch('/api/channels').then(response => response.json()).then(data => {
+          this.channels = data.result;
+        });
+      },
+      changeChannel() {
+        this.messages = [];
+        this.nextCursor = null;
+        this.getMessages();
+      },
       getMessages() {
-        fetch('/api/messages').then(response => response.json()).then(data => {
+        fetch(`/api/channels/${this.channelId}/messages`).then(response => response.json()).then(data => {
           this.messages = data.result;
+          this.nextCursor = data.next_cursor;
         });
       },
+      getOlderMessages() {
+        fetch(`/api/channels/${this.channelId}/messages?before=${this.nextCursor}`).then(response => response.json()).then(data => {
+          this.messages = data.result.concat(this.messages);
+          this.nextCursor = data.next_cursor;
+        });
+      },
+      connectStream() {
+        // 切断された場合は最後に受け取ったメッセージのIDを指定して再接続します
+        const lastID = this.messages.reduce((max, m) => Math.max(max, m.id), 0)
+        const scheme = location.protocol === 'https:' ? 'wss:' : 'ws:'
+        const query = lastID > 0 ? `?last_id=${lastID}` : ''
+        const ws = new WebSocket(`${scheme}//${location.host}/api/stream${query}`)
+        let opened = false
+        ws.onopen = () => {
+          opened = true
+        }
+        ws.onmessage = e => {
+          this.applyEvent(JSON.parse(e.data))
+        }
+        ws.onclose = () => {
+          if (!opened) {
+            // WebSocketが使えない環境ではServer-Sent Eventsに切り替えます
+            this.connectEvents(lastID)
+            return
+          }
+          setTimeout(() => this.connectStream(), 3000)
+        }
+      },
+      connectEvents(lastID) {
+        // EventSourceは再接続時に自動でLast-Event-IDを送ります
+        const query = lastID > 0 ? `?last_event_id=${lastID}` : ''
+        const es = new EventSource(`/api/events${query}`)
+        const types = ['created', 'updated', 'deleted']
+        types.forEach(type => {
+          es.addEventListener(type, e => {
+            this.applyEvent({type: type, message: JSON.parse(e.data)})
+          })
+        })
+      },
+      applyEvent(event) {
+        if (event.message.channel_id !== this.channelId) {
+          return
+        }
+        const index = this.messages.findIndex(m => {
+          return m.id === event.message.id
+        })
+        switch (event.type) {
+          case 'created':
+            if (index === -1) {
+              this.messages.push(event.message)
+            }
+            break
+          case 'updated':
+            if (index !== -1) {
+              Vue.set(this.messages, index, event.message)
+            }
+            break
+          case 'deleted':
+            if (index !== -1) {
+              this.messages.splice(index, 1)
+            }
+            break
+        }
+      },
       sendMessage() {
         const message = this.newMessage;
-        fetch('/api/messages', {
+        fetch(`/api/channels/${this.channelId}/messages`, {
           method: 'POST',
+          credentials: 'same-origin',
           body: JSON.stringify(message)
         })
           .then(response => response.json())
@@ -79,7 +209,7 @@
               alert(response.error.message);
               return;
             }
-            this.messages.push(response.result);
+            this.applyEvent({type: 'created', message: response.result});
             this.clearMessage();
           })
           .catch(error => {
@@ -88,7 +218,8 @@
       },
       removeMessage(id) {
         return fetch(`/api/messages/${id}`, {
-          method: 'DELETE'
+          method: 'DELETE',
+          credentials: 'same-origin'
         })
         .then(response => response.json())
         .then(response => {
@@ -101,9 +232,15 @@
           })
         })
       },
-      updateMessage(updatedMessage) {
+      updateMessage(updatedMessage, etag) {
+        const headers = {}
+        if (etag) {
+          headers['If-Match'] = etag
+        }
         return fetch(`/api/messages/${updatedMessage.id}`, {
           method: 'PUT',
+          credentials: 'same-origin',
+          headers: headers,
           body: JSON.stringify(updatedMessage),
         })
         .then(response => response.json())
@@ -115,7 +252,7 @@
             const index = this.messages.findIndex(m => {
               return m.id === updatedMessage.id
             })
-            Vue.set(this.messages, index, updatedMessage)
+            Vue.set(this.messages, index, response.result)
         })
       },
       clearMessage() {
@@ -0,0 +1,104 @@
+// Package auth はリクエストしたユーザーを識別するためのgin middlewareを提供するパッケージです
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// SessionCookieName はセッションのトークンを保存するcookieの名前です
+	SessionCookieName = "session"
+	// SessionTTL はセッションの有効期間です
+	SessionTTL = 30 * 24 * time.Hour
+
+	// userKey はgin.Contextにログイン中のユーザーを保存するキーです
+	userKey = "auth.user"
+)
+
+// ErrLoginRequired はログインが必要なAPIにログインせずにアクセスした場合のエラーです
+var ErrLoginRequired = errors.New("login required")
+
+// Session はcookieのセッションからログイン中のユーザーを読み込み、gin.Contextに保存するmiddlewareを返します
+//
+// セッションがない場合もリクエストはそのまま続行します。ログインが必要なAPIにはRequireScopeを併せて使います
+func Session(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, err := c.Cookie(SessionCookieName)
+		if err != nil || token == "" {
+			c.Next()
+			return
+		}
+
+		u, err := model.UserBySessionToken(db, token)
+		switch {
+		case err == sql.ErrNoRows:
+			// 期限切れなどで無効になったcookieは消しておきます
+			clearSessionCookie(c)
+		case err != nil:
+			log.Printf("auth: %s", err)
+		default:
+			c.Set(userKey, u)
+		}
+		c.Next()
+	}
+}
+
+// CurrentUser はログイン中のユーザーを返します。ログインしていない場合はnilを返します
+func CurrentUser(c *gin.Context) *model.User {
+	v, ok := c.Get(userKey)
+	if !ok {
+		return nil
+	}
+	u, _ := v.(*model.User)
+	return u
+}
+
+// Login はuのセッションを作成してcookieに保存します
+func Login(c *gin.Context, db *sql.DB, u *model.User) error {
+	s, err := model.NewSession(db, u.ID, SessionTTL)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    s.Token,
+		Path:     "/",
+		Expires:  s.Expires,
+		Secure:   c.Request.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	c.Set(userKey, u)
+	return nil
+}
+
+// Logout はcookieのセッションを削除します
+func Logout(c *gin.Context, db *sql.DB) error {
+	token, err := c.Cookie(SessionCookieName)
+	if err == nil && token != "" {
+		if err := model.DeleteSession(db, token); err != nil {
+			return err
+		}
+	}
+	clearSessionCookie(c)
+	return nil
+}
+
+// clearSessionCookie はセッションのcookieを削除します
+func clearSessionCookie(c *gin.Context) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
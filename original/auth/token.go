@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/httputil"
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+	"github.com/gin-gonic/gin"
+)
+
+// scopeKey はgin.ContextにAPIトークンのscopeを保存するキーです
+const scopeKey = "auth.scope"
+
+var (
+	// ErrInvalidToken は存在しないAPIトークンが指定された場合のエラーです
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrInsufficientScope はAPIトークンのscopeで許可されていない操作をしようとした場合のエラーです
+	ErrInsufficientScope = errors.New("insufficient token scope")
+	// ErrAdminRequired は管理者でないユーザーが管理者だけの操作をしようとした場合のエラーです
+	ErrAdminRequired = errors.New("admin required")
+)
+
+// Token はAuthorizationヘッダーのBearerトークンからユーザーを読み込み、gin.Contextに保存するmiddlewareを返します
+//
+// Authorizationヘッダーがない場合はリクエストをそのまま続行します。トークンが無効な場合は401を返します。
+// scopeがadminでないトークンでは、管理者のユーザーも管理者としては扱いません
+func Token(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h := c.Request.Header.Get("Authorization")
+		if h == "" {
+			c.Next()
+			return
+		}
+
+		const prefix = "Bearer "
+		if !strings.HasPrefix(h, prefix) {
+			resp := httputil.NewErrorResponse(ErrInvalidToken)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, resp)
+			return
+		}
+
+		u, scope, err := model.UserByToken(db, strings.TrimPrefix(h, prefix))
+		switch {
+		case err == sql.ErrNoRows:
+			resp := httputil.NewErrorResponse(ErrInvalidToken)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, resp)
+			return
+		case err != nil:
+			log.Printf("auth: %s", err)
+			resp := httputil.NewErrorResponse(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, resp)
+			return
+		}
+
+		if !scope.Allows(model.ScopeAdmin) {
+			u.Admin = false
+		}
+		c.Set(userKey, u)
+		c.Set(scopeKey, scope)
+		c.Next()
+	}
+}
+
+// RequireScope はログインしていないリクエストに401を、APIトークンのscopeがrequiredを満たさないリクエストに403を返すmiddlewareを返します
+//
+// cookieのセッションでログインしている場合のscopeはCurrentScopeを見てください
+func RequireScope(required model.Scope) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if CurrentUser(c) == nil {
+			resp := httputil.NewErrorResponse(ErrLoginRequired)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, resp)
+			return
+		}
+		if !CurrentScope(c).Allows(required) {
+			resp := httputil.NewErrorResponse(ErrInsufficientScope)
+			c.AbortWithStatusJSON(http.StatusForbidden, resp)
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireAdmin はログインしていないリクエストに401を、管理者でないユーザーやscopeがadminでないAPIトークンのリクエストに403を返すmiddlewareを返します
+//
+// scopeがadminのAPIトークンでも、トークンを作ったユーザーが管理者でなければ通しません
+func RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u := CurrentUser(c)
+		if u == nil {
+			resp := httputil.NewErrorResponse(ErrLoginRequired)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, resp)
+			return
+		}
+		if !CurrentScope(c).Allows(model.ScopeAdmin) {
+			resp := httputil.NewErrorResponse(ErrInsufficientScope)
+			c.AbortWithStatusJSON(http.StatusForbidden, resp)
+			return
+		}
+		if !u.Admin {
+			resp := httputil.NewErrorResponse(ErrAdminRequired)
+			c.AbortWithStatusJSON(http.StatusForbidden, resp)
+			return
+		}
+		c.Next()
+	}
+}
+
+// CurrentScope はリクエストに許可されているscopeを返します
+//
+// cookieのセッションでログインしている場合は、管理者ならmodel.ScopeAdmin、そうでなければmodel.ScopeWriteを返します。
+// ログインしていない場合は空文字列を返します
+func CurrentScope(c *gin.Context) model.Scope {
+	if v, ok := c.Get(scopeKey); ok {
+		scope, _ := v.(model.Scope)
+		return scope
+	}
+	u := CurrentUser(c)
+	switch {
+	case u == nil:
+		return ""
+	case u.Admin:
+		return model.ScopeAdmin
+	}
+	return model.ScopeWrite
+}
@@ -3,60 +3,261 @@ package bot
 import (
 	"context"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
 )
 
+const (
+	// DefaultProcessTimeout はBotが1つのメッセージの返信を作るのを待つ時間のデフォルトです
+	DefaultProcessTimeout = 10 * time.Second
+	// DefaultErrorReply はprocessorが失敗した時にBotが返信する本文のデフォルトです
+	DefaultErrorReply = "気が乗らないパカ"
+)
+
 type (
-	// Bot はinで受け取ったmessageがcheckerの条件を満たした場合、processorが投稿用messageを作り、outに渡します
+	// Bot はinで受け取ったeventのmessageがcheckerの条件を満たした場合、processorが投稿用messageを作り、outに渡します
+	//
+	// eventTypesに含まれない種類のeventは無視します。eventTypesが空の場合はmessageの作成だけに反応します
+	//
+	// processorにはtimeoutを期限にしたctxを渡します。timeoutが0の場合はDefaultProcessTimeoutにします。
+	// storeが設定されている場合はctxに入れるので、processorはStoreFromContextで値を保存できます。
+	// conversationsが設定されている場合は、ユーザーのメッセージに反応する時にそのユーザーとのConversationをctxに入れるので、
+	// processorはConversationFromContextでやりとりを始められます。やりとりの途中のユーザーのメッセージにはcheckerで判定せずに反応します。
+	// processorが失敗した場合はonErrorに従います
+	//
+	// triggerが設定されている場合は、メッセージに反応する代わりに、あるいはそれに加えて、予定の時刻ごとに投稿します。
+	// 時刻はclockで知ります。clockが設定されていない場合はtime.Localでの実際の時刻です。
+	// checkerがnilの場合はメッセージには反応しません
 	//
 	//   fields
-	//     name      string
-	//     in        chan *model.Message
-	//     out       chan *model.Message
-	//     checker   Checker
-	//     processor Processor
+	//     name          string
+	//     in            chan *model.Event
+	//     out           chan *model.Message
+	//     checker       Checker
+	//     processor     Processor
+	//     eventTypes    []model.EventType
+	//     timeout       time.Duration
+	//     onError       ErrorPolicy
+	//     store         *Store
+	//     conversations *Conversations
+	//     trigger       *Trigger
+	//     clock         Clock
 	Bot struct {
-		name      string
-		in        chan *model.Message
-		out       chan *model.Message
-		checker   Checker
-		processor Processor
+		name          string
+		in            chan *model.Event
+		out           chan *model.Message
+		checker       Checker
+		processor     Processor
+		eventTypes    []model.EventType
+		timeout       time.Duration
+		onError       ErrorPolicy
+		store         *Store
+		conversations *Conversations
+		trigger       *Trigger
+		clock         Clock
+	}
+
+	// ErrorPolicy はprocessorが失敗した時にBotがどうするかの設定です
+	//
+	//   fields
+	//     Reply    string 返信する本文。空の場合はDefaultErrorReplyです
+	//     Suppress bool   trueの場合は返信せずに、ログに出すだけにします
+	ErrorPolicy struct {
+		Reply    string `json:"reply,omitempty" yaml:"reply"`
+		Suppress bool   `json:"suppress,omitempty" yaml:"suppress"`
 	}
 )
 
 // Run はBotを起動します
+//
+// processorがRunnerの場合はprocessorも起動し、ctxが終了したらprocessorが停止するのを待ってから返ります。
+// triggerが設定されている場合は、予定の時刻ごとの投稿も行います
 func (b *Bot) Run(ctx context.Context) {
+	if r, ok := b.processor.(Runner); ok {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			r.Run(ctx)
+		}()
+		defer func() { <-done }()
+	}
+
+	// 遅れて投稿する返信は、ctxが終了したら投稿せずに終わらせます
+	var delayed sync.WaitGroup
+	defer delayed.Wait()
+
+	if b.trigger != nil {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			b.runSchedule(ctx, &delayed)
+		}()
+		defer func() { <-done }()
+	}
+
 	// メッセージ監視
 	for {
 		select {
 		case <-ctx.Done():
-			close(b.in)
+			// inへはMulticasterのキューが送信するので、ここでは閉じません
 			return
-		case m := <-b.in:
-			if b.checker.Check(m) {
-				nm, err := b.processor.Process(m)
-				if err != nil {
-					log.Printf("%s: %#v\n", b.name, err)
-					b.out <- &model.Message{
-						Body: "気が乗らないパカ",
-					}
-					// selectから抜ける
-					break
-				}
-				b.out <- nm
+		case e := <-b.in:
+			if !b.accepts(e.Type) {
+				break
+			}
+			m := e.Message
+			conv, err := b.conversation(e)
+			if err != nil {
+				log.Printf("%s: %#v\n", b.name, err)
+				break
+			}
+			// やりとりの途中であればcheckerの条件を満たさなくても反応します
+			if (conv == nil || !conv.Active()) && !b.check(e) {
+				break
 			}
+			pctx := ctx
+			if conv != nil {
+				pctx = WithConversation(ctx, conv)
+			}
+			b.respond(pctx, m, &delayed)
 		}
 	}
 }
 
+// respond はprocessorでmへの返信を作り、outに渡します
+//
+// processorが失敗した場合はonErrorに従います。遅れて投稿する返信はdelayedに加え、ctxが終了したら投稿しません。
+// outが受け取らないままctxが終了した場合も、返信を捨てて返ります
+func (b *Bot) respond(ctx context.Context, m *model.Message, delayed *sync.WaitGroup) {
+	replies, err := b.process(ctx, m)
+	if err != nil {
+		log.Printf("%s: %#v\n", b.name, err)
+		if b.onError.Suppress {
+			return
+		}
+		body := b.onError.Reply
+		if body == "" {
+			body = DefaultErrorReply
+		}
+		replies = []*Reply{{Message: &model.Message{Body: body}}}
+	}
+
+	for _, r := range replies {
+		nm := b.reply(m, r.Message)
+		if r.Delay <= 0 {
+			b.post(ctx, nm)
+			continue
+		}
+		delayed.Add(1)
+		go func(d time.Duration) {
+			defer delayed.Done()
+			t := time.NewTimer(d)
+			defer t.Stop()
+			select {
+			case <-ctx.Done():
+			case <-t.C:
+				b.post(ctx, nm)
+			}
+		}(r.Delay)
+	}
+}
+
+// post はnmをoutに渡します。ctxが終了した場合は渡さずに返ります
+func (b *Bot) post(ctx context.Context, nm *model.Message) {
+	select {
+	case b.out <- nm:
+	case <-ctx.Done():
+	}
+}
+
+// process はtimeoutを期限にしてprocessorで返信を作ります
+//
+// processorがMultiProcessorでなければ、Processの結果を1つの返信にします。ErrNoReplyの場合は返信しません
+func (b *Bot) process(ctx context.Context, m *model.Message) ([]*Reply, error) {
+	timeout := b.timeout
+	if timeout <= 0 {
+		timeout = DefaultProcessTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if b.store != nil {
+		ctx = WithStore(ctx, b.store)
+	}
+
+	if p, ok := b.processor.(MultiProcessor); ok {
+		return p.ProcessAll(ctx, m)
+	}
+	nm, err := b.processor.Process(ctx, m)
+	switch {
+	case err == ErrNoReply:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	return []*Reply{{Message: nm}}, nil
+}
+
+// conversation はeventのユーザーとBotとのやりとりを返します
+//
+// conversationsが設定されていないか、eventがユーザーのメッセージの作成でない場合はnilを返します
+func (b *Bot) conversation(e *model.Event) (*Conversation, error) {
+	if b.conversations == nil || !conversational(e) {
+		return nil, nil
+	}
+	return b.conversations.load(b.name, e.Message)
+}
+
+// reply はnmをmへの返信として投稿できるようにします
+func (b *Bot) reply(m, nm *model.Message) *model.Message {
+	// 反応したメッセージと同じチャンネルに投稿します
+	if nm.ChannelID == 0 {
+		nm.ChannelID = m.ChannelID
+	}
+	// 反応したメッセージへの返信として投稿します
+	if nm.ParentID == 0 {
+		nm.ParentID = m.ID
+	}
+	// 返信し合うbotを止められるように、投稿したbotと連鎖の深さを付けます
+	nm.BotName = b.name
+	nm.ChainDepth = m.ChainDepth + 1
+	return nm
+}
+
+// Name はBotの名前を返します
+func (b *Bot) Name() string {
+	return b.name
+}
+
+// accepts はBotが種類tのeventに反応するかを返します
+func (b *Bot) accepts(t model.EventType) bool {
+	if len(b.eventTypes) == 0 {
+		return t == model.EventCreated
+	}
+	for _, et := range b.eventTypes {
+		if et == t {
+			return true
+		}
+	}
+	return false
+}
+
+// check はBotがeventに反応するかをcheckerで判定します
+func (b *Bot) check(e *model.Event) bool {
+	if b.checker == nil {
+		return false
+	}
+	return checkEvent(b.checker, e)
+}
+
 // NewHelloWorldBot は"hello"を受け取ると"hello, world!"を返す新しいBotの構造体のポインタを返します
 func NewHelloWorldBot(out chan *model.Message) *Bot {
-	in := make(chan *model.Message)
+	in := make(chan *model.Event)
 
 	checker := NewRegexpChecker("\\Ahello\\z")
 
-	processor := &HelloWorldProcessor{}
+	processor := WithContext(&HelloWorldProcessor{})
 
 	return &Bot{
 		name:      "helloworldbot",
@@ -69,7 +270,7 @@ func NewHelloWorldBot(out chan *model.Message) *Bot {
 
 // NewOmikujiBot は"大吉", "吉", "中吉", "小吉", "末吉", "凶"のいずれかをランダムで返す新しいBotの構造体のポインタを返します
 func NewOmikujiBot(out chan *model.Message) *Bot {
-	in := make(chan *model.Message)
+	in := make(chan *model.Event)
 
 	checker := NewRegexpChecker("\\Aomikuji\\z")
 
@@ -84,13 +285,13 @@ func NewOmikujiBot(out chan *model.Message) *Bot {
 	}
 }
 
-// NewKeywordBot はメッセージ本文からキーワードを抽出して返す新しいBotの構造体のポインタを返します
-func NewKeywordBot(out chan *model.Message) *Bot {
-	in := make(chan *model.Message)
+// NewKeywordBot はメッセージ本文からextractorでキーワードを抽出して返す新しいBotの構造体のポインタを返します
+func NewKeywordBot(extractor KeywordExtractor, out chan *model.Message) *Bot {
+	in := make(chan *model.Event)
 
 	checker := NewRegexpChecker("\\Akeyword .+")
 
-	processor := &KeywordProcessor{}
+	processor := &KeywordProcessor{extractor: extractor}
 
 	return &Bot{
 		name:      "keywordbot",
@@ -100,3 +301,21 @@ func NewKeywordBot(out chan *model.Message) *Bot {
 		processor: processor,
 	}
 }
+
+// NewReactionBot はメッセージに👍のリアクションが5個集まると、そのメッセージに返信する新しいBotの構造体のポインタを返します
+func NewReactionBot(out chan *model.Message) *Bot {
+	in := make(chan *model.Event)
+
+	checker := NewReactionChecker("👍", 5)
+
+	processor := WithContext(&ReactionProcessor{})
+
+	return &Bot{
+		name:       "reactionbot",
+		in:         in,
+		out:        out,
+		checker:    checker,
+		processor:  processor,
+		eventTypes: []model.EventType{model.EventReactionAdded},
+	}
+}
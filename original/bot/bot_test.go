@@ -0,0 +1,32 @@
+package bot
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+)
+
+func TestBotはoutが受け取らなくてもctxが終了すると止まる(t *testing.T) {
+	// 誰も受け取らないout
+	out := make(chan *model.Message)
+	b := NewHelloWorldBot(out)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.Run(ctx)
+	}()
+
+	b.in <- model.NewEvent(model.EventCreated, &model.Message{ID: 1, Body: "hello"})
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("bot expected to stop after ctx is done, but it is still blocked on out")
+	}
+}
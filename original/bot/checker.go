@@ -1,7 +1,12 @@
 package bot
 
 import (
+	"math/rand"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
 )
@@ -12,10 +17,102 @@ type (
 		Check(*model.Message) bool
 	}
 
+	// EventChecker はmessageだけでなくeventの種類なども見て判定するCheckerのインターフェースです
+	//
+	// BotのcheckerがEventCheckerを実装している場合、BotはCheckの代わりにCheckEventを呼びます
+	EventChecker interface {
+		Checker
+		CheckEvent(*model.Event) bool
+	}
+
 	// RegexpChecker は 正規表現を満たす場合true、そうでない場合falseを返す構造体です
 	RegexpChecker struct {
 		regexp *regexp.Regexp
 	}
+
+	// PrefixChecker はメッセージ本文がprefixで始まる場合true、そうでない場合falseを返す構造体です
+	PrefixChecker struct {
+		prefix string
+	}
+
+	// ExactChecker はメッセージ本文がtextと一致する場合true、そうでない場合falseを返す構造体です
+	ExactChecker struct {
+		text string
+	}
+
+	// submatcher はメッセージ本文のうちcheckerが条件にした部分を取り出せるcheckerのインターフェースです
+	//
+	// submatchは条件を満たさない場合nilを、満たす場合は本文全体と、本文のうち取り出した部分を順に返します
+	submatcher interface {
+		submatch(body string) []string
+	}
+
+	// ReactionChecker はメッセージのemojiのリアクションがcount個に達した場合true、そうでない場合falseを返す構造体です
+	ReactionChecker struct {
+		emoji string
+		count int
+	}
+
+	// CommandChecker はメッセージ本文がcommandそのものか、commandと空白で始まる場合true、そうでない場合falseを返す構造体です
+	//
+	// PrefixCheckerと違い、"!dice"は"!dicex"には反応しません
+	CommandChecker struct {
+		command string
+	}
+
+	// AuthorKindChecker はメッセージの投稿者の種類(userかbot)がkindの場合true、そうでない場合falseを返す構造体です
+	AuthorKindChecker struct {
+		kind string
+	}
+
+	// UsernameChecker はメッセージの投稿者の名前がusernamesのいずれかの場合true、そうでない場合falseを返す構造体です
+	UsernameChecker struct {
+		usernames []string
+	}
+
+	// ChannelChecker はメッセージのチャンネルがchannelIDsのいずれかの場合true、そうでない場合falseを返す構造体です
+	ChannelChecker struct {
+		channelIDs []int64
+	}
+
+	// TimeWindowChecker は現在時刻がlocationでの時刻startからendの間の場合true、そうでない場合falseを返す構造体です
+	//
+	// start、endは0時からの経過時間です。startよりendが前の場合は、日付をまたいだ時間帯として扱います
+	//
+	//   fields
+	//     start    time.Duration
+	//     end      time.Duration
+	//     location *time.Location
+	//     now      func() time.Time テストでは時刻を差し替えます
+	TimeWindowChecker struct {
+		start    time.Duration
+		end      time.Duration
+		location *time.Location
+		now      func() time.Time
+	}
+
+	// ProbabilityChecker は確率probabilityでtrue、そうでない場合falseを返す構造体です
+	ProbabilityChecker struct {
+		probability float64
+		random      func() float64
+	}
+
+	// CooldownChecker は同じユーザーの前回trueを返してからdurationが経っている場合true、そうでない場合falseを返す構造体です
+	//
+	// trueを返すと、そのユーザーの時刻を記録します。
+	// 他の条件を満たさないメッセージで記録しないように、AndCheckerでは最後に置きます
+	//
+	//   fields
+	//     duration time.Duration
+	//     now      func() time.Time
+	//     mu       sync.Mutex
+	//     last     map[string]time.Time ユーザー毎の前回trueを返した時刻
+	CooldownChecker struct {
+		duration time.Duration
+		now      func() time.Time
+		mu       sync.Mutex
+		last     map[string]time.Time
+	}
 )
 
 // Check は正規表現を満たす場合true、そうでない場合falseを返します
@@ -23,6 +120,11 @@ func (c *RegexpChecker) Check(m *model.Message) bool {
 	return c.regexp.MatchString(m.Body)
 }
 
+// submatch は正規表現にマッチした本文全体と、各グループにマッチした部分を返します
+func (c *RegexpChecker) submatch(body string) []string {
+	return c.regexp.FindStringSubmatch(body)
+}
+
 // NewRegexpChecker は新しいRegexpChecker構造体のポインタを返します
 func NewRegexpChecker(pattern string) *RegexpChecker {
 	r := regexp.MustCompile(pattern)
@@ -30,3 +132,205 @@ func NewRegexpChecker(pattern string) *RegexpChecker {
 		regexp: r,
 	}
 }
+
+// Check はメッセージ本文がprefixで始まる場合true、そうでない場合falseを返します
+func (c *PrefixChecker) Check(m *model.Message) bool {
+	return strings.HasPrefix(m.Body, c.prefix)
+}
+
+// submatch は本文全体と、本文のprefixより後ろの部分を返します
+func (c *PrefixChecker) submatch(body string) []string {
+	if !strings.HasPrefix(body, c.prefix) {
+		return nil
+	}
+	return []string{body, strings.TrimPrefix(body, c.prefix)}
+}
+
+// NewPrefixChecker は新しいPrefixChecker構造体のポインタを返します
+func NewPrefixChecker(prefix string) *PrefixChecker {
+	return &PrefixChecker{
+		prefix: prefix,
+	}
+}
+
+// Check はメッセージ本文がtextと一致する場合true、そうでない場合falseを返します
+func (c *ExactChecker) Check(m *model.Message) bool {
+	return m.Body == c.text
+}
+
+// submatch は本文がtextと一致する場合に本文を返します
+func (c *ExactChecker) submatch(body string) []string {
+	if body != c.text {
+		return nil
+	}
+	return []string{body}
+}
+
+// NewExactChecker は新しいExactChecker構造体のポインタを返します
+func NewExactChecker(text string) *ExactChecker {
+	return &ExactChecker{
+		text: text,
+	}
+}
+
+// Check はメッセージのemojiのリアクションがcount個以上の場合true、そうでない場合falseを返します
+func (c *ReactionChecker) Check(m *model.Message) bool {
+	return m.Reactions[c.emoji] >= c.count
+}
+
+// CheckEvent はemojiのリアクションが付けられて、ちょうどcount個になった場合true、そうでない場合falseを返します
+//
+// 他の絵文字のリアクションや、count個を超えた後のリアクションでは何度も反応しないようにします
+func (c *ReactionChecker) CheckEvent(e *model.Event) bool {
+	return e.Type == model.EventReactionAdded &&
+		e.Reaction != nil && e.Reaction.Emoji == c.emoji &&
+		e.Message.Reactions[c.emoji] == c.count
+}
+
+// NewReactionChecker は新しいReactionChecker構造体のポインタを返します
+func NewReactionChecker(emoji string, count int) *ReactionChecker {
+	return &ReactionChecker{
+		emoji: emoji,
+		count: count,
+	}
+}
+
+// Check はメッセージ本文がcommandそのものか、commandと空白で始まる場合true、そうでない場合falseを返します
+func (c *CommandChecker) Check(m *model.Message) bool {
+	return c.submatch(m.Body) != nil
+}
+
+// submatch は本文全体と、commandより後ろの引数の部分を返します
+func (c *CommandChecker) submatch(body string) []string {
+	if body == c.command {
+		return []string{body, ""}
+	}
+	if !strings.HasPrefix(body, c.command+" ") {
+		return nil
+	}
+	return []string{body, strings.TrimSpace(strings.TrimPrefix(body, c.command))}
+}
+
+// NewCommandChecker は新しいCommandChecker構造体のポインタを返します
+func NewCommandChecker(command string) *CommandChecker {
+	return &CommandChecker{
+		command: command,
+	}
+}
+
+// Check はメッセージの投稿者の種類がkindの場合true、そうでない場合falseを返します
+func (c *AuthorKindChecker) Check(m *model.Message) bool {
+	kind := m.AuthorKind
+	if kind == "" {
+		kind = model.AuthorUser
+	}
+	return kind == c.kind
+}
+
+// NewAuthorKindChecker は新しいAuthorKindChecker構造体のポインタを返します
+func NewAuthorKindChecker(kind string) *AuthorKindChecker {
+	return &AuthorKindChecker{
+		kind: kind,
+	}
+}
+
+// Check はメッセージの投稿者の名前がusernamesのいずれかの場合true、そうでない場合falseを返します
+func (c *UsernameChecker) Check(m *model.Message) bool {
+	for _, name := range c.usernames {
+		if m.Username == name {
+			return true
+		}
+	}
+	return false
+}
+
+// NewUsernameChecker は新しいUsernameChecker構造体のポインタを返します
+func NewUsernameChecker(usernames ...string) *UsernameChecker {
+	return &UsernameChecker{
+		usernames: usernames,
+	}
+}
+
+// Check はメッセージのチャンネルがchannelIDsのいずれかの場合true、そうでない場合falseを返します
+func (c *ChannelChecker) Check(m *model.Message) bool {
+	for _, id := range c.channelIDs {
+		if m.ChannelID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// NewChannelChecker は新しいChannelChecker構造体のポインタを返します
+func NewChannelChecker(channelIDs ...int64) *ChannelChecker {
+	return &ChannelChecker{
+		channelIDs: channelIDs,
+	}
+}
+
+// Check は現在時刻がstartからendの間の場合true、そうでない場合falseを返します
+func (c *TimeWindowChecker) Check(m *model.Message) bool {
+	now := c.now().In(c.location)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, c.location)
+	t := now.Sub(midnight)
+
+	if c.start <= c.end {
+		return c.start <= t && t < c.end
+	}
+	return c.start <= t || t < c.end
+}
+
+// NewTimeWindowChecker は新しいTimeWindowChecker構造体のポインタを返します
+//
+// locationがnilの場合はtime.Localを使います
+func NewTimeWindowChecker(start, end time.Duration, location *time.Location) *TimeWindowChecker {
+	if location == nil {
+		location = time.Local
+	}
+	return &TimeWindowChecker{
+		start:    start,
+		end:      end,
+		location: location,
+		now:      time.Now,
+	}
+}
+
+// Check は確率probabilityでtrue、そうでない場合falseを返します
+func (c *ProbabilityChecker) Check(m *model.Message) bool {
+	return c.random() < c.probability
+}
+
+// NewProbabilityChecker は新しいProbabilityChecker構造体のポインタを返します
+func NewProbabilityChecker(probability float64) *ProbabilityChecker {
+	return &ProbabilityChecker{
+		probability: probability,
+		random:      rand.Float64,
+	}
+}
+
+// Check は同じユーザーの前回trueを返してからdurationが経っている場合true、そうでない場合falseを返します
+func (c *CooldownChecker) Check(m *model.Message) bool {
+	key := m.Username
+	if m.UserID != 0 {
+		key = strconv.FormatInt(m.UserID, 10)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if last, ok := c.last[key]; ok && now.Sub(last) < c.duration {
+		return false
+	}
+	c.last[key] = now
+	return true
+}
+
+// NewCooldownChecker は新しいCooldownChecker構造体のポインタを返します
+func NewCooldownChecker(duration time.Duration) *CooldownChecker {
+	return &CooldownChecker{
+		duration: duration,
+		now:      time.Now,
+		last:     map[string]time.Time{},
+	}
+}
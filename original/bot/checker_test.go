@@ -0,0 +1,201 @@
+package bot
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+)
+
+func TestCheckerがメッセージの条件を判定する(t *testing.T) {
+	cases := []struct {
+		name     string
+		checker  Checker
+		msg      *model.Message
+		expected bool
+	}{
+		{"regexp match", NewRegexpChecker(`\Ahello\z`), &model.Message{Body: "hello"}, true},
+		{"regexp unmatch", NewRegexpChecker(`\Ahello\z`), &model.Message{Body: "hello!"}, false},
+		{"prefix match", NewPrefixChecker("echo "), &model.Message{Body: "echo hi"}, true},
+		{"prefix unmatch", NewPrefixChecker("echo "), &model.Message{Body: "echohi"}, false},
+		{"exact match", NewExactChecker("always"), &model.Message{Body: "always"}, true},
+		{"exact unmatch", NewExactChecker("always"), &model.Message{Body: "always "}, false},
+		{"command only", NewCommandChecker("!roll"), &model.Message{Body: "!roll"}, true},
+		{"command with args", NewCommandChecker("!roll"), &model.Message{Body: "!roll 2d6"}, true},
+		{"command with suffix", NewCommandChecker("!roll"), &model.Message{Body: "!rollx"}, false},
+		{"author kind user", NewAuthorKindChecker(model.AuthorUser), &model.Message{AuthorKind: model.AuthorUser}, true},
+		{"author kind empty is user", NewAuthorKindChecker(model.AuthorUser), &model.Message{}, true},
+		{"author kind bot", NewAuthorKindChecker(model.AuthorUser), &model.Message{AuthorKind: model.AuthorBot}, false},
+		{"username match", NewUsernameChecker("alice", "bob"), &model.Message{Username: "bob"}, true},
+		{"username unmatch", NewUsernameChecker("alice", "bob"), &model.Message{Username: "carol"}, false},
+		{"channel match", NewChannelChecker(1, 2), &model.Message{ChannelID: 2}, true},
+		{"channel unmatch", NewChannelChecker(1, 2), &model.Message{ChannelID: 3}, false},
+		{"reaction reached", NewReactionChecker("👍", 2), &model.Message{Reactions: map[string]int{"👍": 3}}, true},
+		{"reaction not reached", NewReactionChecker("👍", 2), &model.Message{Reactions: map[string]int{"👍": 1, "🎉": 5}}, false},
+		{"probability 1", NewProbabilityChecker(1), &model.Message{}, true},
+		{"probability 0", NewProbabilityChecker(0), &model.Message{}, false},
+	}
+	for _, tc := range cases {
+		if actual := tc.checker.Check(tc.msg); actual != tc.expected {
+			t.Fatalf("%s: expected %v, but %v", tc.name, tc.expected, actual)
+		}
+	}
+}
+
+func TestReactionCheckerがちょうどcount個になったリアクションのeventにだけ反応する(t *testing.T) {
+	c := NewReactionChecker("👍", 2)
+	cases := []struct {
+		name     string
+		e        *model.Event
+		expected bool
+	}{
+		{"reached", model.NewReactionEvent(model.EventReactionAdded, &model.Message{Reactions: map[string]int{"👍": 2}}, &model.Reaction{Emoji: "👍"}), true},
+		{"over", model.NewReactionEvent(model.EventReactionAdded, &model.Message{Reactions: map[string]int{"👍": 3}}, &model.Reaction{Emoji: "👍"}), false},
+		{"other emoji", model.NewReactionEvent(model.EventReactionAdded, &model.Message{Reactions: map[string]int{"👍": 2}}, &model.Reaction{Emoji: "🎉"}), false},
+		{"removed", model.NewReactionEvent(model.EventReactionRemoved, &model.Message{Reactions: map[string]int{"👍": 2}}, &model.Reaction{Emoji: "👍"}), false},
+		{"created", model.NewEvent(model.EventCreated, &model.Message{Reactions: map[string]int{"👍": 2}}), false},
+	}
+	for _, tc := range cases {
+		if actual := checkEvent(c, tc.e); actual != tc.expected {
+			t.Fatalf("%s: expected %v, but %v", tc.name, tc.expected, actual)
+		}
+	}
+}
+
+func TestTimeWindowCheckerが時間帯を判定する(t *testing.T) {
+	jst := time.FixedZone("JST", 9*60*60)
+	cases := []struct {
+		name       string
+		start, end time.Duration
+		now        time.Time
+		expected   bool
+	}{
+		{"inside", 9 * time.Hour, 18 * time.Hour, time.Date(2018, 6, 10, 12, 0, 0, 0, jst), true},
+		{"at start", 9 * time.Hour, 18 * time.Hour, time.Date(2018, 6, 10, 9, 0, 0, 0, jst), true},
+		{"at end", 9 * time.Hour, 18 * time.Hour, time.Date(2018, 6, 10, 18, 0, 0, 0, jst), false},
+		{"before", 9 * time.Hour, 18 * time.Hour, time.Date(2018, 6, 10, 8, 59, 0, 0, jst), false},
+		{"overnight late", 22 * time.Hour, 5 * time.Hour, time.Date(2018, 6, 10, 23, 0, 0, 0, jst), true},
+		{"overnight early", 22 * time.Hour, 5 * time.Hour, time.Date(2018, 6, 10, 4, 0, 0, 0, jst), true},
+		{"overnight outside", 22 * time.Hour, 5 * time.Hour, time.Date(2018, 6, 10, 12, 0, 0, 0, jst), false},
+		// locationの時刻で判定するので、UTCの時刻を渡してもJSTの12時として扱います
+		{"other location", 9 * time.Hour, 18 * time.Hour, time.Date(2018, 6, 10, 3, 0, 0, 0, time.UTC), true},
+	}
+	for _, tc := range cases {
+		c := NewTimeWindowChecker(tc.start, tc.end, jst)
+		now := tc.now
+		c.now = func() time.Time { return now }
+		if actual := c.Check(&model.Message{}); actual != tc.expected {
+			t.Fatalf("%s: expected %v, but %v", tc.name, tc.expected, actual)
+		}
+	}
+}
+
+func TestCooldownCheckerが同じユーザーにduration経つまで反応しない(t *testing.T) {
+	now := time.Date(2018, 6, 10, 9, 0, 0, 0, time.UTC)
+	c := NewCooldownChecker(time.Minute)
+	c.now = func() time.Time { return now }
+
+	steps := []struct {
+		advance  time.Duration
+		msg      *model.Message
+		expected bool
+	}{
+		{0, &model.Message{UserID: 1, Username: "alice"}, true},
+		{30 * time.Second, &model.Message{UserID: 1, Username: "alice"}, false},
+		// 他のユーザーには影響しません
+		{0, &model.Message{UserID: 2, Username: "bob"}, true},
+		// falseを返した時刻は記録しないので、最初にtrueを返してからdurationで反応します
+		{30 * time.Second, &model.Message{UserID: 1, Username: "alice"}, true},
+		{59 * time.Second, &model.Message{UserID: 1, Username: "alice"}, false},
+		// ユーザーIDがない場合は名前で区別します
+		{0, &model.Message{Username: "guest"}, true},
+		{time.Second, &model.Message{Username: "guest"}, false},
+	}
+	for i, s := range steps {
+		now = now.Add(s.advance)
+		if actual := c.Check(s.msg); actual != s.expected {
+			t.Fatalf("step %d: expected %v, but %v", i, s.expected, actual)
+		}
+	}
+}
+
+func TestAndOrNotでCheckerを組み合わせる(t *testing.T) {
+	yes := NewProbabilityChecker(1)
+	no := NewProbabilityChecker(0)
+	cases := []struct {
+		name     string
+		checker  Checker
+		expected bool
+	}{
+		{"and all", And(yes, yes), true},
+		{"and one false", And(yes, no, yes), false},
+		{"and empty", And(), true},
+		{"or one true", Or(no, yes), true},
+		{"or all false", Or(no, no), false},
+		{"or empty", Or(), false},
+		{"not true", Not(yes), false},
+		{"not false", Not(no), true},
+		{"nested", Or(And(yes, no), Not(Or(no, no))), true},
+	}
+	for _, tc := range cases {
+		if actual := tc.checker.Check(&model.Message{}); actual != tc.expected {
+			t.Fatalf("%s: expected %v, but %v", tc.name, tc.expected, actual)
+		}
+		if actual := checkEvent(tc.checker, model.NewEvent(model.EventCreated, &model.Message{})); actual != tc.expected {
+			t.Fatalf("%s: event expected %v, but %v", tc.name, tc.expected, actual)
+		}
+	}
+}
+
+func TestAndCheckerは条件を満たさなければ後ろのcooldownを記録しない(t *testing.T) {
+	now := time.Date(2018, 6, 10, 9, 0, 0, 0, time.UTC)
+	cooldown := NewCooldownChecker(time.Minute)
+	cooldown.now = func() time.Time { return now }
+	c := And(NewCommandChecker("!roll"), cooldown)
+
+	for _, s := range []struct {
+		body     string
+		expected bool
+	}{
+		{"hello", false},
+		{"!roll 2d6", true},
+		{"!roll 2d6", false},
+	} {
+		if actual := c.Check(&model.Message{UserID: 1, Body: s.body}); actual != s.expected {
+			t.Fatalf("%s: expected %v, but %v", s.body, s.expected, actual)
+		}
+	}
+}
+
+func TestSubmatchでCheckerが条件にした部分を取り出す(t *testing.T) {
+	cases := []struct {
+		name     string
+		checker  submatcher
+		body     string
+		expected []string
+	}{
+		{"regexp groups", NewRegexpChecker(`\Aecho (.+) (.+)\z`), "echo a b", []string{"echo a b", "a", "b"}},
+		{"regexp unmatch", NewRegexpChecker(`\Aecho (.+)\z`), "hello", nil},
+		{"prefix", NewPrefixChecker("echo "), "echo hi", []string{"echo hi", "hi"}},
+		{"prefix unmatch", NewPrefixChecker("echo "), "hi", nil},
+		{"exact", NewExactChecker("always"), "always", []string{"always"}},
+		{"exact unmatch", NewExactChecker("always"), "never", nil},
+		{"command only", NewCommandChecker("!roll"), "!roll", []string{"!roll", ""}},
+		{"command args", NewCommandChecker("!roll"), "!roll  2d6 ", []string{"!roll  2d6 ", "2d6"}},
+		{"command suffix", NewCommandChecker("!roll"), "!rollx", nil},
+		// Andは取り出せた最初のcheckerで取り出します
+		{"and", And(NewAuthorKindChecker(model.AuthorUser), NewPrefixChecker("echo "), NewPrefixChecker("echo a")), "echo ab", []string{"echo ab", "ab"}},
+		{"and skips unmatched", And(NewPrefixChecker("/"), NewCommandChecker("!dice")), "!dice 2d6", []string{"!dice 2d6", "2d6"}},
+		{"and with not", And(Not(NewExactChecker("!dice")), NewCommandChecker("!dice")), "!dice 2d6", []string{"!dice 2d6", "2d6"}},
+		{"and without submatcher", And(NewAuthorKindChecker(model.AuthorUser)), "hello", []string{"hello"}},
+		// Orは取り出せた最初のcheckerで取り出します
+		{"or", Or(NewPrefixChecker("!"), NewPrefixChecker("/")), "/help", []string{"/help", "help"}},
+		{"or unmatch", Or(NewPrefixChecker("!"), NewPrefixChecker("/")), "help", []string{"help"}},
+	}
+	for _, tc := range cases {
+		if actual := tc.checker.submatch(tc.body); !reflect.DeepEqual(actual, tc.expected) {
+			t.Fatalf("%s: expected %q, but %q", tc.name, tc.expected, actual)
+		}
+	}
+}
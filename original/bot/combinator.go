@@ -0,0 +1,132 @@
+package bot
+
+import (
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+)
+
+type (
+	// AndChecker は全てのcheckerの条件を満たす場合true、そうでない場合falseを返す構造体です
+	//
+	// 前から順に判定し、条件を満たさないcheckerがあればそれより後ろは判定しません。
+	// CooldownCheckerのように判定すると状態が変わるcheckerは最後に置きます
+	AndChecker struct {
+		checkers []Checker
+	}
+
+	// OrChecker はいずれかのcheckerの条件を満たす場合true、そうでない場合falseを返す構造体です
+	//
+	// 前から順に判定し、条件を満たすcheckerがあればそれより後ろは判定しません
+	OrChecker struct {
+		checkers []Checker
+	}
+
+	// NotChecker はcheckerの条件を満たさない場合true、満たす場合falseを返す構造体です
+	NotChecker struct {
+		checker Checker
+	}
+)
+
+// Check は全てのcheckerの条件を満たす場合true、そうでない場合falseを返します
+func (c *AndChecker) Check(m *model.Message) bool {
+	for _, checker := range c.checkers {
+		if !checker.Check(m) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckEvent は全てのcheckerがeventの条件を満たす場合true、そうでない場合falseを返します
+func (c *AndChecker) CheckEvent(e *model.Event) bool {
+	for _, checker := range c.checkers {
+		if !checkEvent(checker, e) {
+			return false
+		}
+	}
+	return true
+}
+
+// submatch は本文の一部を取り出せた最初のsubmatcherのcheckerが取り出した部分を返します
+//
+// Notなどで本文の一部を取り出せないcheckerは飛ばします
+func (c *AndChecker) submatch(body string) []string {
+	for _, checker := range c.checkers {
+		if s, ok := checker.(submatcher); ok {
+			if groups := s.submatch(body); groups != nil {
+				return groups
+			}
+		}
+	}
+	return []string{body}
+}
+
+// Check はいずれかのcheckerの条件を満たす場合true、そうでない場合falseを返します
+func (c *OrChecker) Check(m *model.Message) bool {
+	for _, checker := range c.checkers {
+		if checker.Check(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckEvent はいずれかのcheckerがeventの条件を満たす場合true、そうでない場合falseを返します
+func (c *OrChecker) CheckEvent(e *model.Event) bool {
+	for _, checker := range c.checkers {
+		if checkEvent(checker, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// submatch は本文の一部を取り出せた最初のsubmatcherのcheckerが取り出した部分を返します
+func (c *OrChecker) submatch(body string) []string {
+	for _, checker := range c.checkers {
+		if s, ok := checker.(submatcher); ok {
+			if groups := s.submatch(body); groups != nil {
+				return groups
+			}
+		}
+	}
+	return []string{body}
+}
+
+// Check はcheckerの条件を満たさない場合true、満たす場合falseを返します
+func (c *NotChecker) Check(m *model.Message) bool {
+	return !c.checker.Check(m)
+}
+
+// CheckEvent はcheckerがeventの条件を満たさない場合true、満たす場合falseを返します
+func (c *NotChecker) CheckEvent(e *model.Event) bool {
+	return !checkEvent(c.checker, e)
+}
+
+// checkEvent はcheckerがEventCheckerの場合はCheckEventで、そうでない場合はeventのmessageをCheckで判定します
+func checkEvent(checker Checker, e *model.Event) bool {
+	if c, ok := checker.(EventChecker); ok {
+		return c.CheckEvent(e)
+	}
+	return checker.Check(e.Message)
+}
+
+// And は全てのcheckersの条件を満たす場合にtrueを返す新しいAndChecker構造体のポインタを返します
+func And(checkers ...Checker) *AndChecker {
+	return &AndChecker{
+		checkers: checkers,
+	}
+}
+
+// Or はいずれかのcheckersの条件を満たす場合にtrueを返す新しいOrChecker構造体のポインタを返します
+func Or(checkers ...Checker) *OrChecker {
+	return &OrChecker{
+		checkers: checkers,
+	}
+}
+
+// Not はcheckerの条件を満たさない場合にtrueを返す新しいNotChecker構造体のポインタを返します
+func Not(checker Checker) *NotChecker {
+	return &NotChecker{
+		checker: checker,
+	}
+}
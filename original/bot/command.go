@@ -0,0 +1,473 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+)
+
+// DefaultCommandPrefix はコマンドの名前の前に付ける文字のデフォルトです
+const DefaultCommandPrefix = "/"
+
+// 引数の型です
+const (
+	// ArgString は文字列の引数です。空白を含む場合は"か'で囲みます
+	ArgString ArgType = iota
+	// ArgInt は整数の引数です
+	ArgInt
+	// ArgFloat は小数の引数です
+	ArgFloat
+	// ArgRest は残りの引数を全て空白でつないだ文字列です。最後の引数にだけ使えます
+	ArgRest
+)
+
+// ErrCommandExists は同じ名前のコマンドを登録しようとした場合のエラーです
+var ErrCommandExists = errors.New("command already exists")
+
+// diceRegexp は"2d6+3"のようなサイコロの式の正規表現です
+var diceRegexp = regexp.MustCompile(`\A(\d*)[dD](\d+)([+-]\d+)?\z`)
+
+type (
+	// ArgType はコマンドの引数の型です
+	ArgType int
+
+	// Command は"/dice 2d6"のようなコマンドの定義です
+	//
+	// Subcommandsがある場合、最初の引数がサブコマンドの名前ならそのサブコマンドを実行します。
+	// そうでない場合はArgsの通りに引数を読み、Handlerを呼びます
+	//
+	//   fields
+	//     Name        string         プレフィックスを除いたコマンドの名前
+	//     Description string         /helpに表示する説明
+	//     Args        []Arg          引数の定義
+	//     Subcommands []*Command     サブコマンド
+	//     Handler     CommandHandler コマンドを実行する関数。nilの場合はサブコマンドが必須になります
+	Command struct {
+		Name        string
+		Description string
+		Args        []Arg
+		Subcommands []*Command
+		Handler     CommandHandler
+	}
+
+	// Arg はコマンドの引数の定義です。Optionalがtrueの引数は省略できます
+	Arg struct {
+		Name     string
+		Type     ArgType
+		Optional bool
+	}
+
+	// CommandHandler はコマンドを実行して返信を作る関数です
+	//
+	// 引数の値が正しくない場合はUsagefのエラーを返すと、使い方を返信します
+	CommandHandler func(ctx context.Context, m *model.Message, args Args) (*model.Message, error)
+
+	// Args は引数の名前をキーにした、Arg.Typeの型に変換済みの引数の値です
+	Args map[string]interface{}
+
+	// UsageError はコマンドの使い方が間違っている場合のエラーです
+	UsageError struct {
+		Reason string
+	}
+
+	// CommandRouter はメッセージ本文をコマンドとして読み、登録されたコマンドに振り分けるcheckerとprocessorです
+	//
+	// 登録されていないコマンドには反応しません。"help"のコマンドは登録されているコマンドの一覧を返します。
+	// HandleはBotを起動する前に呼びます
+	//
+	//   fields
+	//     prefix   string
+	//     commands []*Command 登録した順に/helpに表示します
+	CommandRouter struct {
+		prefix   string
+		commands []*Command
+	}
+)
+
+// Error は使い方が間違っている理由を返します
+func (e *UsageError) Error() string {
+	return e.Reason
+}
+
+// Usagef はformatの理由で使い方が間違っていることを表すエラーを返します
+func Usagef(format string, a ...interface{}) error {
+	return &UsageError{Reason: fmt.Sprintf(format, a...)}
+}
+
+// String は引数nameの文字列を返します。ない場合は空文字列を返します
+func (a Args) String(name string) string {
+	v, _ := a[name].(string)
+	return v
+}
+
+// Int は引数nameの整数を返します。ない場合は0を返します
+func (a Args) Int(name string) int {
+	v, _ := a[name].(int)
+	return v
+}
+
+// Float は引数nameの小数を返します。ない場合は0を返します
+func (a Args) Float(name string) float64 {
+	v, _ := a[name].(float64)
+	return v
+}
+
+// Has は引数nameが指定されたかを返します
+func (a Args) Has(name string) bool {
+	_, ok := a[name]
+	return ok
+}
+
+// usage はpathで呼ばれたコマンドの使い方を"/dice <式>"のような形式で返します
+func (c *Command) usage(path string) string {
+	if c.Handler == nil && len(c.Subcommands) > 0 {
+		names := make([]string, 0, len(c.Subcommands))
+		for _, sub := range c.Subcommands {
+			names = append(names, sub.Name)
+		}
+		return fmt.Sprintf("%s <%s>", path, strings.Join(names, "|"))
+	}
+
+	usage := path
+	for _, arg := range c.Args {
+		name := arg.Name
+		if arg.Type == ArgRest {
+			name += "..."
+		}
+		if arg.Optional {
+			usage += " [" + name + "]"
+		} else {
+			usage += " <" + name + ">"
+		}
+	}
+	return usage
+}
+
+// parseArgs はtokensをArgsの定義に従って変換します
+func (c *Command) parseArgs(tokens []string) (Args, error) {
+	args := Args{}
+	for i, arg := range c.Args {
+		if arg.Type == ArgRest {
+			if i >= len(tokens) {
+				if !arg.Optional {
+					return nil, Usagef("%sを指定してほしいパカ", arg.Name)
+				}
+				return args, nil
+			}
+			args[arg.Name] = strings.Join(tokens[i:], " ")
+			return args, nil
+		}
+
+		if i >= len(tokens) {
+			if !arg.Optional {
+				return nil, Usagef("%sを指定してほしいパカ", arg.Name)
+			}
+			continue
+		}
+
+		token := tokens[i]
+		switch arg.Type {
+		case ArgInt:
+			v, err := strconv.Atoi(token)
+			if err != nil {
+				return nil, Usagef("%sは整数で指定してほしいパカ: %s", arg.Name, token)
+			}
+			args[arg.Name] = v
+		case ArgFloat:
+			v, err := strconv.ParseFloat(token, 64)
+			if err != nil {
+				return nil, Usagef("%sは数で指定してほしいパカ: %s", arg.Name, token)
+			}
+			args[arg.Name] = v
+		default:
+			args[arg.Name] = token
+		}
+	}
+
+	if len(tokens) > len(c.Args) {
+		return nil, Usagef("引数が多すぎるパカ: %s", strings.Join(tokens[len(c.Args):], " "))
+	}
+	return args, nil
+}
+
+// Handle はコマンドcを登録します
+//
+// 同じ名前のコマンドが登録されている場合はErrCommandExistsを返します
+func (r *CommandRouter) Handle(c *Command) error {
+	if r.find(c.Name) != nil {
+		return ErrCommandExists
+	}
+	r.commands = append(r.commands, c)
+	return nil
+}
+
+// Check はメッセージ本文が登録されたコマンドの場合true、そうでない場合falseを返します
+func (r *CommandRouter) Check(m *model.Message) bool {
+	if !strings.HasPrefix(m.Body, r.prefix) {
+		return false
+	}
+	fields := strings.Fields(strings.TrimPrefix(m.Body, r.prefix))
+	return len(fields) > 0 && r.find(fields[0]) != nil
+}
+
+// Process はメッセージ本文のコマンドを実行した結果を返します
+//
+// 使い方が間違っている場合は、理由とコマンドの使い方を返します
+func (r *CommandRouter) Process(ctx context.Context, msgIn *model.Message) (*model.Message, error) {
+	tokens, err := splitArgs(strings.TrimPrefix(msgIn.Body, r.prefix))
+	if err != nil {
+		return &model.Message{Body: err.Error()}, nil
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("bad message: %s", msgIn.Body)
+	}
+
+	c := r.find(tokens[0])
+	if c == nil {
+		return nil, fmt.Errorf("bad message: %s", msgIn.Body)
+	}
+	path := r.prefix + c.Name
+	tokens = tokens[1:]
+	for len(tokens) > 0 {
+		sub := findCommand(c.Subcommands, tokens[0])
+		if sub == nil {
+			break
+		}
+		c = sub
+		path += " " + sub.Name
+		tokens = tokens[1:]
+	}
+
+	if c.Handler == nil {
+		return usageReply(c, path, Usagef("サブコマンドを指定してほしいパカ")), nil
+	}
+	args, err := c.parseArgs(tokens)
+	if err != nil {
+		return usageReply(c, path, err), nil
+	}
+
+	nm, err := c.Handler(ctx, msgIn, args)
+	if ue, ok := err.(*UsageError); ok {
+		return usageReply(c, path, ue), nil
+	}
+	return nm, err
+}
+
+// help は登録されたコマンドの一覧か、引数のコマンドの使い方を返します
+func (r *CommandRouter) help(ctx context.Context, m *model.Message, args Args) (*model.Message, error) {
+	if !args.Has("command") {
+		lines := []string{"コマンド一覧"}
+		for _, c := range r.commands {
+			lines = append(lines, helpLine(c.usage(r.prefix+c.Name), c.Description))
+		}
+		return &model.Message{Body: strings.Join(lines, "\n")}, nil
+	}
+
+	name := strings.TrimPrefix(args.String("command"), r.prefix)
+	c := r.find(name)
+	if c == nil {
+		return nil, Usagef("%s%sというコマンドはないパカ", r.prefix, name)
+	}
+	path := r.prefix + c.Name
+	lines := []string{c.usage(path)}
+	if c.Description != "" {
+		lines = append(lines, c.Description)
+	}
+	for _, sub := range c.Subcommands {
+		lines = append(lines, helpLine(sub.usage(path+" "+sub.Name), sub.Description))
+	}
+	return &model.Message{Body: strings.Join(lines, "\n")}, nil
+}
+
+// helpLine は/helpに表示する、コマンドの使い方と説明の1行を返します
+func helpLine(usage, description string) string {
+	if description == "" {
+		return usage
+	}
+	return usage + " " + description
+}
+
+// find は名前がnameのコマンドを返します。ない場合はnilを返します
+func (r *CommandRouter) find(name string) *Command {
+	return findCommand(r.commands, name)
+}
+
+// findCommand はcommandsのうち名前がnameのコマンドを返します。ない場合はnilを返します
+func findCommand(commands []*Command, name string) *Command {
+	for _, c := range commands {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// usageReply はerrの理由とpathで呼ばれたコマンドcの使い方を本文にしたメッセージを返します
+func usageReply(c *Command, path string, err error) *model.Message {
+	return &model.Message{
+		Body: fmt.Sprintf("%s\n使い方: %s", err, c.usage(path)),
+	}
+}
+
+// splitArgs はsを空白で区切った引数にします
+//
+// "か'で囲んだ部分は空白を含めて1つの引数にします。\の次の文字はそのまま使います
+func splitArgs(s string) ([]string, error) {
+	var (
+		tokens  []string
+		current []rune
+		inToken bool
+		quote   rune
+		escaped bool
+	)
+	for _, c := range s {
+		switch {
+		case escaped:
+			current = append(current, c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inToken = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				current = append(current, c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+			inToken = true
+		case unicode.IsSpace(c):
+			if inToken {
+				tokens = append(tokens, string(current))
+				current = current[:0]
+				inToken = false
+			}
+		default:
+			current = append(current, c)
+			inToken = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, Usagef("%cが閉じていないパカ", quote)
+	}
+	if escaped {
+		return nil, Usagef("\\の後に文字がないパカ")
+	}
+	if inToken {
+		tokens = append(tokens, string(current))
+	}
+	return tokens, nil
+}
+
+// rollDice は"2d6+3"のような式のサイコロを振った結果を"2d6+3 = 12 (4+5+3)"の形式で返します
+func rollDice(expr string) (string, error) {
+	match := diceRegexp.FindStringSubmatch(expr)
+	if match == nil {
+		return "", Usagef("サイコロの式が読めないパカ: %s", expr)
+	}
+
+	count := 1
+	if match[1] != "" {
+		count, _ = strconv.Atoi(match[1])
+	}
+	faces, _ := strconv.Atoi(match[2])
+	if count < 1 || count > 100 || faces < 1 || faces > 1000 {
+		return "", Usagef("サイコロは1から100個、1から1000面までパカ")
+	}
+
+	var rolls []string
+	sum := 0
+	for i := 0; i < count; i++ {
+		n := randIntn(faces) + 1
+		rolls = append(rolls, strconv.Itoa(n))
+		sum += n
+	}
+	detail := strings.Join(rolls, "+")
+	if match[3] != "" {
+		modifier, _ := strconv.Atoi(match[3])
+		sum += modifier
+		detail += match[3]
+	}
+	return fmt.Sprintf("%s = %d (%s)", expr, sum, detail), nil
+}
+
+// NewCommandRouter はprefixで始まるメッセージをコマンドとして読む新しいCommandRouter構造体のポインタを返します
+//
+// "help"のコマンドは最初から登録されています
+func NewCommandRouter(prefix string) *CommandRouter {
+	r := &CommandRouter{
+		prefix: prefix,
+	}
+	r.Handle(&Command{
+		Name:        "help",
+		Description: "コマンドの一覧か、コマンドの使い方を表示します",
+		Args:        []Arg{{Name: "command", Optional: true}},
+		Handler:     r.help,
+	})
+	return r
+}
+
+// NewCommandBot はrouterに登録されたコマンドに返信する新しいBotの構造体のポインタを返します
+func NewCommandBot(name string, router *CommandRouter, out chan *model.Message) *Bot {
+	in := make(chan *model.Event)
+
+	return &Bot{
+		name:      name,
+		in:        in,
+		out:       out,
+		checker:   router,
+		processor: router,
+	}
+}
+
+// NewBuiltinCommandRouter は"/omikuji"、"/keyword <text>"、"/dice 2d6+3"のコマンドを登録した新しいCommandRouter構造体のポインタを返します
+//
+// "/keyword"はextractorでキーワードを抽出します
+func NewBuiltinCommandRouter(extractor KeywordExtractor) *CommandRouter {
+	router := NewCommandRouter(DefaultCommandPrefix)
+	router.Handle(&Command{
+		Name:        "omikuji",
+		Description: "おみくじを引きます",
+		Handler: func(ctx context.Context, m *model.Message, args Args) (*model.Message, error) {
+			return (&OmikujiProcessor{}).Process(ctx, m)
+		},
+	})
+	router.Handle(&Command{
+		Name:        "keyword",
+		Description: "文章からキーワードを抽出します",
+		Args:        []Arg{{Name: "text", Type: ArgRest}},
+		Handler: func(ctx context.Context, m *model.Message, args Args) (*model.Message, error) {
+			keywords, err := extractor.Extract(ctx, args.String("text"))
+			if err != nil {
+				return nil, err
+			}
+			return &model.Message{
+				Body: "キーワード：" + strings.Join(keywords, ", "),
+			}, nil
+		},
+	})
+	router.Handle(&Command{
+		Name:        "dice",
+		Description: "サイコロを振ります。式は2d6+3のように書きます",
+		Args:        []Arg{{Name: "式"}},
+		Handler: func(ctx context.Context, m *model.Message, args Args) (*model.Message, error) {
+			body, err := rollDice(args.String("式"))
+			if err != nil {
+				return nil, err
+			}
+			return &model.Message{
+				Body: body,
+			}, nil
+		},
+	})
+
+	return router
+}
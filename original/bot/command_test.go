@@ -0,0 +1,107 @@
+package bot
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitArgsが空白と引用符で引数を区切る(t *testing.T) {
+	cases := []struct {
+		s        string
+		expected []string
+		err      string
+	}{
+		{s: "", expected: nil},
+		{s: "   ", expected: nil},
+		{s: "a b  c", expected: []string{"a", "b", "c"}},
+		{s: " a\tb\n", expected: []string{"a", "b"}},
+		{s: "あ　い", expected: []string{"あ", "い"}},
+		{s: `"a b" c`, expected: []string{"a b", "c"}},
+		{s: `'a "b"' c`, expected: []string{`a "b"`, "c"}},
+		{s: `x"y z"w`, expected: []string{"xy zw"}},
+		{s: `"" b`, expected: []string{"", "b"}},
+		{s: `a\ b`, expected: []string{"a b"}},
+		{s: `"a\"b"`, expected: []string{`a"b`}},
+		// 'で囲んだ部分では\もそのまま使います
+		{s: `'a\b'`, expected: []string{`a\b`}},
+		{s: `"a b`, err: `"が閉じていないパカ`},
+		{s: `'a b`, err: `'が閉じていないパカ`},
+		{s: `a\`, err: `\の後に文字がないパカ`},
+	}
+	for _, tc := range cases {
+		actual, err := splitArgs(tc.s)
+		if tc.err != "" {
+			if ue, ok := err.(*UsageError); !ok || ue.Reason != tc.err {
+				t.Fatalf("%q: usage error %q expected, but %v", tc.s, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: failed to split: %s", tc.s, err)
+		}
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Fatalf("%q: expected %q, but %q", tc.s, tc.expected, actual)
+		}
+	}
+}
+
+func TestRollDiceが式のサイコロを振る(t *testing.T) {
+	// 1面のサイコロは必ず1なので、結果まで決まります
+	cases := []struct {
+		expr     string
+		expected string
+	}{
+		{"3d1+2", "3d1+2 = 5 (1+1+1+2)"},
+		{"d1", "d1 = 1 (1)"},
+		{"2D1-3", "2D1-3 = -1 (1+1-3)"},
+		{"100d1", fmt.Sprintf("100d1 = 100 (1%s)", strings.Repeat("+1", 99))},
+	}
+	for _, tc := range cases {
+		actual, err := rollDice(tc.expr)
+		if err != nil {
+			t.Fatalf("%s: failed to roll: %s", tc.expr, err)
+		}
+		if actual != tc.expected {
+			t.Fatalf("%s: expected %q, but %q", tc.expr, tc.expected, actual)
+		}
+	}
+
+	// 1面でなければ、合計が出目の範囲に収まることを確かめます
+	for i := 0; i < 100; i++ {
+		actual, err := rollDice("2d6+1")
+		if err != nil {
+			t.Fatalf("failed to roll: %s", err)
+		}
+		var sum, a, b int
+		if _, err := fmt.Sscanf(actual, "2d6+1 = %d (%d+%d+1)", &sum, &a, &b); err != nil {
+			t.Fatalf("unexpected result %q: %s", actual, err)
+		}
+		if a < 1 || a > 6 || b < 1 || b > 6 || sum != a+b+1 {
+			t.Fatalf("unexpected result %q", actual)
+		}
+	}
+}
+
+func TestRollDiceが読めない式や範囲外のサイコロを断る(t *testing.T) {
+	cases := []struct {
+		expr string
+		err  string
+	}{
+		{"x", "サイコロの式が読めないパカ: x"},
+		{"2d", "サイコロの式が読めないパカ: 2d"},
+		{"2d6+", "サイコロの式が読めないパカ: 2d6+"},
+		{" 2d6", "サイコロの式が読めないパカ:  2d6"},
+		{"0d6", "サイコロは1から100個、1から1000面までパカ"},
+		{"101d6", "サイコロは1から100個、1から1000面までパカ"},
+		{"1d0", "サイコロは1から100個、1から1000面までパカ"},
+		{"1d1001", "サイコロは1から100個、1から1000面までパカ"},
+	}
+	for _, tc := range cases {
+		_, err := rollDice(tc.expr)
+		if ue, ok := err.(*UsageError); !ok || ue.Reason != tc.err {
+			t.Fatalf("%q: usage error %q expected, but %v", tc.expr, tc.err, err)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package bot
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+)
+
+// DefaultConversationTimeout はやりとりを続ける時間のデフォルトです
+const DefaultConversationTimeout = 5 * time.Minute
+
+// conversationKey はctxにConversationを入れるためのキーです
+type conversationKey struct{}
+
+type (
+	// Conversations はbotとユーザーのやりとりをDBに保存する構造体です
+	//
+	// やりとりはユーザーとチャンネルごとに1つで、サーバーを再起動しても続きます。
+	// MulticasterはやりとりしているユーザーのメッセージのeventをそのBotにだけ渡します。
+	// Multicasterが全てのメッセージでDBを読まないように、やりとりしているbotはownersにキャッシュします
+	//
+	//   fields
+	//     db     *sql.DB
+	//     now    func() time.Time テストでは時刻を差し替えます
+	//     mu     sync.Mutex
+	//     owners map[ownerKey]owner
+	Conversations struct {
+		db     *sql.DB
+		now    func() time.Time
+		mu     sync.Mutex
+		owners map[ownerKey]owner
+	}
+
+	// ownerKey はやりとりをキャッシュするユーザーとチャンネルの組です
+	ownerKey struct {
+		userID    int64
+		channelID int64
+	}
+
+	// owner はユーザーがチャンネルでやりとりしているbotです。botNameが空の場合はやりとりしていません
+	//
+	//   fields
+	//     botName string
+	//     expires time.Time
+	owner struct {
+		botName string
+		expires time.Time
+	}
+
+	// Conversation はbotとユーザーのチャンネルでの一続きのやりとりです
+	//
+	// Botはユーザーのメッセージに反応する時に、processorに渡すctxにConversationを入れます。
+	// processorはStartでやりとりを始めると、同じユーザーの同じチャンネルでの次のメッセージをcheckerの判定なしで受け取ります。
+	// Activeでやりとりの続きかを判定し、Stateで前に保存した値を読み出します。Endを呼ぶか、期限を過ぎるとやりとりは終わります。
+	// やりとりの続きのメッセージが届くたびに、期限はその時からStartのttlが経つまでにのびます
+	//
+	//   fields
+	//     conversations *Conversations
+	//     botName       string
+	//     userID        int64
+	//     channelID     int64
+	//     state         string
+	//     active        bool
+	Conversation struct {
+		conversations *Conversations
+		botName       string
+		userID        int64
+		channelID     int64
+		state         string
+		active        bool
+	}
+)
+
+// conversational はeventがやりとりの続きになれるメッセージの作成かを返します
+//
+// ログインしたユーザーが投稿したメッセージだけがやりとりの続きになります
+func conversational(e *model.Event) bool {
+	if e.Type != model.EventCreated || e.Message.UserID == 0 {
+		return false
+	}
+	return e.Message.AuthorKind == "" || e.Message.AuthorKind == model.AuthorUser
+}
+
+// owner はmのユーザーがmのチャンネルでやりとりしているbotの名前を返します。やりとりがない場合は空文字列を返します
+//
+// ユーザーとチャンネルごとに最初の1回だけDBから読み出します
+func (cs *Conversations) owner(m *model.Message) (string, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	k := ownerKey{userID: m.UserID, channelID: m.ChannelID}
+	o, ok := cs.owners[k]
+	if !ok {
+		c, err := model.ConversationByUser(cs.db, m.UserID, m.ChannelID, cs.now())
+		switch {
+		case err == sql.ErrNoRows:
+		case err != nil:
+			return "", err
+		default:
+			o = owner{botName: c.BotName, expires: c.Expires}
+		}
+		cs.owners[k] = o
+	}
+	if o.botName == "" || !o.expires.After(cs.now()) {
+		return "", nil
+	}
+	return o.botName, nil
+}
+
+// load はbotNameのbotとmのユーザーのmのチャンネルでのやりとりを返します
+//
+// やりとりの途中であれば、mはやりとりの続きなので期限をのばします。やりとりがない場合は、まだ始めていないConversationを返します
+//
+// 全てのbotがユーザーのメッセージごとに呼ぶので、ownerのキャッシュでこのbotとやりとりしていることが分かった場合だけDBから読み出します
+func (cs *Conversations) load(botName string, m *model.Message) (*Conversation, error) {
+	conv := &Conversation{
+		conversations: cs,
+		botName:       botName,
+		userID:        m.UserID,
+		channelID:     m.ChannelID,
+	}
+	name, err := cs.owner(m)
+	if err != nil {
+		return nil, err
+	}
+	if name != botName {
+		return conv, nil
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	now := cs.now()
+	c, err := model.ConversationByUser(cs.db, m.UserID, m.ChannelID, now)
+	switch {
+	case err == sql.ErrNoRows:
+		return conv, nil
+	case err != nil:
+		return nil, err
+	}
+	if c.BotName != botName {
+		return conv, nil
+	}
+
+	if err := c.Extend(cs.db, now); err != nil {
+		return nil, err
+	}
+	cs.owners[ownerKey{userID: c.UserID, channelID: c.ChannelID}] = owner{botName: c.BotName, expires: c.Expires}
+	conv.state = c.State
+	conv.active = true
+	return conv, nil
+}
+
+// Clean は期限を過ぎた全てのやりとりを削除します
+func (cs *Conversations) Clean() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	now := cs.now()
+	for k, o := range cs.owners {
+		if !o.expires.After(now) {
+			delete(cs.owners, k)
+		}
+	}
+	return model.DeleteExpiredConversations(cs.db, now)
+}
+
+// Active はやりとりの途中であればtrue、そうでなければfalseを返します
+func (c *Conversation) Active() bool {
+	return c.active
+}
+
+// State はやりとりに保存されている値を返します
+func (c *Conversation) State() string {
+	return c.state
+}
+
+// Start はstateを保存してやりとりを始めます。やりとりの途中であればstateを保存し直して続けます
+//
+// ttlが経つまでに次のメッセージがなければやりとりは終わります。次のメッセージが届くと、その時からttlが経つまでにのばします。
+// ttlが0以下の場合はDefaultConversationTimeoutです。
+// ユーザーが同じチャンネルで他のbotとやりとりしていた場合は、そのやりとりを終わらせます
+func (c *Conversation) Start(state string, ttl time.Duration) error {
+	if ttl <= 0 {
+		ttl = DefaultConversationTimeout
+	}
+	cs := c.conversations
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	mc := &model.Conversation{
+		UserID:    c.userID,
+		ChannelID: c.channelID,
+		BotName:   c.botName,
+		State:     state,
+		Expires:   cs.now().Add(ttl),
+		TTL:       ttl,
+	}
+	if err := mc.Save(cs.db); err != nil {
+		return err
+	}
+	cs.owners[ownerKey{userID: c.userID, channelID: c.channelID}] = owner{botName: c.botName, expires: mc.Expires}
+	c.state = state
+	c.active = true
+	return nil
+}
+
+// End はやりとりを終わらせます
+func (c *Conversation) End() error {
+	cs := c.conversations
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	mc := &model.Conversation{
+		UserID:    c.userID,
+		ChannelID: c.channelID,
+		BotName:   c.botName,
+	}
+	if err := mc.Delete(cs.db); err != nil {
+		return err
+	}
+	// 他のbotが新しいやりとりを始めていた場合は、そのやりとりを残します
+	k := ownerKey{userID: c.userID, channelID: c.channelID}
+	if o, ok := cs.owners[k]; ok && o.botName == c.botName {
+		cs.owners[k] = owner{}
+	}
+	c.state = ""
+	c.active = false
+	return nil
+}
+
+// WithConversation はcを入れたctxを返します
+func WithConversation(ctx context.Context, c *Conversation) context.Context {
+	return context.WithValue(ctx, conversationKey{}, c)
+}
+
+// ConversationFromContext はctxに入っているConversationを返します。ない場合はnilを返します
+func ConversationFromContext(ctx context.Context) *Conversation {
+	c, _ := ctx.Value(conversationKey{}).(*Conversation)
+	return c
+}
+
+// NewConversations はdbにやりとりを保存する新しいConversations構造体のポインタを返します
+func NewConversations(db *sql.DB) *Conversations {
+	return &Conversations{
+		db:     db,
+		now:    time.Now,
+		owners: map[ownerKey]owner{},
+	}
+}
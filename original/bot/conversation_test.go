@@ -0,0 +1,84 @@
+package bot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/db/dbtest"
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+)
+
+func TestConversationsがやりとりの続きのメッセージで期限をのばす(t *testing.T) {
+	now := time.Date(2018, 6, 10, 9, 0, 0, 0, time.UTC)
+	cs := NewConversations(dbtest.Open(t))
+	cs.now = func() time.Time { return now }
+	m := &model.Message{UserID: 1, ChannelID: 1}
+
+	conv, err := cs.load("quizbot", m)
+	if err != nil {
+		t.Fatalf("failed to load: %s", err)
+	}
+	if err := conv.Start("q1", time.Minute); err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+
+	steps := []struct {
+		advance  time.Duration
+		load     bool
+		expected string
+	}{
+		// 期限の前に続きのメッセージが届くと、その時から1分後までのびます
+		{50 * time.Second, true, "quizbot"},
+		{50 * time.Second, false, "quizbot"},
+		{11 * time.Second, false, ""},
+	}
+	for i, s := range steps {
+		now = now.Add(s.advance)
+		if s.load {
+			conv, err := cs.load("quizbot", m)
+			if err != nil {
+				t.Fatalf("step %d: failed to load: %s", i, err)
+			}
+			if !conv.Active() || conv.State() != "q1" {
+				t.Fatalf("step %d: active conversation expected, but %+v", i, conv)
+			}
+		}
+		if actual, err := cs.owner(m); err != nil || actual != s.expected {
+			t.Fatalf("step %d: owner %q expected, but %q (%v)", i, s.expected, actual, err)
+		}
+		// DBに保存した期限ものびていることを確かめます
+		_, err := model.ConversationByUser(cs.db, m.UserID, m.ChannelID, now)
+		if actual := err == nil; actual != (s.expected != "") {
+			t.Fatalf("step %d: saved conversation expected %v, but %v", i, s.expected != "", err)
+		}
+	}
+}
+
+func TestConversationsは他のbotのやりとりの期限をのばさない(t *testing.T) {
+	now := time.Date(2018, 6, 10, 9, 0, 0, 0, time.UTC)
+	cs := NewConversations(dbtest.Open(t))
+	cs.now = func() time.Time { return now }
+	m := &model.Message{UserID: 1, ChannelID: 1}
+
+	conv, err := cs.load("quizbot", m)
+	if err != nil {
+		t.Fatalf("failed to load: %s", err)
+	}
+	if err := conv.Start("q1", time.Minute); err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+
+	now = now.Add(50 * time.Second)
+	other, err := cs.load("otherbot", m)
+	if err != nil {
+		t.Fatalf("failed to load: %s", err)
+	}
+	if other.Active() {
+		t.Fatalf("inactive conversation expected, but active")
+	}
+
+	now = now.Add(11 * time.Second)
+	if actual, err := cs.owner(m); err != nil || actual != "" {
+		t.Fatalf("expired conversation expected, but owner %q (%v)", actual, err)
+	}
+}
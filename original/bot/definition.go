@@ -0,0 +1,635 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+	"gopkg.in/yaml.v2"
+)
+
+// checkerの種類です
+const (
+	CheckerRegexp      = "regexp"
+	CheckerPrefix      = "prefix"
+	CheckerExact       = "exact"
+	CheckerCommand     = "command"
+	CheckerAuthorKind  = "author_kind"
+	CheckerUsername    = "username"
+	CheckerChannel     = "channel"
+	CheckerTimeWindow  = "time_window"
+	CheckerProbability = "probability"
+	CheckerCooldown    = "cooldown"
+)
+
+// processorの種類です
+const (
+	ProcessorChoice   = "choice"
+	ProcessorTemplate = "template"
+	ProcessorHTTP     = "http"
+	ProcessorExec     = "exec"
+)
+
+// ErrInvalidDefinition はbotを作れない定義が書かれていた場合のエラーです
+var ErrInvalidDefinition = errors.New("invalid bot definition")
+
+type (
+	// Definitions はbots.ymlに書かれたbotの定義の一覧です
+	Definitions struct {
+		Bots []*Definition `yaml:"bots"`
+	}
+
+	// Definition はbots.ymlに書くbotの定義です
+	//
+	//   fields
+	//     Name      string        botの名前。チャンネルでbotを有効にする時に使います
+	//     Checker   CheckerDef    反応するメッセージの条件。Scheduleを書いた場合は省略できます
+	//     Schedule  *ScheduleDef  予定の時刻に投稿する設定
+	//     Processor ProcessorDef  返信の作り方
+	//     Timeout   time.Duration 1つのメッセージの返信を作るのにかけられる時間。省略した場合はDefaultProcessTimeoutです
+	//     OnError   ErrorPolicy   返信を作れなかった時の扱い
+	Definition struct {
+		Name      string        `yaml:"name"`
+		Checker   CheckerDef    `yaml:"checker"`
+		Schedule  *ScheduleDef  `yaml:"schedule"`
+		Processor ProcessorDef  `yaml:"processor"`
+		Timeout   time.Duration `yaml:"timeout"`
+		OnError   ErrorPolicy   `yaml:"on_error"`
+	}
+
+	// ScheduleDef はbotが予定の時刻に投稿する設定の定義です
+	//
+	// CronかEveryのどちらかを書きます。Timezoneを省略した場合はサーバーのタイムゾーンで時刻を決めます
+	//
+	//   fields
+	//     Cron     string        cronの書式の予定。詳しくはCronScheduleを見てください
+	//     Every    time.Duration 0時からの間隔の予定。1日以下にします
+	//     Timezone string        予定の時刻を決めるタイムゾーン
+	//     Channels []int64       投稿するチャンネル
+	//     Missed   MissedPolicy  botが止まっていた間に過ぎた予定の時刻の扱い。省略した場合はMissedSkipです
+	ScheduleDef struct {
+		Cron     string        `yaml:"cron"`
+		Every    time.Duration `yaml:"every"`
+		Timezone string        `yaml:"timezone"`
+		Channels []int64       `yaml:"channels"`
+		Missed   MissedPolicy  `yaml:"missed"`
+	}
+
+	// CheckerDef はbotが反応するメッセージの条件の定義です
+	//
+	// And、Or、Notのいずれかを書いた場合は、Typeの代わりにそれらの条件を組み合わせます。
+	// そうでない場合はTypeによって使うフィールドが異なります
+	//
+	//   CheckerRegexp      Patternにマッチするメッセージ
+	//   CheckerPrefix      Patternで始まるメッセージ
+	//   CheckerExact       Patternと一致するメッセージ
+	//   CheckerCommand     Patternそのものか、Patternと空白で始まるメッセージ
+	//   CheckerAuthorKind  投稿者の種類がKind(userかbot)のメッセージ
+	//   CheckerUsername    Usernamesのいずれかのユーザーのメッセージ
+	//   CheckerChannel     Channelsのいずれかのチャンネルのメッセージ
+	//   CheckerTimeWindow  TimezoneでStart("15:04"の書式)からEndまでの間のメッセージ
+	//   CheckerProbability 確率Probabilityで全てのメッセージ
+	//   CheckerCooldown    同じユーザーに前回反応してからDurationが経ったメッセージ
+	CheckerDef struct {
+		Type        string        `yaml:"type"`
+		Pattern     string        `yaml:"pattern"`
+		Kind        string        `yaml:"kind"`
+		Usernames   []string      `yaml:"usernames"`
+		Channels    []int64       `yaml:"channels"`
+		Start       string        `yaml:"start"`
+		End         string        `yaml:"end"`
+		Timezone    string        `yaml:"timezone"`
+		Probability float64       `yaml:"probability"`
+		Duration    time.Duration `yaml:"duration"`
+		And         []*CheckerDef `yaml:"and"`
+		Or          []*CheckerDef `yaml:"or"`
+		Not         *CheckerDef   `yaml:"not"`
+	}
+
+	// ProcessorDef はbotの返信の作り方の定義です
+	//
+	// Typeによって使うフィールドが異なります
+	//
+	//   ProcessorChoice   Choicesから重みに応じてランダムに1つ選んで返します
+	//   ProcessorTemplate Templateを展開して返します
+	//   ProcessorHTTP     URL, Method, Header, BodyでJSONのAPIを呼び、結果のうちResultの位置の値をTemplateで展開して返します
+	//   ProcessorExec     Command, Args, Envで起動したプログラムに返信を作らせます。詳しくはExecProcessorを見てください
+	//
+	// Template, URL, Header, Bodyはtext/templateの書式で、TemplateDataの値とenv関数(環境変数)を使えます
+	ProcessorDef struct {
+		Type     string            `yaml:"type"`
+		Choices  []Choice          `yaml:"choices"`
+		Template string            `yaml:"template"`
+		URL      string            `yaml:"url"`
+		Method   string            `yaml:"method"`
+		Header   map[string]string `yaml:"header"`
+		Body     string            `yaml:"body"`
+		Result   string            `yaml:"result"`
+		Command  string            `yaml:"command"`
+		Args     []string          `yaml:"args"`
+		Env      map[string]string `yaml:"env"`
+		Timeout  time.Duration     `yaml:"timeout"`
+	}
+
+	// Choice はProcessorChoiceで選ぶ返信と、その重みです。Weightを省略した場合は1です
+	Choice struct {
+		Text   string `yaml:"text"`
+		Weight int    `yaml:"weight"`
+	}
+
+	// TemplateData はbots.ymlのテンプレートに渡す値です
+	//
+	//   fields
+	//     Message *model.Message 反応したメッセージ
+	//     Groups  []string       checkerが条件にした部分。Groups[0]は本文全体です
+	//     Text    string         prefixより後ろの部分や正規表現の最初のグループ。ない場合は本文全体です
+	//     Result  interface{}    ProcessorHTTPの場合のAPIの結果
+	TemplateData struct {
+		Message *model.Message
+		Groups  []string
+		Text    string
+		Result  interface{}
+	}
+
+	// ChoiceProcessor は重み付きの候補からランダムに1つ選んだメッセージを作るprocessorの構造体です
+	ChoiceProcessor struct {
+		choices []Choice
+		total   int
+	}
+
+	// TemplateProcessor はテンプレートを展開したメッセージを作るprocessorの構造体です
+	TemplateProcessor struct {
+		matcher  submatcher
+		template *template.Template
+	}
+
+	// HTTPProcessor はJSONのAPIを呼び、その結果を使ったメッセージを作るprocessorの構造体です
+	HTTPProcessor struct {
+		matcher  submatcher
+		method   string
+		url      *template.Template
+		header   map[string]*template.Template
+		body     *template.Template
+		result   string
+		template *template.Template
+	}
+)
+
+// ParseDefinitions はyamlのbotの定義を読み込みます
+func ParseDefinitions(b []byte) (*Definitions, error) {
+	var defs Definitions
+	if err := yaml.UnmarshalStrict(b, &defs); err != nil {
+		return nil, err
+	}
+	return &defs, nil
+}
+
+// NewBotFromDefinition はdefの定義で、outに投稿用messageを渡す新しいBotの構造体のポインタを返します
+func NewBotFromDefinition(def *Definition, out chan *model.Message) (*Bot, error) {
+	if def.Name == "" {
+		return nil, fmt.Errorf("%s: name is missing", ErrInvalidDefinition)
+	}
+
+	// 予定の時刻に投稿するbotはcheckerを省略できます
+	var checker Checker
+	if def.Schedule == nil || !def.Checker.empty() {
+		var err error
+		if checker, err = newCheckerFromDef(&def.Checker); err != nil {
+			return nil, fmt.Errorf("%s: %s: %s", ErrInvalidDefinition, def.Name, err)
+		}
+	}
+	processor, err := newProcessorFromDef(&def.Processor, matcherOf(checker))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: %s", ErrInvalidDefinition, def.Name, err)
+	}
+
+	b := &Bot{
+		name:      def.Name,
+		in:        make(chan *model.Event),
+		out:       out,
+		checker:   checker,
+		processor: processor,
+		timeout:   def.Timeout,
+		onError:   def.OnError,
+	}
+	if def.Schedule != nil {
+		if b.trigger, err = newTriggerFromDef(def.Schedule); err != nil {
+			return nil, fmt.Errorf("%s: %s: %s", ErrInvalidDefinition, def.Name, err)
+		}
+	}
+	return b, nil
+}
+
+// empty はcheckerの定義が書かれていない場合true、そうでない場合falseを返します
+func (def *CheckerDef) empty() bool {
+	return def.Type == "" && def.And == nil && def.Or == nil && def.Not == nil
+}
+
+// newTriggerFromDef はdefの定義で新しいTrigger構造体のポインタを返します
+func newTriggerFromDef(def *ScheduleDef) (*Trigger, error) {
+	var (
+		location *time.Location
+		err      error
+	)
+	if def.Timezone != "" {
+		if location, err = time.LoadLocation(def.Timezone); err != nil {
+			return nil, err
+		}
+	}
+
+	t := &Trigger{
+		Channels: def.Channels,
+		Missed:   def.Missed,
+	}
+	switch {
+	case def.Cron != "" && def.Every != 0:
+		return nil, errors.New("either cron or every must be specified, not both")
+	case def.Cron != "":
+		t.Schedule, err = ParseCron(def.Cron, location)
+	case def.Every != 0:
+		t.Schedule, err = NewIntervalSchedule(def.Every, location)
+	default:
+		return nil, errors.New("cron or every is missing")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// newCheckerFromDef はdefの定義でcheckerを作ります
+func newCheckerFromDef(def *CheckerDef) (Checker, error) {
+	switch {
+	case def.And != nil:
+		checkers, err := newCheckersFromDefs(def.And)
+		if err != nil {
+			return nil, err
+		}
+		return And(checkers...), nil
+	case def.Or != nil:
+		checkers, err := newCheckersFromDefs(def.Or)
+		if err != nil {
+			return nil, err
+		}
+		return Or(checkers...), nil
+	case def.Not != nil:
+		checker, err := newCheckerFromDef(def.Not)
+		if err != nil {
+			return nil, err
+		}
+		return Not(checker), nil
+	}
+
+	switch def.Type {
+	case CheckerRegexp, CheckerPrefix, CheckerExact, CheckerCommand:
+		if def.Pattern == "" {
+			return nil, errors.New("checker pattern is missing")
+		}
+	}
+
+	switch def.Type {
+	case CheckerRegexp:
+		r, err := regexp.Compile(def.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		return &RegexpChecker{regexp: r}, nil
+	case CheckerPrefix:
+		return NewPrefixChecker(def.Pattern), nil
+	case CheckerExact:
+		return NewExactChecker(def.Pattern), nil
+	case CheckerCommand:
+		return NewCommandChecker(def.Pattern), nil
+	case CheckerAuthorKind:
+		if def.Kind != model.AuthorUser && def.Kind != model.AuthorBot {
+			return nil, fmt.Errorf("unknown author kind %q", def.Kind)
+		}
+		return NewAuthorKindChecker(def.Kind), nil
+	case CheckerUsername:
+		if len(def.Usernames) == 0 {
+			return nil, errors.New("usernames are missing")
+		}
+		return NewUsernameChecker(def.Usernames...), nil
+	case CheckerChannel:
+		if len(def.Channels) == 0 {
+			return nil, errors.New("channels are missing")
+		}
+		return NewChannelChecker(def.Channels...), nil
+	case CheckerTimeWindow:
+		return newTimeWindowChecker(def)
+	case CheckerProbability:
+		if def.Probability < 0 || def.Probability > 1 {
+			return nil, fmt.Errorf("probability %v must be between 0 and 1", def.Probability)
+		}
+		return NewProbabilityChecker(def.Probability), nil
+	case CheckerCooldown:
+		if def.Duration <= 0 {
+			return nil, errors.New("cooldown duration is missing")
+		}
+		return NewCooldownChecker(def.Duration), nil
+	}
+	return nil, fmt.Errorf("unknown checker type %q", def.Type)
+}
+
+// newCheckersFromDefs はdefsの定義でcheckerを順に作ります
+func newCheckersFromDefs(defs []*CheckerDef) ([]Checker, error) {
+	if len(defs) == 0 {
+		return nil, errors.New("checkers are missing")
+	}
+
+	checkers := make([]Checker, 0, len(defs))
+	for _, d := range defs {
+		c, err := newCheckerFromDef(d)
+		if err != nil {
+			return nil, err
+		}
+		checkers = append(checkers, c)
+	}
+	return checkers, nil
+}
+
+// newTimeWindowChecker はdefの定義で新しいTimeWindowChecker構造体のポインタを返します
+func newTimeWindowChecker(def *CheckerDef) (*TimeWindowChecker, error) {
+	start, err := parseTimeOfDay(def.Start)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseTimeOfDay(def.End)
+	if err != nil {
+		return nil, err
+	}
+
+	location := time.Local
+	if def.Timezone != "" {
+		location, err = time.LoadLocation(def.Timezone)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewTimeWindowChecker(start, end, location), nil
+}
+
+// parseTimeOfDay は"15:04"の書式の時刻を、0時からの経過時間にします
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("bad time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// matcherOf はcheckerが条件にした部分を取り出すsubmatcherを返します
+//
+// checkerがsubmatcherでない場合は、本文全体を取り出します
+func matcherOf(checker Checker) submatcher {
+	if s, ok := checker.(submatcher); ok {
+		return s
+	}
+	return wholeBody{}
+}
+
+// wholeBody は本文全体を取り出すsubmatcherです
+type wholeBody struct{}
+
+// submatch は本文全体を返します
+func (wholeBody) submatch(body string) []string {
+	return []string{body}
+}
+
+// newProcessorFromDef はdefの定義でprocessorを作ります
+func newProcessorFromDef(def *ProcessorDef, matcher submatcher) (Processor, error) {
+	switch def.Type {
+	case ProcessorChoice:
+		p, err := newChoiceProcessor(def.Choices)
+		if err != nil {
+			return nil, err
+		}
+		return WithContext(p), nil
+	case ProcessorTemplate:
+		t, err := parseTemplate("template", def.Template)
+		if err != nil {
+			return nil, err
+		}
+		return WithContext(&TemplateProcessor{matcher: matcher, template: t}), nil
+	case ProcessorHTTP:
+		return newHTTPProcessor(def, matcher)
+	case ProcessorExec:
+		if def.Command == "" {
+			return nil, errors.New("command is missing")
+		}
+		p := NewExecProcessor(def.Command, def.Args...)
+		for k, v := range def.Env {
+			p.Env = append(p.Env, k+"="+v)
+		}
+		if def.Timeout > 0 {
+			p.Timeout = def.Timeout
+		}
+		return p, nil
+	}
+	return nil, fmt.Errorf("unknown processor type %q", def.Type)
+}
+
+// newChoiceProcessor はchoicesから選ぶ新しいChoiceProcessor構造体のポインタを返します
+func newChoiceProcessor(choices []Choice) (*ChoiceProcessor, error) {
+	if len(choices) == 0 {
+		return nil, errors.New("choices are missing")
+	}
+
+	p := &ChoiceProcessor{}
+	for _, c := range choices {
+		if c.Weight < 0 {
+			return nil, fmt.Errorf("weight of %q must not be negative", c.Text)
+		}
+		if c.Weight == 0 {
+			c.Weight = 1
+		}
+		p.choices = append(p.choices, c)
+		p.total += c.Weight
+	}
+	return p, nil
+}
+
+// newHTTPProcessor はdefの定義で新しいHTTPProcessor構造体のポインタを返します
+func newHTTPProcessor(def *ProcessorDef, matcher submatcher) (*HTTPProcessor, error) {
+	p := &HTTPProcessor{
+		matcher: matcher,
+		method:  strings.ToUpper(def.Method),
+		header:  map[string]*template.Template{},
+		result:  def.Result,
+	}
+	if p.method == "" {
+		p.method = http.MethodGet
+	}
+
+	var err error
+	if def.URL == "" {
+		return nil, errors.New("url is missing")
+	}
+	if p.url, err = parseTemplate("url", def.URL); err != nil {
+		return nil, err
+	}
+	if p.body, err = parseTemplate("body", def.Body); err != nil {
+		return nil, err
+	}
+	for k, v := range def.Header {
+		if p.header[k], err = parseTemplate(k, v); err != nil {
+			return nil, err
+		}
+	}
+	// テンプレートを省略した場合は結果をそのまま返します
+	tmpl := def.Template
+	if tmpl == "" {
+		tmpl = "{{.Result}}"
+	}
+	if p.template, err = parseTemplate("template", tmpl); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Process はchoicesから重みに応じてランダムに選んだbodyがセットされたメッセージのポインタを返します
+func (p *ChoiceProcessor) Process(msgIn *model.Message) (*model.Message, error) {
+	n := randIntn(p.total)
+	for _, c := range p.choices {
+		if n < c.Weight {
+			return &model.Message{
+				Body: c.Text,
+			}, nil
+		}
+		n -= c.Weight
+	}
+	// totalは重みの合計なのでここには来ません
+	return nil, errors.New("no choice selected")
+}
+
+// Process はテンプレートを展開したbodyがセットされたメッセージのポインタを返します
+func (p *TemplateProcessor) Process(msgIn *model.Message) (*model.Message, error) {
+	data, err := newTemplateData(msgIn, p.matcher)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := execute(p.template, data)
+	if err != nil {
+		return nil, err
+	}
+	return &model.Message{
+		Body: body,
+	}, nil
+}
+
+// Process はAPIを呼び、その結果をテンプレートで展開したbodyがセットされたメッセージのポインタを返します
+func (p *HTTPProcessor) Process(ctx context.Context, msgIn *model.Message) (*model.Message, error) {
+	data, err := newTemplateData(msgIn, p.matcher)
+	if err != nil {
+		return nil, err
+	}
+
+	requestURL, err := execute(p.url, data)
+	if err != nil {
+		return nil, err
+	}
+	body, err := execute(p.body, data)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	for k, t := range p.header {
+		v, err := execute(t, data)
+		if err != nil {
+			return nil, err
+		}
+		header.Set(k, v)
+	}
+
+	var response interface{}
+	if err := doJSON(ctx, p.method, requestURL, header, body, &response); err != nil {
+		return nil, err
+	}
+	if data.Result, err = lookup(response, p.result); err != nil {
+		return nil, err
+	}
+
+	reply, err := execute(p.template, data)
+	if err != nil {
+		return nil, err
+	}
+	return &model.Message{
+		Body: reply,
+	}, nil
+}
+
+// newTemplateData はmのテンプレートに渡す値を作ります
+func newTemplateData(m *model.Message, matcher submatcher) (*TemplateData, error) {
+	groups := matcher.submatch(m.Body)
+	if groups == nil {
+		return nil, fmt.Errorf("bad message: %s", m.Body)
+	}
+
+	data := &TemplateData{
+		Message: m,
+		Groups:  groups,
+		Text:    groups[0],
+	}
+	if len(groups) > 1 {
+		data.Text = groups[1]
+	}
+	return data, nil
+}
+
+// parseTemplate はbots.ymlのテンプレートを読み込みます
+func parseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(template.FuncMap{
+		"env": os.Getenv,
+	}).Parse(text)
+}
+
+// execute はtをdataで展開します
+func execute(t *template.Template, data *TemplateData) (string, error) {
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// lookup はvからpathの位置の値を返します
+//
+// pathは"results.0.reply"のように、オブジェクトのキーと配列の添字を.で区切ったものです。空の場合はvを返します
+func lookup(v interface{}, path string) (interface{}, error) {
+	if path == "" {
+		return v, nil
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		switch x := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = x[key]; !ok {
+				return nil, fmt.Errorf("no such key in response: %s", path)
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(x) {
+				return nil, fmt.Errorf("no such index in response: %s", path)
+			}
+			v = x[i]
+		default:
+			return nil, fmt.Errorf("no such value in response: %s", path)
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,285 @@
+package bot
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+)
+
+const (
+	// DefaultExecTimeout はExecProcessorがプログラムの返信を待つ時間のデフォルトです
+	DefaultExecTimeout = 5 * time.Second
+	// DefaultRestartDelay はExecProcessorが終了したプログラムを起動し直すまでの時間のデフォルトです
+	DefaultRestartDelay = time.Second
+	// maxRestartDelay は続けて終了するプログラムを起動し直すまでの時間の上限です
+	maxRestartDelay = 30 * time.Second
+)
+
+var (
+	// errExecTimeout はプログラムがTimeoutまでに返信しなかった場合のエラーです
+	errExecTimeout = errors.New("plugin timed out")
+	// errExecNotRunning はプログラムが起動していない場合のエラーです
+	errExecNotRunning = errors.New("plugin is not running")
+)
+
+type (
+	// ExecRequest はExecProcessorがプログラムに送るリクエストです
+	ExecRequest struct {
+		ID      int64          `json:"id"`
+		Message *model.Message `json:"message"`
+	}
+
+	// ExecResponse はプログラムがExecProcessorに返すレスポンスです
+	ExecResponse struct {
+		ID      int64          `json:"id"`
+		Message *model.Message `json:"message"`
+		Error   string         `json:"error,omitempty"`
+	}
+
+	// ExecProcessor は外部のプログラムと、標準入出力で1行に1つのJSONをやりとりして返信を作るprocessorの構造体です
+	//
+	// 1つのメッセージにつき、サーバーからプログラムの標準入力にExecRequestを1行で書き込みます
+	//
+	//   {"id": 1, "message": {"id": 10, "body": "hello", "username": "testuser", "user_id": 2, "channel_id": 1, "parent_id": 0, "reply_count": 0, "reactions": {}, "author_kind": "user", "bot_name": "", "chain_depth": 0}}
+	//
+	// プログラムは同じidのExecResponseを1行で標準出力に書き込みます。messageはmodel.Messageと同じ形で、bodyだけを指定すれば十分です。
+	// 返信しない場合はmessageをnullに、失敗した場合はerrorにメッセージを入れます
+	//
+	//   {"id": 1, "message": {"body": "hello, world!"}}
+	//   {"id": 2, "message": null}
+	//   {"id": 3, "error": "something went wrong"}
+	//
+	// プログラムはRunで起動し、ctxが終了するまで動かし続けます。
+	// 標準エラー出力はサーバーのログに出します。プログラムが終了した場合はRestartDelayの後に起動し直します
+	//
+	//   fields
+	//     Path         string        プログラムのパス
+	//     Args         []string      プログラムの引数
+	//     Env          []string      サーバーの環境変数に追加する"KEY=value"の形の環境変数
+	//     Timeout      time.Duration 1つのメッセージの返信を待つ時間
+	//     RestartDelay time.Duration 終了したプログラムを起動し直すまでの時間
+	//     requests     chan *execCall
+	ExecProcessor struct {
+		Path         string
+		Args         []string
+		Env          []string
+		Timeout      time.Duration
+		RestartDelay time.Duration
+		requests     chan *execCall
+	}
+
+	// execCall はProcessからRunに渡す1つのメッセージの処理です
+	execCall struct {
+		message *model.Message
+		reply   chan *ExecResponse
+	}
+)
+
+// Process はメッセージをプログラムに送り、プログラムが返したメッセージのポインタを返します
+//
+// Timeoutかctxの期限の早い方までにプログラムが返信しなければエラーを返します
+func (p *ExecProcessor) Process(ctx context.Context, msgIn *model.Message) (*model.Message, error) {
+	call := &execCall{
+		message: msgIn,
+		reply:   make(chan *ExecResponse, 1),
+	}
+
+	timer := time.NewTimer(p.Timeout)
+	defer timer.Stop()
+
+	select {
+	case p.requests <- call:
+	case <-timer.C:
+		return nil, errExecNotRunning
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case resp := <-call.reply:
+		switch {
+		case resp.Error != "":
+			return nil, errors.New(resp.Error)
+		case resp.Message == nil:
+			return nil, ErrNoReply
+		}
+		return resp.Message, nil
+	case <-timer.C:
+		return nil, errExecTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Run はプログラムを起動し、ctxが終了するまで終了したプログラムを起動し直します
+//
+// ctxが終了するとプログラムを止め、終了するまで待ってから返ります
+func (p *ExecProcessor) Run(ctx context.Context) {
+	delay := p.RestartDelay
+	for {
+		started := time.Now()
+		if err := p.serve(ctx); err != nil {
+			log.Printf("%s: %s", p.Path, err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		// しばらく動いていた場合は、すぐに起動し直します
+		if time.Since(started) > maxRestartDelay {
+			delay = p.RestartDelay
+		}
+		log.Printf("%s: restarting in %s", p.Path, delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+	}
+}
+
+// serve はプログラムを1回起動し、終了するまでリクエストを送り続けます
+func (p *ExecProcessor) serve(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, p.Path, p.Args...)
+	cmd.Env = append(os.Environ(), p.Env...)
+	cmd.Stderr = &logWriter{prefix: p.Path}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	responses := make(chan *ExecResponse)
+	exited := make(chan error, 1)
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		exited <- readResponses(ctx, stdout, responses)
+	}()
+
+	err = p.dispatch(ctx, stdin, responses, exited)
+	stdin.Close()
+	cancel()
+	// Waitはstdoutを閉じるので、読み終わるのを待ってから呼びます
+	<-readerDone
+	if werr := cmd.Wait(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+// dispatch はProcessから受け取ったメッセージをプログラムに送り、レスポンスを返します
+//
+// プログラムの標準出力が閉じられるか、ctxが終了すると返ります
+func (p *ExecProcessor) dispatch(ctx context.Context, w io.Writer, responses chan *ExecResponse, exited chan error) error {
+	enc := json.NewEncoder(w)
+	var id int64
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-exited:
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		case resp := <-responses:
+			log.Printf("%s: ignored response %d", p.Path, resp.ID)
+		case call := <-p.requests:
+			id++
+			if err := enc.Encode(&ExecRequest{ID: id, Message: call.message}); err != nil {
+				call.reply <- &ExecResponse{ID: id, Error: err.Error()}
+				return err
+			}
+
+			// Processが諦めた後に届いたレスポンスは捨てます
+			timer := time.NewTimer(p.Timeout)
+		wait:
+			for {
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return nil
+				case err := <-exited:
+					timer.Stop()
+					call.reply <- &ExecResponse{ID: id, Error: "plugin exited"}
+					if err == nil {
+						err = io.ErrUnexpectedEOF
+					}
+					return err
+				case resp := <-responses:
+					if resp.ID != id {
+						log.Printf("%s: ignored response %d", p.Path, resp.ID)
+						continue
+					}
+					call.reply <- resp
+					break wait
+				case <-timer.C:
+					break wait
+				}
+			}
+			timer.Stop()
+		}
+	}
+}
+
+// readResponses はrから1行ずつレスポンスを読んでresponsesに渡します
+func readResponses(ctx context.Context, r io.Reader, responses chan *ExecResponse) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var resp ExecResponse
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			return fmt.Errorf("invalid response: %s", err)
+		}
+		select {
+		case responses <- &resp:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// logWriter は書き込まれた内容をログに出すio.Writerです
+type logWriter struct {
+	prefix string
+}
+
+// Write はpをログに出します
+func (w *logWriter) Write(p []byte) (int, error) {
+	log.Printf("%s: %s", w.prefix, p)
+	return len(p), nil
+}
+
+// NewExecProcessor はpathのプログラムをargsの引数で動かす新しいExecProcessor構造体のポインタを返します
+func NewExecProcessor(path string, args ...string) *ExecProcessor {
+	return &ExecProcessor{
+		Path:         path,
+		Args:         args,
+		Timeout:      DefaultExecTimeout,
+		RestartDelay: DefaultRestartDelay,
+		requests:     make(chan *execCall),
+	}
+}
@@ -0,0 +1,208 @@
+package bot
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/env"
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+	"github.com/ikawaha/kagome.ipadic/tokenizer"
+)
+
+const (
+	keywordAPIURLFormat = "https://jlp.yahooapis.jp/KeyphraseService/V1/extract?appid=%s&sentence=%s&output=json"
+
+	// DefaultKeywordLimit はLocalKeywordExtractorが返すキーワードの数のデフォルトです
+	DefaultKeywordLimit = 5
+)
+
+// キーワードを抽出する方法です
+const (
+	// KeywordBackendLocal はLocalKeywordExtractorで抽出します
+	KeywordBackendLocal = "local"
+	// KeywordBackendYahoo はYahooKeywordExtractorで抽出します
+	KeywordBackendYahoo = "yahoo"
+)
+
+type (
+	// KeywordExtractor はテキストからキーワードを抽出するインターフェースです
+	//
+	// キーワードは重要なものから順に返します
+	KeywordExtractor interface {
+		Extract(ctx context.Context, text string) ([]string, error)
+	}
+
+	// LocalKeywordExtractor は形態素解析で取り出した名詞を、DBのメッセージでのTF-IDFの順に並べてキーワードにする構造体です
+	//
+	// 辞書はプログラムに埋め込まれているので、外部のAPIを呼びません。連続した名詞は1つの複合語にします。
+	// 多くのメッセージに出てくる語ほど順位を下げます。DBがnilの場合はテキストの中での出現回数だけで並べます
+	//
+	//   fields
+	//     DB        *sql.DB
+	//     Limit     int       返すキーワードの最大数
+	//     once      sync.Once 辞書の読み込みは重いので、最初に使う時に1度だけ行います
+	//     tokenizer tokenizer.Tokenizer
+	LocalKeywordExtractor struct {
+		DB        *sql.DB
+		Limit     int
+		once      sync.Once
+		tokenizer tokenizer.Tokenizer
+	}
+
+	// YahooKeywordExtractor はYahoo!のキーフレーズ抽出APIでキーワードを抽出する構造体です
+	YahooKeywordExtractor struct {
+		AppID string
+	}
+
+	// keywordScore はキーワードの候補とそのスコアです
+	keywordScore struct {
+		term  string
+		score float64
+	}
+)
+
+// Extract はtextの名詞をTF-IDFの高い順に最大Limit個返します
+func (e *LocalKeywordExtractor) Extract(ctx context.Context, text string) ([]string, error) {
+	e.once.Do(func() {
+		e.tokenizer = tokenizer.New()
+	})
+
+	var terms []string
+	counts := map[string]int{}
+	for _, term := range e.nouns(text) {
+		if counts[term] == 0 {
+			terms = append(terms, term)
+		}
+		counts[term]++
+	}
+
+	total, dfs, err := e.count(ctx, terms)
+	if err != nil {
+		return nil, err
+	}
+	scores := make([]keywordScore, 0, len(terms))
+	for i, term := range terms {
+		idf := math.Log(float64(total+1)/float64(dfs[i]+1)) + 1
+		scores = append(scores, keywordScore{term: term, score: float64(counts[term]) * idf})
+	}
+	// スコアが同じ場合はテキストに先に出てきた語を前にします
+	sort.SliceStable(scores, func(i, j int) bool {
+		return scores[i].score > scores[j].score
+	})
+
+	limit := e.Limit
+	if limit <= 0 {
+		limit = DefaultKeywordLimit
+	}
+	keywords := make([]string, 0, limit)
+	for _, s := range scores {
+		if len(keywords) == limit {
+			break
+		}
+		keywords = append(keywords, s.term)
+	}
+	return keywords, nil
+}
+
+// nouns はtextを形態素解析し、名詞と連続した名詞をつないだ複合語を出現順に返します
+//
+// 代名詞や非自立の名詞は区切りとして扱い、数や接尾辞だけの語は返しません
+func (e *LocalKeywordExtractor) nouns(text string) []string {
+	var (
+		nouns    []string
+		compound []string
+		content  bool
+	)
+	flush := func() {
+		if content {
+			nouns = append(nouns, strings.Join(compound, ""))
+		}
+		compound = compound[:0]
+		content = false
+	}
+
+	for _, token := range e.tokenizer.Tokenize(text) {
+		features := token.Features()
+		if len(features) < 2 || features[0] != "名詞" || strings.TrimSpace(token.Surface) == "" {
+			flush()
+			continue
+		}
+		switch features[1] {
+		case "代名詞", "非自立":
+			flush()
+			continue
+		case "数", "接尾":
+		default:
+			content = true
+		}
+		compound = append(compound, token.Surface)
+	}
+	flush()
+	return nouns
+}
+
+// count は全てのメッセージの件数と、本文にtermsのそれぞれを含むメッセージの件数を返します。DBがnilの場合は全て0を返します
+func (e *LocalKeywordExtractor) count(ctx context.Context, terms []string) (int64, []int64, error) {
+	if e.DB == nil || len(terms) == 0 {
+		return 0, make([]int64, len(terms)), nil
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+	return model.MessagesCountContainingEach(e.DB, terms)
+}
+
+// Extract はYahoo!のキーフレーズ抽出APIでtextからキーワードを抽出します
+func (e *YahooKeywordExtractor) Extract(ctx context.Context, text string) ([]string, error) {
+	requestURL := fmt.Sprintf(keywordAPIURLFormat, e.AppID, url.QueryEscape(text))
+
+	var response map[string]interface{}
+	if err := get(ctx, requestURL, &response); err != nil {
+		return nil, err
+	}
+
+	scores := make([]keywordScore, 0, len(response))
+	for k, v := range response {
+		if k == "Error" {
+			return nil, fmt.Errorf("%#v", v)
+		}
+		score, _ := v.(float64)
+		scores = append(scores, keywordScore{term: k, score: score})
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		return scores[i].score > scores[j].score
+	})
+
+	keywords := make([]string, 0, len(scores))
+	for _, s := range scores {
+		keywords = append(keywords, s.term)
+	}
+	return keywords, nil
+}
+
+// NewLocalKeywordExtractor はdbのメッセージでキーワードを順位付けする新しいLocalKeywordExtractor構造体のポインタを返します
+func NewLocalKeywordExtractor(db *sql.DB) *LocalKeywordExtractor {
+	return &LocalKeywordExtractor{
+		DB:    db,
+		Limit: DefaultKeywordLimit,
+	}
+}
+
+// NewKeywordExtractor はbackendの方法でキーワードを抽出するKeywordExtractorを返します
+//
+// KeywordBackendLocalか空の場合はdbのメッセージで順位付けし、KeywordBackendYahooの場合はenv.KeywordAPIAppIDでAPIを呼びます
+func NewKeywordExtractor(backend string, db *sql.DB) (KeywordExtractor, error) {
+	switch backend {
+	case KeywordBackendLocal, "":
+		return NewLocalKeywordExtractor(db), nil
+	case KeywordBackendYahoo:
+		return &YahooKeywordExtractor{AppID: env.KeywordAPIAppID}, nil
+	}
+	return nil, fmt.Errorf("unknown keyword backend %q", backend)
+}
@@ -0,0 +1,54 @@
+package bot
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/db/dbtest"
+)
+
+func TestLocalKeywordExtractorが名詞をTFIDFの順に並べる(t *testing.T) {
+	// カレーは全てのメッセージに、今日は一部のメッセージに出てきて、渋谷はどのメッセージにも出てきません
+	history := []string{"今日のカレー", "今日もカレー", "今日はカレー"}
+	for i := 0; i < 7; i++ {
+		history = append(history, "カレーを食べた")
+	}
+
+	cases := []struct {
+		name     string
+		history  []string
+		limit    int
+		text     string
+		expected []string
+	}{
+		// DBがない場合はテキストの中での出現回数で並べ、同じ場合は先に出てきた語を前にします
+		{name: "without db", text: "今日は渋谷でカレーを食べた", expected: []string{"今日", "渋谷", "カレー"}},
+		{name: "term frequency", text: "渋谷でカレー、新宿でもカレー", expected: []string{"カレー", "渋谷", "新宿"}},
+		// 連続した名詞は1つの複合語にします
+		{name: "compound", text: "渋谷のカレー屋", expected: []string{"渋谷", "カレー屋"}},
+		// 多くのメッセージに出てくる語ほど後ろにします
+		{name: "idf", history: history, text: "今日は渋谷でカレーを食べた", expected: []string{"渋谷", "今日", "カレー"}},
+		{name: "limit", history: history, limit: 2, text: "今日は渋谷でカレーを食べた", expected: []string{"渋谷", "今日"}},
+		{name: "no nouns", history: history, text: "とても美味しかった", expected: []string{}},
+	}
+	for _, tc := range cases {
+		e := NewLocalKeywordExtractor(nil)
+		if tc.history != nil {
+			db := dbtest.Open(t)
+			dbtest.InsertMessages(t, db, tc.history...)
+			e.DB = db
+		}
+		if tc.limit > 0 {
+			e.Limit = tc.limit
+		}
+
+		actual, err := e.Extract(context.Background(), tc.text)
+		if err != nil {
+			t.Fatalf("%s: failed to extract: %s", tc.name, err)
+		}
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Fatalf("%s: expected %v, but %v", tc.name, tc.expected, actual)
+		}
+	}
+}
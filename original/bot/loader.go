@@ -0,0 +1,132 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+)
+
+// DefaultReloadInterval はLoaderがbots.ymlの変更を確認する間隔のデフォルトです
+const DefaultReloadInterval = 2 * time.Second
+
+// Loader はbots.ymlに定義されたbotをMulticasterに登録し、ファイルが変更されたら登録し直す構造体です
+//
+// ファイルから消えたbotは登録を解除し、定義が変わったbotは作り直します。
+// ファイルが読めない場合や定義が不正な場合は、ログに出して前回読み込んだbotをそのまま動かします。
+// APIなどで同じ名前のbotが先に登録されていた場合は、そのbotを残してファイルの定義は登録しません
+//
+//   fields
+//     Path        string
+//     Interval    time.Duration
+//     multicaster *Multicaster
+//     out         chan *model.Message
+//     content     []byte
+//     defs        map[string]*Definition 登録できたbotの定義
+//     bots        map[string]*Bot        登録したbot。解除する時は名前ではなくこのbotを指定します
+type Loader struct {
+	Path        string
+	Interval    time.Duration
+	multicaster *Multicaster
+	out         chan *model.Message
+	content     []byte
+	defs        map[string]*Definition
+	bots        map[string]*Bot
+}
+
+// Run はbots.ymlを読み込み、ctxが終了するまでInterval毎に変更を確認します
+func (l *Loader) Run(ctx context.Context) {
+	l.reload()
+
+	ticker := time.NewTicker(l.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.reload()
+		}
+	}
+}
+
+// reload はbots.ymlが前回から変わっていれば読み込み直します
+func (l *Loader) reload() {
+	content, err := ioutil.ReadFile(l.Path)
+	if os.IsNotExist(err) {
+		// ファイルが消された場合は全てのbotを止めます
+		content, err = nil, nil
+	}
+	if err != nil {
+		log.Printf("loader: %s", err)
+		return
+	}
+	if l.defs != nil && bytes.Equal(content, l.content) {
+		return
+	}
+
+	defs, err := ParseDefinitions(content)
+	if err != nil {
+		log.Printf("loader: %s: %s", l.Path, err)
+		return
+	}
+	bots := map[string]*Bot{}
+	next := map[string]*Definition{}
+	for _, def := range defs.Bots {
+		b, err := NewBotFromDefinition(def, l.out)
+		if err != nil {
+			log.Printf("loader: %s: %s", l.Path, err)
+			return
+		}
+		bots[def.Name] = b
+		next[def.Name] = def
+	}
+
+	for name, def := range l.defs {
+		if nd, ok := next[name]; ok && reflect.DeepEqual(def, nd) {
+			// 変わっていないbotはそのまま動かします
+			delete(bots, name)
+			continue
+		}
+		// APIなどで登録を解除され、同じ名前で登録し直されたbotは解除しません
+		if err := l.multicaster.unregisterBot(l.bots[name]); err != nil && err != ErrBotNotFound {
+			log.Printf("loader: %s: %s", name, err)
+		}
+		delete(l.bots, name)
+	}
+	pending := false
+	for name, b := range bots {
+		if err := l.multicaster.Register(b); err != nil {
+			log.Printf("loader: %s: %s", name, err)
+			delete(next, name)
+			pending = true
+			continue
+		}
+		l.bots[name] = b
+	}
+
+	// 登録できなかったbotがある場合は、ファイルが変わっていなくても次の確認で登録し直します
+	if !pending {
+		l.content = content
+	}
+	l.defs = next
+	log.Printf("loader: loaded %d bots from %s", len(next), l.Path)
+}
+
+// NewLoader はpathのファイルに定義されたbotをmcに登録する新しいLoader構造体のポインタを返します
+//
+// 登録したbotはoutに投稿用messageを渡します
+func NewLoader(path string, mc *Multicaster, out chan *model.Message) *Loader {
+	return &Loader{
+		Path:        path,
+		Interval:    DefaultReloadInterval,
+		multicaster: mc,
+		out:         out,
+		bots:        map[string]*Bot{},
+	}
+}
@@ -2,49 +2,299 @@ package bot
 
 import (
 	"context"
+	"errors"
+	"log"
+	"sync"
 
 	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
 )
 
+// DefaultMaxChainDepth はbotの返信にbotが返信し続けられる深さのデフォルトです
+const DefaultMaxChainDepth = 3
+
+var (
+	// ErrBotExists は同じ名前のbotが既に登録されている場合のエラーです
+	ErrBotExists = errors.New("bot already exists")
+	// ErrBotNotFound は登録されていない名前のbotが指定された場合のエラーです
+	ErrBotNotFound = errors.New("bot not found")
+	// ErrNotRunning はMulticasterが起動していない、または停止した後にbotを登録しようとした場合のエラーです
+	ErrNotRunning = errors.New("multicaster is not running")
+)
+
 // Multicaster は1つのチャンネルで複数botを動かすためのヘルパーです
 //
-// msgInで受け取ったmessageをbotsに登録された全botに渡します
+// msgInで受け取ったeventを、botsに登録された全botのキューに入れます。
+// 各botはそれぞれのキューから順番にeventを受け取るので、処理の遅いbotが他のbotやmsgInへの送信を止めることはありません
+//
+// botsへの登録はBotInかRegisterで行い、Unregisterで解除します。
+// 登録したbotのgoroutineはMulticasterが起動し、登録を解除するかRunのctxが終了すると停止します。
+// キューの設定はQueuesにbotの名前で指定し、ない場合はQueueを使います
+//
+// Filterが設定されている場合は、Filterがtrueを返したbotにだけ渡します。
+// Filterは全てのeventでbotごとに呼ぶので、DBを読むなどの時間のかかる処理はキャッシュしてください
 //
-// botsへの登録はBotInで行います
+// botが無限に返信し合わないように、botには自分が投稿したメッセージのeventを渡しません。
+// また、ChainDepthがMaxChainDepth以上のメッセージのeventはどのbotにも渡しません。
+// MaxChainDepthを1にすると、botはユーザーのメッセージにだけ反応します
+//
+// Storeが設定されている場合は、登録したbotにbotの名前のnamespaceのStoreを渡します
+//
+// Conversationsが設定されている場合は、登録したbotにConversationsを渡します。
+// ユーザーが登録されているbotとやりとりしている場合は、そのユーザーのそのチャンネルでのメッセージのeventをそのbotにだけ渡します
+//
+// Clockが設定されている場合は、登録したbotにClockを渡します。予定の時刻に投稿するbotはClockのタイムゾーンで時刻を決めます
 //
 //   fields
-// 	   BotIn chan *Bot
-// 	   bots  map[*Bot]bool
-// 	   msgIn chan *model.Message
+// 	   BotIn         chan *Bot
+// 	   Filter        func(bot *Bot, msg *model.Message) bool
+// 	   MaxChainDepth int
+// 	   Queue         QueueConfig
+// 	   Queues        map[string]QueueConfig
+// 	   Store         *Store
+// 	   Conversations *Conversations
+// 	   Clock         Clock
+// 	   mu            sync.Mutex
+// 	   ctx           context.Context
+// 	   queues        []*queue
+// 	   msgIn         chan *model.Event
 type Multicaster struct {
-	BotIn chan *Bot
-	bots  []*Bot
-	msgIn chan *model.Message
+	BotIn         chan *Bot
+	Filter        func(bot *Bot, msg *model.Message) bool
+	MaxChainDepth int
+	Queue         QueueConfig
+	Queues        map[string]QueueConfig
+	Store         *Store
+	Conversations *Conversations
+	Clock         Clock
+	mu            sync.Mutex
+	ctx           context.Context
+	queues        []*queue
+	msgIn         chan *model.Event
 }
 
 // Run はMulticasterを起動します
 func (mc *Multicaster) Run(ctx context.Context) {
+	mc.mu.Lock()
+	mc.ctx = ctx
+	mc.mu.Unlock()
+
 	for {
 		select {
 		case <-ctx.Done():
-			close(mc.msgIn)
+			mc.mu.Lock()
+			queues := mc.queues
+			mc.queues = nil
+			mc.mu.Unlock()
+			for _, q := range queues {
+				q.stop()
+			}
+			// msgInはHubが送り続けている場合があるので閉じません。閉じるのは送る側です
 			return
 		case bot := <-mc.BotIn:
-			mc.bots = append(mc.bots, bot)
+			if err := mc.Register(bot); err != nil {
+				log.Printf("multicaster: %s: %s", bot.name, err)
+			}
 		case msg := <-mc.msgIn:
-			for _, bot := range mc.bots {
-				bot.in <- msg
+			if msg.Message.ChainDepth >= mc.MaxChainDepth {
+				log.Printf("multicaster: message %d reached max chain depth %d", msg.Message.ID, mc.MaxChainDepth)
+				break
 			}
+			mc.mu.Lock()
+			queues := mc.queues
+			mc.mu.Unlock()
+
+			owner := mc.owner(queues, msg)
+			for _, q := range queues {
+				if msg.Message.BotName == q.bot.name {
+					continue
+				}
+				if owner != "" && owner != q.bot.name {
+					continue
+				}
+				if mc.Filter != nil && !mc.Filter(q.bot, msg.Message) {
+					continue
+				}
+				q.push(msg)
+			}
+		}
+	}
+}
+
+// owner はeventのユーザーがやりとりしているbotの名前を返します
+//
+// やりとりしていないか、やりとりしているbotがqueuesに登録されていないか、Filterでそのチャンネルでは無効になっている場合は
+// 空文字列を返すので、eventは全botに渡します
+func (mc *Multicaster) owner(queues []*queue, e *model.Event) string {
+	if mc.Conversations == nil || !conversational(e) {
+		return ""
+	}
+	name, err := mc.Conversations.owner(e.Message)
+	if err != nil {
+		log.Printf("multicaster: %s", err)
+		return ""
+	}
+	for _, q := range queues {
+		if q.bot.name != name {
+			continue
+		}
+		// 無効になったbotがやりとりの期限までユーザーのメッセージを独り占めしないようにします
+		if mc.Filter != nil && !mc.Filter(q.bot, e.Message) {
+			return ""
 		}
+		return name
+	}
+	return ""
+}
+
+// Register はbotを登録し、botのgoroutineを起動します
+//
+// 同じ名前のbotが既に登録されている場合はErrBotExistsを返します
+func (mc *Multicaster) Register(bot *Bot) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if mc.ctx == nil || mc.ctx.Err() != nil {
+		return ErrNotRunning
+	}
+	if mc.find(bot.name) != nil {
+		return ErrBotExists
+	}
+
+	if mc.Store != nil && bot.store == nil {
+		bot.store = mc.Store.Namespace(bot.name)
+	}
+	if mc.Conversations != nil && bot.conversations == nil {
+		bot.conversations = mc.Conversations
+	}
+	if mc.Clock != nil && bot.clock == nil {
+		bot.clock = mc.Clock
+	}
+
+	config, ok := mc.Queues[bot.name]
+	if !ok {
+		config = mc.Queue
+	}
+	q := newQueue(bot, config)
+	q.start(mc.ctx)
+
+	// Runが読んでいる間に書き換えないように、新しいスライスを作ります
+	queues := make([]*queue, len(mc.queues), len(mc.queues)+1)
+	copy(queues, mc.queues)
+	mc.queues = append(queues, q)
+
+	return nil
+}
+
+// Unregister はnameのbotの登録を解除し、botのgoroutineが停止するまで待ちます
+//
+// キューに残っているeventは捨てます。nameのbotが登録されていない場合はErrBotNotFoundを返します
+func (mc *Multicaster) Unregister(name string) error {
+	return mc.unregister(func(b *Bot) bool { return b.name == name })
+}
+
+// unregisterBot はbotの登録を解除します。botが登録されていない場合はErrBotNotFoundを返します
+//
+// LoaderとScriptLoaderは、同じ名前で他から登録されたbotを解除しないように、自分が登録したbotを指定して解除します
+func (mc *Multicaster) unregisterBot(bot *Bot) error {
+	return mc.unregister(func(b *Bot) bool { return b == bot })
+}
+
+// unregister はmatchがtrueを返すbotの登録を解除し、botのgoroutineが停止するまで待ちます
+func (mc *Multicaster) unregister(match func(b *Bot) bool) error {
+	mc.mu.Lock()
+	var q *queue
+	queues := make([]*queue, 0, len(mc.queues))
+	for _, v := range mc.queues {
+		if q == nil && match(v.bot) {
+			q = v
+			continue
+		}
+		queues = append(queues, v)
+	}
+	mc.queues = queues
+	mc.mu.Unlock()
+
+	if q == nil {
+		return ErrBotNotFound
+	}
+	q.stop()
+
+	return nil
+}
+
+// Pause はnameのbotを一時停止します。一時停止中に届いたeventはbotに渡しません
+func (mc *Multicaster) Pause(name string) error {
+	return mc.setPaused(name, true)
+}
+
+// Resume は一時停止したnameのbotを再開します
+func (mc *Multicaster) Resume(name string) error {
+	return mc.setPaused(name, false)
+}
+
+// setPaused はnameのbotを一時停止するか、再開します
+func (mc *Multicaster) setPaused(name string, paused bool) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	q := mc.find(name)
+	if q == nil {
+		return ErrBotNotFound
+	}
+	q.setPaused(paused)
+
+	return nil
+}
+
+// find はnameのbotのキューを返します。mc.muをロックしてから呼びます
+func (mc *Multicaster) find(name string) *queue {
+	for _, q := range mc.queues {
+		if q.bot.name == name {
+			return q
+		}
+	}
+	return nil
+}
+
+// BotStatus は登録されているbotの状態です
+type BotStatus struct {
+	Name   string `json:"name"`
+	Paused bool   `json:"paused"`
+}
+
+// Bots は登録されている全botの状態を登録順に返します
+func (mc *Multicaster) Bots() []BotStatus {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	bots := make([]BotStatus, 0, len(mc.queues))
+	for _, q := range mc.queues {
+		bots = append(bots, BotStatus{Name: q.bot.name, Paused: q.isPaused()})
+	}
+	return bots
+}
+
+// Stats は登録されている全botのキューの状態を返します
+func (mc *Multicaster) Stats() []QueueStats {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	stats := make([]QueueStats, 0, len(mc.queues))
+	for _, q := range mc.queues {
+		stats = append(stats, q.stats())
 	}
+	return stats
 }
 
 // NewMulticaster は新しいMulticaster構造体のポインタを返します
-func NewMulticaster(msgIn chan *model.Message) *Multicaster {
+func NewMulticaster(msgIn chan *model.Event) *Multicaster {
 	memberIn := make(chan *Bot)
 	return &Multicaster{
-		BotIn: memberIn,
-		bots:  []*Bot{},
-		msgIn: msgIn,
+		BotIn:         memberIn,
+		MaxChainDepth: DefaultMaxChainDepth,
+		Queue:         DefaultQueueConfig,
+		Queues:        map[string]QueueConfig{},
+		queues:        []*queue{},
+		msgIn:         msgIn,
 	}
 }
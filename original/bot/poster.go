@@ -2,34 +2,83 @@ package bot
 
 import (
 	"context"
+	"encoding/json"
+	"log"
+	"net/http"
 
 	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
 )
 
 type (
-	// Poster はInに渡されたmessageをPOSTするための構造体です
+	// Poster はInに渡されたmessageを投稿するための構造体です
+	//
+	// Createが設定されている場合は、Createを呼んでサーバー内で直接投稿します。
+	// 設定されていない場合はURLの/api/messagesにPOSTします。サーバーとは別のプロセスでbotを動かす場合に使います。
+	// Headerはその場合にリクエストに付けるヘッダーで、botユーザーの認証情報などを設定します
+	//
+	//   fields
+	//     In     chan *model.Message
+	//     Create func(ctx context.Context, m *model.Message) (*model.Message, error)
+	//     URL    string
+	//     Header http.Header
 	Poster struct {
-		In chan *model.Message
+		In     chan *model.Message
+		Create func(ctx context.Context, m *model.Message) (*model.Message, error)
+		URL    string
+		Header http.Header
 	}
 )
 
 // Run はPosterを起動します
-func (p *Poster) Run(ctx context.Context, url string) {
+//
+// 投稿に失敗したmessageはログに出して捨てます
+func (p *Poster) Run(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
-			close(p.In)
+			// Inはbotが遅れた返信を送ってくる場合があるので閉じません。閉じるのは送る側です
 			return
 		case m := <-p.In:
-			postJSON(url+"/api/messages", m, nil)
+			if err := p.post(ctx, m); err != nil {
+				log.Printf("poster: %s", err)
+			}
 		}
 	}
 }
 
-// NewPoster は新しいPoster構造体のポインタを返します
-func NewPoster(bufferSize int) *Poster {
+// post はmを投稿します
+func (p *Poster) post(ctx context.Context, m *model.Message) error {
+	if p.Create != nil {
+		_, err := p.Create(ctx, m)
+		return err
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	var out interface{}
+	return doJSON(ctx, http.MethodPost, p.URL+"/api/messages", p.Header, string(data), &out)
+}
+
+// NewPoster はcreateを呼んでサーバー内で投稿する新しいPoster構造体のポインタを返します
+//
+// createにはRunのctxを渡します
+func NewPoster(bufferSize int, create func(ctx context.Context, m *model.Message) (*model.Message, error)) *Poster {
+	in := make(chan *model.Message, bufferSize)
+	return &Poster{
+		In:     in,
+		Create: create,
+		Header: http.Header{},
+	}
+}
+
+// NewHTTPPoster はurlのサーバーのAPIにPOSTして投稿する新しいPoster構造体のポインタを返します
+func NewHTTPPoster(bufferSize int, url string) *Poster {
 	in := make(chan *model.Message, bufferSize)
 	return &Poster{
-		In: in,
+		In:     in,
+		URL:    url,
+		Header: http.Header{},
 	}
 }
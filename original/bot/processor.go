@@ -1,34 +1,93 @@
 package bot
 
 import (
+	"context"
+	"errors"
 	"regexp"
 	"strings"
+	"time"
 
 	"fmt"
 
-	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/env"
 	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
-	"net/url"
 )
 
-const (
-	keywordAPIURLFormat = "https://jlp.yahooapis.jp/KeyphraseService/V1/extract?appid=%s&sentence=%s&output=json"
-)
+// keywordRegexp はKeywordProcessorが反応するメッセージの正規表現です
+var keywordRegexp = regexp.MustCompile("\\Akeyword (.+)")
+
+// ErrNoReply はprocessorが返信しないことを選んだ場合のエラーです。Botは何も投稿しません
+var ErrNoReply = errors.New("no reply")
 
 type (
 	// Processor はmessageを受け取り、投稿用messageを作るインターフェースです
+	//
+	// ctxが終了したら処理を止めて、ctx.Err()を返します。ErrNoReplyを返した場合、Botは何も投稿しません
 	Processor interface {
+		Process(ctx context.Context, message *model.Message) (*model.Message, error)
+	}
+
+	// MultiProcessor は1つのmessageから0個以上の返信を作るprocessorのインターフェースです
+	//
+	// processorがMultiProcessorを実装している場合、BotはProcessではなくProcessAllを呼び、返された順に投稿します。
+	// 空のスライスを返した場合は何も投稿しません
+	MultiProcessor interface {
+		ProcessAll(ctx context.Context, message *model.Message) ([]*Reply, error)
+	}
+
+	// Reply はMultiProcessorが作る返信です
+	//
+	// Delayが0より大きい場合は、返信を作ってからDelayが経った後に投稿します。その前にBotが停止した場合は投稿しません
+	Reply struct {
+		Message *model.Message
+		Delay   time.Duration
+	}
+
+	// SimpleProcessor はctxを受け取らないprocessorのインターフェースです
+	//
+	// すぐに終わる処理はSimpleProcessorとして書き、WithContextでProcessorにして使います
+	SimpleProcessor interface {
 		Process(message *model.Message) (*model.Message, error)
 	}
 
+	// Runner はbotが動いている間、裏で動かし続ける必要があるprocessorのインターフェースです
+	//
+	// BotはRunを起動してからeventを受け取り始め、停止する時はctxを終了してRunが返るのを待ちます
+	Runner interface {
+		Run(ctx context.Context)
+	}
+
 	// HelloWorldProcessor は"hello, world!"メッセージを作るprocessorの構造体です
 	HelloWorldProcessor struct{}
 
 	// OmikujiProcessor は"大吉", "吉", "中吉", "小吉", "末吉", "凶"のいずれかをランダムで作るprocessorの構造体です
+	//
+	// 引いた結果はStoreに保存します
 	OmikujiProcessor struct{}
 
-	// KeywordProcessor はメッセージ本文からキーワードを抽出するprocessorの構造体です
-	KeywordProcessor struct{}
+	// KeywordProcessor はメッセージ本文からextractorでキーワードを抽出するprocessorの構造体です
+	KeywordProcessor struct {
+		extractor KeywordExtractor
+	}
+
+	// simpleProcessor はSimpleProcessorをProcessorとして使うためのアダプターです
+	simpleProcessor struct {
+		processor SimpleProcessor
+	}
+
+	// processResult はsimpleProcessorがprocessorの結果を受け取るための構造体です
+	processResult struct {
+		message *model.Message
+		err     error
+	}
+
+	// ReactionProcessor はリアクションが集まったことを祝うメッセージを作るprocessorの構造体です
+	ReactionProcessor struct{}
+
+	// ReplyProcessor はtemplateのregexpのグループを展開したメッセージを作るprocessorの構造体です
+	ReplyProcessor struct {
+		regexp   *regexp.Regexp
+		template string
+	}
 )
 
 // Process は"hello, world!"というbodyがセットされたメッセージのポインタを返します
@@ -39,7 +98,9 @@ func (p *HelloWorldProcessor) Process(msgIn *model.Message) (*model.Message, err
 }
 
 // Process は"大吉", "吉", "中吉", "小吉", "末吉", "凶"のいずれかがbodyにセットされたメッセージへのポインタを返します
-func (p *OmikujiProcessor) Process(msgIn *model.Message) (*model.Message, error) {
+//
+// ctxにStoreがある場合は、同じユーザーには同じ日の間は同じ結果を返します
+func (p *OmikujiProcessor) Process(ctx context.Context, msgIn *model.Message) (*model.Message, error) {
 	fortunes := []string{
 		"大吉",
 		"吉",
@@ -48,37 +109,89 @@ func (p *OmikujiProcessor) Process(msgIn *model.Message) (*model.Message, error)
 		"末吉",
 		"凶",
 	}
-	result := fortunes[randIntn(len(fortunes))]
+	store := StoreFromContext(ctx)
+	if store == nil {
+		return &model.Message{
+			Body: fortunes[randIntn(len(fortunes))],
+		}, nil
+	}
+
+	key := fmt.Sprintf("omikuji:%d:%s", msgIn.UserID, store.now().Format("2006-01-02"))
+	result, err := store.Get(key)
+	switch {
+	case err == ErrKeyNotFound:
+		result = fortunes[randIntn(len(fortunes))]
+		// 次の日には別のキーで引き直すので、古い結果は消えるようにします
+		if err := store.Set(key, result, 24*time.Hour); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	}
 	return &model.Message{
 		Body: result,
 	}, nil
 }
 
+// WithContext はpをctxの終了で打ち切れるProcessorにします
+//
+// pはctxを受け取らないので、ctxが終了したらpの終了を待たずにctx.Err()を返します
+func WithContext(p SimpleProcessor) Processor {
+	return &simpleProcessor{processor: p}
+}
+
+// Process はprocessorを別のgoroutineで呼び、終わるかctxが終了するまで待ちます
+func (p *simpleProcessor) Process(ctx context.Context, msgIn *model.Message) (*model.Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make(chan processResult, 1)
+	go func() {
+		m, err := p.processor.Process(msgIn)
+		result <- processResult{message: m, err: err}
+	}()
+
+	select {
+	case r := <-result:
+		return r.message, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 // Process はメッセージ本文からキーワードを抽出します
-func (p *KeywordProcessor) Process(msgIn *model.Message) (*model.Message, error) {
-	r := regexp.MustCompile("\\Akeyword (.+)")
-	matchedStrings := r.FindStringSubmatch(msgIn.Body)
+func (p *KeywordProcessor) Process(ctx context.Context, msgIn *model.Message) (*model.Message, error) {
+	matchedStrings := keywordRegexp.FindStringSubmatch(msgIn.Body)
 	if len(matchedStrings) != 2 {
 		return nil, fmt.Errorf("bad message: %s", msgIn.Body)
 	}
 
-	text := matchedStrings[1]
+	keywords, err := p.extractor.Extract(ctx, matchedStrings[1])
+	if err != nil {
+		return nil, err
+	}
 
-	requestURL := fmt.Sprintf(keywordAPIURLFormat, env.KeywordAPIAppID, url.QueryEscape(text))
+	return &model.Message{
+		Body: "キーワード：" + strings.Join(keywords, ", "),
+	}, nil
+}
 
-	type keywordAPIResponse map[string]interface{}
-	var response keywordAPIResponse
-	get(requestURL, &response)
+// Process はリアクションが集まったことを祝うbodyがセットされたメッセージのポインタを返します
+func (p *ReactionProcessor) Process(msgIn *model.Message) (*model.Message, error) {
+	return &model.Message{
+		Body: "👍が5個集まったパカ！",
+	}, nil
+}
 
-	keywords := make([]string, 0, len(response))
-	for k, v := range response {
-		if k == "Error" {
-			return nil, fmt.Errorf("%#v", v)
-		}
-		keywords = append(keywords, k)
+// Process はtemplateの$1などをメッセージ本文のregexpのグループで置き換えたbodyがセットされたメッセージのポインタを返します
+func (p *ReplyProcessor) Process(msgIn *model.Message) (*model.Message, error) {
+	match := p.regexp.FindStringSubmatchIndex(msgIn.Body)
+	if match == nil {
+		return nil, fmt.Errorf("bad message: %s", msgIn.Body)
 	}
-
+	body := p.regexp.ExpandString(nil, p.template, msgIn.Body, match)
 	return &model.Message{
-		Body: "キーワード：" + strings.Join(keywords, ", "),
+		Body: string(body),
 	}, nil
 }
@@ -0,0 +1,266 @@
+package bot
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+)
+
+// OverflowPolicy はbotのキューが一杯の時に新しいeventをどう扱うかを表します
+type OverflowPolicy string
+
+const (
+	// DropOldest はキューの一番古いeventを捨てて、新しいeventを入れます
+	DropOldest OverflowPolicy = "drop_oldest"
+	// DropNewest は新しいeventを捨てます
+	DropNewest OverflowPolicy = "drop_newest"
+	// Block はキューに空きができるまでQueueConfig.Timeoutだけ待ち、それでも空かなければ新しいeventを捨てます
+	//
+	// 待つのはキューごとのgoroutineなので、Multicasterや他のbotは待たされません。
+	// 待っているeventもQueueConfig.Sizeまでで、それを超えた分はすぐに捨てます
+	Block OverflowPolicy = "block"
+)
+
+// DefaultQueueConfig はMulticasterがbotごとに作るキューのデフォルトの設定です
+var DefaultQueueConfig = QueueConfig{
+	Size:    100,
+	Policy:  DropOldest,
+	Timeout: time.Second,
+}
+
+type (
+	// QueueConfig はbotごとのキューの設定です
+	//
+	//   fields
+	//     Size    int            キューに溜めておけるeventの数
+	//     Policy  OverflowPolicy キューが一杯の時の扱い
+	//     Timeout time.Duration  PolicyがBlockの場合に待つ時間
+	QueueConfig struct {
+		Size    int
+		Policy  OverflowPolicy
+		Timeout time.Duration
+	}
+
+	// QueueStats はbotのキューの状態です
+	//
+	// Pausedが一時停止中のbotはeventを受け取らず、捨てたeventとしても数えません
+	QueueStats struct {
+		Bot     string         `json:"bot"`
+		Paused  bool           `json:"paused"`
+		Policy  OverflowPolicy `json:"policy"`
+		Length  int            `json:"length"`
+		Size    int            `json:"size"`
+		Dropped uint64         `json:"dropped"`
+	}
+
+	// queue はMulticasterから1つのbotにeventを渡すためのキューです
+	//
+	// pushでcに溜めたeventを、runがbotのinに1つずつ渡します。
+	// PolicyがBlockの場合は、pushがwaitingに入れたeventを、waitがcに空きができるまで期限まで待って入れます
+	//
+	// cancelを呼ぶとbotとキューのgoroutineが停止し、両方が終了するとdoneが閉じられます。
+	// droppedとpausedは32bit環境でもatomicに扱えるように先頭に置きます
+	//
+	//   fields
+	//     dropped uint64
+	//     paused  int32
+	//     bot     *Bot
+	//     config  QueueConfig
+	//     c       chan *model.Event
+	//     waiting chan waitingEvent
+	//     cancel  context.CancelFunc
+	//     done    chan struct{}
+	queue struct {
+		dropped uint64
+		paused  int32
+		bot     *Bot
+		config  QueueConfig
+		c       chan *model.Event
+		waiting chan waitingEvent
+		cancel  context.CancelFunc
+		done    chan struct{}
+	}
+
+	// waitingEvent はキューの空きを待っているeventです
+	//
+	//   fields
+	//     e        *model.Event
+	//     deadline time.Time    これを過ぎても空かなければ捨てます
+	waitingEvent struct {
+		e        *model.Event
+		deadline time.Time
+	}
+)
+
+// newQueue はbotに渡すための新しいqueue構造体のポインタを返します
+func newQueue(bot *Bot, config QueueConfig) *queue {
+	if config.Size <= 0 {
+		config.Size = DefaultQueueConfig.Size
+	}
+	if config.Policy == "" {
+		config.Policy = DefaultQueueConfig.Policy
+	}
+	if config.Policy == Block && config.Timeout <= 0 {
+		config.Timeout = DefaultQueueConfig.Timeout
+	}
+	q := &queue{
+		bot:    bot,
+		config: config,
+		c:      make(chan *model.Event, config.Size),
+		done:   make(chan struct{}),
+	}
+	if config.Policy == Block {
+		q.waiting = make(chan waitingEvent, config.Size)
+	}
+	return q
+}
+
+// start はbotとキューのgoroutineを起動します。ctxが終了するか、stopを呼ぶと停止します
+func (q *queue) start(ctx context.Context) {
+	ctx, q.cancel = context.WithCancel(ctx)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		q.bot.Run(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		q.run(ctx)
+	}()
+	if q.waiting != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.wait(ctx)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(q.done)
+	}()
+}
+
+// stop はbotとキューのgoroutineを停止し、終了するまで待ちます
+func (q *queue) stop() {
+	q.cancel()
+	<-q.done
+}
+
+// setPaused はbotを一時停止するか、再開します
+func (q *queue) setPaused(paused bool) {
+	var v int32
+	if paused {
+		v = 1
+	}
+	atomic.StoreInt32(&q.paused, v)
+}
+
+// isPaused はbotが一時停止中か判定します
+func (q *queue) isPaused() bool {
+	return atomic.LoadInt32(&q.paused) == 1
+}
+
+// run はキューのeventをbotに渡し続けます
+func (q *queue) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-q.c:
+			select {
+			case q.bot.in <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// wait は空きを待っているeventを、期限までにcに空きができれば順番に入れ、できなければ捨てます
+func (q *queue) wait(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case w := <-q.waiting:
+			t := time.NewTimer(w.deadline.Sub(time.Now()))
+			select {
+			case q.c <- w.e:
+			case <-t.C:
+				q.drop(w.e)
+			case <-ctx.Done():
+				t.Stop()
+				return
+			}
+			t.Stop()
+		}
+	}
+}
+
+// push はeをキューに入れます。キューが一杯の場合はconfig.Policyに従います
+//
+// 呼び出し側を待たせることはありません。botが一時停止中の場合は何もしません
+func (q *queue) push(e *model.Event) {
+	if q.isPaused() {
+		return
+	}
+
+	if q.waiting != nil {
+		// 先に空きを待っているeventを追い越さないように、全てwaitを通して入れます
+		select {
+		case q.waiting <- waitingEvent{e: e, deadline: time.Now().Add(q.config.Timeout)}:
+		default:
+			q.drop(e)
+		}
+		return
+	}
+
+	select {
+	case q.c <- e:
+		return
+	default:
+	}
+
+	switch q.config.Policy {
+	case DropNewest:
+		q.drop(e)
+	default:
+		for {
+			select {
+			case q.c <- e:
+				return
+			default:
+			}
+			// runが取り出して空きができている場合もあるので、取り出せた時だけ捨てたと数えます
+			select {
+			case old := <-q.c:
+				q.drop(old)
+			default:
+			}
+		}
+	}
+}
+
+// drop は捨てたeventを数えます
+func (q *queue) drop(e *model.Event) {
+	n := atomic.AddUint64(&q.dropped, 1)
+	log.Printf("%s: dropped %s event of message %d (%d dropped in total)", q.bot.name, e.Type, e.Message.ID, n)
+}
+
+// stats はキューの現在の状態を返します
+func (q *queue) stats() QueueStats {
+	return QueueStats{
+		Bot:     q.bot.name,
+		Paused:  q.isPaused(),
+		Policy:  q.config.Policy,
+		Length:  len(q.c) + len(q.waiting),
+		Size:    cap(q.c),
+		Dropped: atomic.LoadUint64(&q.dropped),
+	}
+}
@@ -0,0 +1,462 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+)
+
+// MissedPolicy はbotが止まっていた間に過ぎた予定の時刻の扱いです
+type MissedPolicy string
+
+// 過ぎた予定の時刻の扱いです
+const (
+	// MissedSkip は過ぎた予定の時刻には投稿しません。空の場合もMissedSkipです
+	MissedSkip MissedPolicy = "skip"
+	// MissedOnce は過ぎた予定の時刻があれば、最後の時刻の分を1回だけ投稿します
+	MissedOnce MissedPolicy = "once"
+	// MissedAll は過ぎた予定の時刻の分を古い順に全て投稿します。ただし新しいものから最大maxMissedRuns回です
+	MissedAll MissedPolicy = "all"
+)
+
+const (
+	// maxMissedRuns はMissedAllで投稿する過ぎた予定の時刻の数の上限です
+	maxMissedRuns = 100
+	// maxIntervalSchedule はIntervalScheduleの間隔の上限です
+	maxIntervalSchedule = 24 * time.Hour
+	// cronSearchYears はCronScheduleが次の時刻を探す年数です。2月30日のように来ない時刻を探し続けないようにします
+	cronSearchYears = 5
+	// lastRunKey は最後に予定の時刻を処理した時刻をbotのStoreに保存するキーです
+	lastRunKey = "schedule:last"
+)
+
+type (
+	// Clock はbotが現在時刻を知り、時刻まで待つためのインターフェースです
+	//
+	// Nowが返す時刻のタイムゾーンで予定の時刻を決めます。テストでは時刻を進められるClockに差し替えます
+	Clock interface {
+		Now() time.Time
+		After(d time.Duration) <-chan time.Time
+	}
+
+	// Schedule はbotが投稿する予定の時刻を決めるインターフェースです
+	//
+	// Nextはtより後の最初の予定の時刻を返します。それ以降に予定がない場合はゼロ値を返します
+	Schedule interface {
+		Next(t time.Time) time.Time
+	}
+
+	// Trigger はbotが予定の時刻になったら投稿する設定です
+	//
+	// 予定の時刻になると、ChannelsのチャンネルごとにChannelIDとUpdatedに予定の時刻を入れた本文が空のmessageをprocessorに渡し、
+	// 返信の代わりにそのチャンネルに投稿します。
+	// botが止まっていた間に過ぎた予定の時刻はMissedに従います。最後に処理した時刻はbotのStoreに保存するので、再起動しても分かります
+	//
+	//   fields
+	//     Schedule Schedule
+	//     Channels []int64
+	//     Missed   MissedPolicy
+	Trigger struct {
+		Schedule Schedule
+		Channels []int64
+		Missed   MissedPolicy
+	}
+
+	// CronSchedule はcronの書式で予定の時刻を決める構造体です
+	//
+	// "分 時 日 月 曜日"の5つの欄に、*、数、a-b、リスト(,区切り)、間隔(*/15や9-17/2)を書けます。
+	// 月と曜日はJANやMONのように英語の3文字でも書けます。曜日の0と7は日曜日です。
+	// 日と曜日の両方を*以外にした場合は、cronと同じようにどちらかに当てはまる日にします
+	//
+	//   fields
+	//     minute, hour, dom, month, dow uint64         それぞれの欄で当てはまる値のビット
+	//     domAny, dowAny                bool           日と曜日の欄が*かどうか
+	//     location                      *time.Location nilの場合はNextに渡した時刻のタイムゾーンです
+	CronSchedule struct {
+		minute, hour, dom, month, dow uint64
+		domAny, dowAny                bool
+		location                      *time.Location
+	}
+
+	// IntervalSchedule は0時からintervalおきの時刻を予定にする構造体です
+	//
+	// 1日を割り切れない間隔の場合も、0時にはそろえ直します
+	//
+	//   fields
+	//     interval time.Duration
+	//     location *time.Location nilの場合はNextに渡した時刻のタイムゾーンです
+	IntervalSchedule struct {
+		interval time.Duration
+		location *time.Location
+	}
+
+	// systemClock はlocationでの実際の時刻のClockです
+	systemClock struct {
+		location *time.Location
+	}
+
+	// cronField はcronの1つの欄に書ける値の範囲です
+	cronField struct {
+		name     string
+		min, max int
+		names    []string
+	}
+)
+
+var (
+	// cronFields はcronの欄の並びです
+	cronFields = []cronField{
+		{name: "minute", min: 0, max: 59},
+		{name: "hour", min: 0, max: 23},
+		{name: "day of month", min: 1, max: 31},
+		{name: "month", min: 1, max: 12, names: []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+		{name: "day of week", min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+	}
+
+	// cronDescriptors は@から始まる省略形と、それが表すcronの書式です
+	cronDescriptors = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+)
+
+// runSchedule はtriggerの予定の時刻ごとに投稿し、ctxが終了するまで続けます
+//
+// 遅れて投稿する返信はdelayedで待ちます
+func (b *Bot) runSchedule(ctx context.Context, delayed *sync.WaitGroup) {
+	clock := b.clock
+	if clock == nil {
+		clock = NewClock(nil)
+	}
+
+	now := clock.Now()
+	last, err := b.lastRun()
+	if err != nil {
+		log.Printf("%s: %s", b.name, err)
+	}
+	if last.IsZero() {
+		// 初めて起動した場合は、過ぎた予定の時刻はありません
+		last = now
+	}
+	b.runMissed(ctx, b.trigger.between(last, now), delayed)
+	b.saveLastRun(now)
+	last = now
+
+	for {
+		next := b.trigger.Schedule.Next(last)
+		if next.IsZero() {
+			log.Printf("%s: no more scheduled runs", b.name)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-clock.After(next.Sub(clock.Now())):
+		}
+
+		b.runAt(ctx, next, delayed)
+		// 待っている間に時計が進んだ場合は、その間に過ぎた予定の時刻も止まっていた間と同じように扱います
+		now := clock.Now()
+		b.runMissed(ctx, b.trigger.between(next, now), delayed)
+		if now.Before(next) {
+			now = next
+		}
+		b.saveLastRun(now)
+		last = now
+	}
+}
+
+// runMissed は過ぎた予定の時刻runsをtriggerのMissedに従って処理します
+func (b *Bot) runMissed(ctx context.Context, runs []time.Time, delayed *sync.WaitGroup) {
+	if len(runs) == 0 {
+		return
+	}
+	switch b.trigger.Missed {
+	case MissedAll:
+	case MissedOnce:
+		runs = runs[len(runs)-1:]
+	default:
+		log.Printf("%s: skipped %d missed runs", b.name, len(runs))
+		return
+	}
+	for _, t := range runs {
+		b.runAt(ctx, t, delayed)
+	}
+}
+
+// runAt は予定の時刻tの分をtriggerの全てのチャンネルに投稿します
+func (b *Bot) runAt(ctx context.Context, t time.Time, delayed *sync.WaitGroup) {
+	for _, channelID := range b.trigger.Channels {
+		b.respond(ctx, &model.Message{ChannelID: channelID, Updated: t}, delayed)
+	}
+}
+
+// lastRun はbotのStoreに保存した、最後に予定の時刻を処理した時刻を返します。保存されていない場合はゼロ値を返します
+func (b *Bot) lastRun() (time.Time, error) {
+	if b.store == nil {
+		return time.Time{}, nil
+	}
+	v, err := b.store.Get(lastRunKey)
+	switch {
+	case err == ErrKeyNotFound:
+		return time.Time{}, nil
+	case err != nil:
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, v)
+}
+
+// saveLastRun は最後に予定の時刻を処理した時刻tをbotのStoreに保存します
+func (b *Bot) saveLastRun(t time.Time) {
+	if b.store == nil {
+		return
+	}
+	if err := b.store.Set(lastRunKey, t.Format(time.RFC3339Nano), 0); err != nil {
+		log.Printf("%s: %s", b.name, err)
+	}
+}
+
+// validate はtriggerの設定で投稿できるかを確かめます
+func (t *Trigger) validate() error {
+	if t.Schedule == nil {
+		return errors.New("schedule is missing")
+	}
+	if len(t.Channels) == 0 {
+		return errors.New("channels are missing")
+	}
+	switch t.Missed {
+	case "", MissedSkip, MissedOnce, MissedAll:
+	default:
+		return fmt.Errorf("unknown missed policy %q", t.Missed)
+	}
+	return nil
+}
+
+// between はafterより後でuntilまでの予定の時刻を古い順に返します。新しいものから最大maxMissedRuns個です
+func (t *Trigger) between(after, until time.Time) []time.Time {
+	var runs []time.Time
+	for next := t.Schedule.Next(after); !next.IsZero() && !next.After(until); next = t.Schedule.Next(next) {
+		if len(runs) == maxMissedRuns {
+			runs = runs[1:]
+		}
+		runs = append(runs, next)
+	}
+	return runs
+}
+
+// Next はtより後でcronの書式に当てはまる最初の時刻を返します
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	location := t.Location()
+	if s.location != nil {
+		location = s.location
+	}
+	t = t.In(location).Truncate(time.Minute).Add(time.Minute)
+
+	limit := t.Year() + cronSearchYears
+	for t.Year() <= limit {
+		switch {
+		case !hasBit(s.month, int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, location)
+		case !s.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, location)
+		case !hasBit(s.hour, t.Hour()):
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, location)
+		case !hasBit(s.minute, t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// matchDay はtの日が日と曜日の欄に当てはまるかを返します
+func (s *CronSchedule) matchDay(t time.Time) bool {
+	dom := hasBit(s.dom, t.Day())
+	dow := hasBit(s.dow, int(t.Weekday()))
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next はtより後でintervalおきの最初の時刻を返します
+func (s *IntervalSchedule) Next(t time.Time) time.Time {
+	location := t.Location()
+	if s.location != nil {
+		location = s.location
+	}
+	t = t.In(location)
+
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, location)
+	next := midnight.Add((t.Sub(midnight)/s.interval + 1) * s.interval)
+	if tomorrow := time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, location); !next.Before(tomorrow) {
+		return tomorrow
+	}
+	return next
+}
+
+// Now はlocationでの現在時刻を返します
+func (c *systemClock) Now() time.Time {
+	return time.Now().In(c.location)
+}
+
+// After はdが経つと現在時刻を送るchannelを返します
+func (c *systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// hasBit はbitsのvのビットが立っているかを返します
+func hasBit(bits uint64, v int) bool {
+	return bits&(1<<uint(v)) != 0
+}
+
+// parseCronField はcronの1つの欄sを、当てはまる値のビットにします。sが*だけの場合は2番目の戻り値でtrueを返します
+func parseCronField(s string, f cronField) (uint64, bool, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		lo, hi, step := f.min, f.max, 1
+		expr := part
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, false, fmt.Errorf("bad step in %s: %q", f.name, part)
+			}
+			expr, step = part[:i], n
+		}
+
+		switch {
+		case expr == "*":
+		case strings.Contains(expr, "-"):
+			i := strings.Index(expr, "-")
+			var err error
+			if lo, err = f.value(expr[:i]); err != nil {
+				return 0, false, err
+			}
+			if hi, err = f.value(expr[i+1:]); err != nil {
+				return 0, false, err
+			}
+		default:
+			var err error
+			if lo, err = f.value(expr); err != nil {
+				return 0, false, err
+			}
+			// 5/15のように間隔を付けた場合は最大値まで、そうでなければその値だけです
+			if step == 1 {
+				hi = lo
+			}
+		}
+		if lo > hi {
+			return 0, false, fmt.Errorf("bad range in %s: %q", f.name, part)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, s == "*", nil
+}
+
+// value はcronの欄に書かれた数か名前を値にします
+func (f cronField) value(s string) (int, error) {
+	for i, name := range f.names {
+		if name != "" && strings.EqualFold(s, name) {
+			return i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("bad %s: %q", f.name, s)
+	}
+	return v, nil
+}
+
+// NewClock はlocationでの実際の時刻のClockを返します。locationがnilの場合はtime.Localです
+func NewClock(location *time.Location) Clock {
+	if location == nil {
+		location = time.Local
+	}
+	return &systemClock{
+		location: location,
+	}
+}
+
+// ParseCron はcronの書式specで予定の時刻を決める新しいCronSchedule構造体のポインタを返します
+//
+// specには@dailyや@hourlyのような省略形も書けます。locationがnilの場合はClockのタイムゾーンで決めます
+func ParseCron(spec string, location *time.Location) (*CronSchedule, error) {
+	if s, ok := cronDescriptors[strings.ToLower(spec)]; ok {
+		spec = s
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("cron spec must have %d fields: %q", len(cronFields), spec)
+	}
+
+	var (
+		bits [5]uint64
+		star [5]bool
+	)
+	for i, f := range cronFields {
+		var err error
+		if bits[i], star[i], err = parseCronField(fields[i], f); err != nil {
+			return nil, err
+		}
+	}
+	// 曜日の7は日曜日です
+	if hasBit(bits[4], 7) {
+		bits[4] |= 1
+	}
+
+	return &CronSchedule{
+		minute:   bits[0],
+		hour:     bits[1],
+		dom:      bits[2],
+		month:    bits[3],
+		dow:      bits[4],
+		domAny:   star[2],
+		dowAny:   star[4],
+		location: location,
+	}, nil
+}
+
+// NewIntervalSchedule は0時からintervalおきの時刻を予定にする新しいIntervalSchedule構造体のポインタを返します
+//
+// intervalは0より長く1日以下にします。locationがnilの場合はClockのタイムゾーンで決めます
+func NewIntervalSchedule(interval time.Duration, location *time.Location) (*IntervalSchedule, error) {
+	if interval <= 0 || interval > maxIntervalSchedule {
+		return nil, fmt.Errorf("interval %s must be longer than 0 and not longer than %s", interval, maxIntervalSchedule)
+	}
+	return &IntervalSchedule{
+		interval: interval,
+		location: location,
+	}, nil
+}
+
+// NewScheduledBot は予定の時刻になるとprocessorが作ったメッセージをtriggerのチャンネルに投稿する、nameの名前の新しいBotの構造体のポインタを返します
+//
+// checkerがないので、メッセージには反応しません
+func NewScheduledBot(name string, trigger *Trigger, processor Processor, out chan *model.Message) (*Bot, error) {
+	if err := trigger.validate(); err != nil {
+		return nil, err
+	}
+
+	return &Bot{
+		name:      name,
+		in:        make(chan *model.Event),
+		out:       out,
+		processor: processor,
+		trigger:   trigger,
+	}, nil
+}
@@ -0,0 +1,182 @@
+package bot
+
+import (
+	"testing"
+	"time"
+)
+
+// jst はテストで予定の時刻を決めるタイムゾーンです
+var jst = time.FixedZone("JST", 9*60*60)
+
+// bitsOf はvaluesのビットを立てた値を返します
+func bitsOf(values ...int) uint64 {
+	var bits uint64
+	for _, v := range values {
+		bits |= 1 << uint(v)
+	}
+	return bits
+}
+
+func TestParseCronFieldがcronの欄を値のビットにする(t *testing.T) {
+	minute, hour, dom, month, dow := cronFields[0], cronFields[1], cronFields[2], cronFields[3], cronFields[4]
+	cases := []struct {
+		s        string
+		field    cronField
+		expected uint64
+		star     bool
+	}{
+		{"*", hour, bitsOf(0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23), true},
+		{"5", minute, bitsOf(5), false},
+		{"1,15,30", dom, bitsOf(1, 15, 30), false},
+		{"9-12", hour, bitsOf(9, 10, 11, 12), false},
+		{"*/15", minute, bitsOf(0, 15, 30, 45), false},
+		{"10-20/5", minute, bitsOf(10, 15, 20), false},
+		// 間隔だけを付けた値は最大値まで続けます
+		{"50/3", minute, bitsOf(50, 53, 56, 59), false},
+		{"jan,MAR-may", month, bitsOf(1, 3, 4, 5), false},
+		{"mon-fri", dow, bitsOf(1, 2, 3, 4, 5), false},
+		{"0,7", dow, bitsOf(0, 7), false},
+	}
+	for _, tc := range cases {
+		bits, star, err := parseCronField(tc.s, tc.field)
+		if err != nil {
+			t.Fatalf("%s %q: failed to parse: %s", tc.field.name, tc.s, err)
+		}
+		if bits != tc.expected || star != tc.star {
+			t.Fatalf("%s %q: expected %b %v, but %b %v", tc.field.name, tc.s, tc.expected, tc.star, bits, star)
+		}
+	}
+
+	for _, tc := range []struct {
+		s     string
+		field cronField
+	}{
+		{"60", minute},
+		{"-1", minute},
+		{"0", dom},
+		{"13", month},
+		{"8", dow},
+		{"x", hour},
+		{"sun", month},
+		{"5-1", hour},
+		{"*/0", minute},
+		{"*/x", minute},
+		{"1-", hour},
+		{"", minute},
+	} {
+		if _, _, err := parseCronField(tc.s, tc.field); err == nil {
+			t.Fatalf("%s %q: error expected, but nil", tc.field.name, tc.s)
+		}
+	}
+}
+
+func TestParseCronが欄の数や省略形を読む(t *testing.T) {
+	for _, spec := range []string{"0 9 * * *", "@daily", "@HOURLY", "  0  9  *  *  * "} {
+		if _, err := ParseCron(spec, nil); err != nil {
+			t.Fatalf("%q: failed to parse: %s", spec, err)
+		}
+	}
+	for _, spec := range []string{"", "0 9 * *", "0 9 * * * *", "@every", "0 24 * * *"} {
+		if _, err := ParseCron(spec, nil); err == nil {
+			t.Fatalf("%q: error expected, but nil", spec)
+		}
+	}
+}
+
+func TestCronScheduleが次の予定の時刻を返す(t *testing.T) {
+	// 2018年6月10日は日曜日です
+	from := time.Date(2018, 6, 10, 8, 59, 30, 0, jst)
+	cases := []struct {
+		name     string
+		spec     string
+		location *time.Location
+		from     time.Time
+		expected time.Time
+	}{
+		{"same day", "0 9 * * *", nil, from, time.Date(2018, 6, 10, 9, 0, 0, 0, jst)},
+		{"exactly at run", "0 9 * * *", nil, time.Date(2018, 6, 10, 9, 0, 0, 0, jst), time.Date(2018, 6, 11, 9, 0, 0, 0, jst)},
+		{"step", "*/15 * * * *", nil, time.Date(2018, 6, 10, 9, 7, 0, 0, jst), time.Date(2018, 6, 10, 9, 15, 0, 0, jst)},
+		{"next hour", "30 * * * *", nil, time.Date(2018, 6, 10, 9, 45, 0, 0, jst), time.Date(2018, 6, 10, 10, 30, 0, 0, jst)},
+		{"hourly", "@hourly", nil, from, time.Date(2018, 6, 10, 9, 0, 0, 0, jst)},
+		{"weekday", "0 0 * * 1", nil, from, time.Date(2018, 6, 11, 0, 0, 0, 0, jst)},
+		// 曜日の7は日曜日です
+		{"sunday as 7", "0 12 * * 7", nil, time.Date(2018, 6, 10, 13, 0, 0, 0, jst), time.Date(2018, 6, 17, 12, 0, 0, 0, jst)},
+		{"sunday as 0", "0 12 * * 0", nil, from, time.Date(2018, 6, 10, 12, 0, 0, 0, jst)},
+		// 日と曜日の両方を指定した場合は、どちらかに当てはまる日です
+		{"dom or dow by dom", "0 0 13 * fri", nil, from, time.Date(2018, 6, 13, 0, 0, 0, 0, jst)},
+		{"dom or dow by dow", "0 0 13 * fri", nil, time.Date(2018, 6, 13, 0, 0, 0, 0, jst), time.Date(2018, 6, 15, 0, 0, 0, 0, jst)},
+		// 片方が*の場合は、もう片方に当てはまる日です
+		{"dom only", "0 0 1 * *", nil, from, time.Date(2018, 7, 1, 0, 0, 0, 0, jst)},
+		{"month name", "0 0 1 jan *", nil, from, time.Date(2019, 1, 1, 0, 0, 0, 0, jst)},
+		{"leap day", "0 0 29 2 *", nil, from, time.Date(2020, 2, 29, 0, 0, 0, 0, jst)},
+		{"never", "0 0 30 2 *", nil, from, time.Time{}},
+		// locationを指定した場合は、そのタイムゾーンの時刻で決めます
+		{"location", "0 9 * * *", time.UTC, from, time.Date(2018, 6, 10, 9, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range cases {
+		s, err := ParseCron(tc.spec, tc.location)
+		if err != nil {
+			t.Fatalf("%s: failed to parse: %s", tc.name, err)
+		}
+		if actual := s.Next(tc.from); !actual.Equal(tc.expected) {
+			t.Fatalf("%s: expected %s, but %s", tc.name, tc.expected, actual)
+		}
+	}
+}
+
+func TestIntervalScheduleが0時からの間隔で次の予定の時刻を返す(t *testing.T) {
+	cases := []struct {
+		name     string
+		interval time.Duration
+		location *time.Location
+		from     time.Time
+		expected time.Time
+	}{
+		{"next", 15 * time.Minute, nil, time.Date(2018, 6, 10, 8, 59, 30, 0, jst), time.Date(2018, 6, 10, 9, 0, 0, 0, jst)},
+		{"exactly at run", 15 * time.Minute, nil, time.Date(2018, 6, 10, 9, 0, 0, 0, jst), time.Date(2018, 6, 10, 9, 15, 0, 0, jst)},
+		// 1日を割り切れない間隔は0時にそろえ直します
+		{"realign", 7 * time.Hour, nil, time.Date(2018, 6, 10, 21, 0, 0, 0, jst), time.Date(2018, 6, 11, 0, 0, 0, 0, jst)},
+		{"after realign", 7 * time.Hour, nil, time.Date(2018, 6, 11, 0, 0, 0, 0, jst), time.Date(2018, 6, 11, 7, 0, 0, 0, jst)},
+		{"daily", 24 * time.Hour, nil, time.Date(2018, 6, 10, 0, 0, 0, 0, jst), time.Date(2018, 6, 11, 0, 0, 0, 0, jst)},
+		// JSTの8時はUTCの前日23時です
+		{"location", 12 * time.Hour, time.UTC, time.Date(2018, 6, 10, 8, 0, 0, 0, jst), time.Date(2018, 6, 10, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range cases {
+		s, err := NewIntervalSchedule(tc.interval, tc.location)
+		if err != nil {
+			t.Fatalf("%s: failed to create: %s", tc.name, err)
+		}
+		if actual := s.Next(tc.from); !actual.Equal(tc.expected) {
+			t.Fatalf("%s: expected %s, but %s", tc.name, tc.expected, actual)
+		}
+	}
+
+	for _, interval := range []time.Duration{0, -time.Minute, 25 * time.Hour} {
+		if _, err := NewIntervalSchedule(interval, nil); err == nil {
+			t.Fatalf("%s: error expected, but nil", interval)
+		}
+	}
+}
+
+func TestTriggerが過ぎた予定の時刻を新しいものから上限まで返す(t *testing.T) {
+	s, err := NewIntervalSchedule(time.Hour, nil)
+	if err != nil {
+		t.Fatalf("failed to create schedule: %s", err)
+	}
+	trigger := &Trigger{Schedule: s}
+	after := time.Date(2018, 6, 10, 0, 0, 0, 0, jst)
+
+	runs := trigger.between(after, after.Add(3*time.Hour))
+	if len(runs) != 3 || !runs[0].Equal(after.Add(time.Hour)) || !runs[2].Equal(after.Add(3*time.Hour)) {
+		t.Fatalf("runs expected 01:00 to 03:00, but %v", runs)
+	}
+	if runs := trigger.between(after, after.Add(30*time.Minute)); len(runs) != 0 {
+		t.Fatalf("no runs expected, but %v", runs)
+	}
+
+	until := after.Add(10 * 24 * time.Hour)
+	runs = trigger.between(after, until)
+	if len(runs) != maxMissedRuns || !runs[len(runs)-1].Equal(until) || !runs[0].Equal(until.Add(-(maxMissedRuns-1)*time.Hour)) {
+		t.Fatalf("latest %d runs expected, but %d runs from %s to %s", maxMissedRuns, len(runs), runs[0], runs[len(runs)-1])
+	}
+}
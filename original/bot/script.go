@@ -0,0 +1,602 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+	"github.com/dop251/goja"
+)
+
+const (
+	// DefaultScriptCPULimit はスクリプトを1回呼び出す時に実行できる時間のデフォルトです
+	DefaultScriptCPULimit = 100 * time.Millisecond
+	// DefaultScriptTimeout はスクリプトを1回呼び出す時に、fetchの応答を待つ時間も含めて待つ時間のデフォルトです
+	DefaultScriptTimeout = 5 * time.Second
+	// maxScriptCallStackSize はスクリプトの関数呼び出しの深さの上限です
+	maxScriptCallStackSize = 1000
+	// maxFetchBodySize はfetchで読み込むレスポンスの本文の大きさの上限です
+	maxFetchBodySize = 1 << 20
+)
+
+var (
+	// errScriptCPULimit はスクリプトがCPULimitを超えて実行された場合のエラーです
+	errScriptCPULimit = errors.New("script exceeded cpu limit")
+	// errScriptTimeout はスクリプトの呼び出しがTimeoutまでに終わらなかった場合のエラーです
+	errScriptTimeout = errors.New("script timed out")
+	// errFetchNotAllowed はfetchでAllowedHostsにないURLにアクセスしようとした場合のエラーです
+	errFetchNotAllowed = errors.New("fetch is not allowed for this url")
+)
+
+type (
+	// ScriptConfig はスクリプトのbotの実行の制限です
+	//
+	//   fields
+	//     CPULimit     time.Duration 1回の呼び出しでスクリプトを実行できる時間。fetchの応答を待つ時間は含みません
+	//     Timeout      time.Duration fetchの応答を待つ時間も含めた、1回の呼び出しにかけられる時間
+	//     AllowedHosts []string      fetchでアクセスできるホスト。"example.com"か、ポートを含めた"example.com:8080"の形で指定します
+	ScriptConfig struct {
+		CPULimit     time.Duration
+		Timeout      time.Duration
+		AllowedHosts []string
+	}
+
+	// Script はJavaScriptのスクリプトで反応するかの判定と返信の作成をする、checkerとMultiProcessorの構造体です
+	//
+	// スクリプトではmessageを受け取る2つの関数をexportsに代入するか、トップレベルに定義します
+	//
+	//   exports.check = function(msg) { return msg.body.indexOf("js ") === 0; };
+	//   exports.process = function(msg) { return "js: " + msg.body.slice(3); };
+	//
+	// msgはmodel.MessageをJSONにしたものと同じ形のオブジェクトです。checkは反応するかを真偽値で返します。
+	// processは返信の本文の文字列か、bodyを持つオブジェクトを返します。複数の返信をする場合はそれらの配列を返します。
+	// 返信は常に反応したメッセージと同じチャンネルとスレッドに投稿します。
+	// オブジェクトのdelayにミリ秒を指定すると、その時間が経ってから投稿します。nullかundefinedか空の配列を返した場合は返信しません
+	//
+	// スクリプトからはファイルやネットワークにアクセスできません。
+	// 例外としてfetch(url, {method, headers, body})でScriptConfig.AllowedHostsのホストにだけHTTPでリクエストできます。
+	// fetchは応答を待ってから{status, ok, headers, text(), json()}を返し、失敗した場合は例外を投げます。
+	// console.logに渡したものはサーバーのログに出ます
+	//
+	// processの中ではstoreでbotのStoreに文字列の値を保存できます。オブジェクトはJSON.stringifyしてから保存してください
+	//
+	//   store.get(key)             値を返します。ない場合はnullを返します
+	//   store.set(key, value, ttl) 値を保存します。ttlにミリ秒を指定すると、その時間が経つと消えます
+	//   store.incr(key, delta)     整数の値にdelta(省略した場合は1)を足して、足した後の値を返します
+	//   store.expire(key, ttl)     値がttlミリ秒経つと消えるようにします
+	//   store.del(key)             値を消します
+	//
+	// processの中ではconversationでメッセージを投稿したユーザーとのやりとりを続けられます。
+	// やりとりを始めると、そのユーザーのそのチャンネルでの次のメッセージはcheckを呼ばずにprocessに渡します
+	//
+	//   conversation.active()           やりとりの途中であればtrueを返します
+	//   conversation.state()            やりとりに保存した文字列を返します
+	//   conversation.start(state, ttl)  stateを保存してやりとりを始めるか続けます。ttlミリ秒の間に次のメッセージがなければ終わります
+	//   conversation.end()              やりとりを終わらせます
+	//
+	// goja.Runtimeは複数のgoroutineから同時に使えないので、呼び出しはmuで1つずつにします
+	//
+	//   fields
+	//     name    string
+	//     config  ScriptConfig
+	//     client  *http.Client
+	//     mu      sync.Mutex
+	//     vm      *goja.Runtime
+	//     check   goja.Callable
+	//     process goja.Callable
+	//     ctx     context.Context 実行中の呼び出しの期限
+	//     cpu     *cpuLimit       実行中の呼び出しのCPULimit
+	Script struct {
+		name    string
+		config  ScriptConfig
+		client  *http.Client
+		mu      sync.Mutex
+		vm      *goja.Runtime
+		check   goja.Callable
+		process goja.Callable
+		ctx     context.Context
+		cpu     *cpuLimit
+	}
+
+	// cpuLimit はスクリプトの実行時間が残りremainingを超えたらvmを中断させるタイマーです
+	//
+	// fetchの応答を待つ間はpauseで止めておき、resumeで再開します
+	cpuLimit struct {
+		vm        *goja.Runtime
+		remaining time.Duration
+		resumed   time.Time
+		timer     *time.Timer
+	}
+)
+
+// Check はスクリプトのcheckでメッセージに反応するか判定します
+//
+// スクリプトが失敗した場合はログに出して反応しません
+func (s *Script) Check(m *model.Message) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, err := s.call(context.Background(), s.check, m)
+	if err != nil {
+		log.Printf("%s: check: %s", s.name, err)
+		return false
+	}
+	return v.ToBoolean()
+}
+
+// Process はスクリプトのprocessが返した最初の返信を返します
+func (s *Script) Process(ctx context.Context, msgIn *model.Message) (*model.Message, error) {
+	replies, err := s.ProcessAll(ctx, msgIn)
+	if err != nil {
+		return nil, err
+	}
+	if len(replies) == 0 {
+		return nil, ErrNoReply
+	}
+	return replies[0].Message, nil
+}
+
+// ProcessAll はスクリプトのprocessで返信を作ります
+//
+// ctxが終了した場合はスクリプトを中断します
+func (s *Script) ProcessAll(ctx context.Context, msgIn *model.Message) ([]*Reply, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, err := s.call(ctx, s.process, msgIn)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil || goja.IsUndefined(v) || goja.IsNull(v) {
+		return nil, nil
+	}
+
+	values := []interface{}{v.Export()}
+	if a, ok := values[0].([]interface{}); ok {
+		values = a
+	}
+	replies := make([]*Reply, 0, len(values))
+	for _, value := range values {
+		r, err := s.toReply(value)
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, r)
+	}
+	return replies, nil
+}
+
+// toReply はprocessが返した文字列か、bodyとdelay(ミリ秒)を持つオブジェクトを返信にします
+//
+// オブジェクトのそれ以外の値は使いません。スクリプトが返信するチャンネルやスレッドを選べると、
+// botが有効になっていないチャンネルにも投稿できてしまうので、返信先は常に反応したメッセージにします
+func (s *Script) toReply(v interface{}) (*Reply, error) {
+	if body, ok := v.(string); ok {
+		return &Reply{Message: &model.Message{Body: body}}, nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var r struct {
+		Body  string  `json:"body"`
+		Delay float64 `json:"delay"`
+	}
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, err
+	}
+	if r.Body == "" {
+		return nil, fmt.Errorf("%s: process returned a message without body", s.name)
+	}
+	return &Reply{
+		Message: &model.Message{Body: r.Body},
+		Delay:   time.Duration(r.Delay * float64(time.Millisecond)),
+	}, nil
+}
+
+// call はmをJavaScriptのオブジェクトにしてfnを呼び出します
+func (s *Script) call(ctx context.Context, fn goja.Callable, m *model.Message) (goja.Value, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var arg interface{}
+	if err := json.Unmarshal(b, &arg); err != nil {
+		return nil, err
+	}
+
+	return s.run(ctx, func() (goja.Value, error) {
+		return fn(goja.Undefined(), s.vm.ToValue(arg))
+	})
+}
+
+// run はCPULimitとTimeoutの制限を付けてfを実行します
+//
+// Timeoutより先にctxが終了した場合も中断します
+func (s *Script) run(ctx context.Context, f func() (goja.Value, error)) (goja.Value, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.config.Timeout)
+	defer cancel()
+	s.ctx = ctx
+	s.cpu = &cpuLimit{vm: s.vm, remaining: s.config.CPULimit}
+
+	// 前回の呼び出しの終わり際に中断されていた場合に備えて、実行前にも解除します
+	s.vm.ClearInterrupt()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			s.vm.Interrupt(errScriptTimeout)
+		case <-done:
+		}
+	}()
+	s.cpu.resume()
+	v, err := f()
+	s.cpu.pause()
+	close(done)
+	<-stopped
+	s.vm.ClearInterrupt()
+
+	if ie, ok := err.(*goja.InterruptedError); ok {
+		if e, ok := ie.Value().(error); ok {
+			return nil, e
+		}
+	}
+	return v, err
+}
+
+// fetch はスクリプトのfetch(url, {method, headers, body})の実装です
+func (s *Script) fetch(call goja.FunctionCall) goja.Value {
+	var opts struct {
+		Method  string            `json:"method"`
+		Headers map[string]string `json:"headers"`
+		Body    string            `json:"body"`
+	}
+	if o := call.Argument(1); !goja.IsUndefined(o) && !goja.IsNull(o) {
+		if err := s.vm.ExportTo(o, &opts); err != nil {
+			panic(s.vm.NewGoError(err))
+		}
+	}
+	if opts.Method == "" {
+		opts.Method = http.MethodGet
+	}
+
+	u, err := url.Parse(call.Argument(0).String())
+	if err != nil {
+		panic(s.vm.NewGoError(err))
+	}
+	if !s.config.allows(u) {
+		panic(s.vm.NewGoError(fmt.Errorf("%s: %s", errFetchNotAllowed, u)))
+	}
+	req, err := http.NewRequest(opts.Method, u.String(), strings.NewReader(opts.Body))
+	if err != nil {
+		panic(s.vm.NewGoError(err))
+	}
+	for k, v := range opts.Headers {
+		req.Header.Set(k, v)
+	}
+
+	// 応答を待つ間はスクリプトを実行していないので、CPULimitを止めておきます
+	s.cpu.pause()
+	status, header, body, err := s.do(req.WithContext(s.ctx))
+	s.cpu.resume()
+	if err != nil {
+		panic(s.vm.NewGoError(err))
+	}
+
+	headers := map[string]interface{}{}
+	for k := range header {
+		headers[strings.ToLower(k)] = header.Get(k)
+	}
+	res := s.vm.NewObject()
+	res.Set("status", status)
+	res.Set("ok", status >= 200 && status < 300)
+	res.Set("headers", headers)
+	res.Set("text", func() string {
+		return string(body)
+	})
+	res.Set("json", func() goja.Value {
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err != nil {
+			panic(s.vm.NewGoError(err))
+		}
+		return s.vm.ToValue(v)
+	})
+	return res
+}
+
+// do はreqを送信し、レスポンスのステータスコードとヘッダーと本文を返します
+func (s *Script) do(req *http.Request) (int, http.Header, []byte, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	// 上限を超えたか判定するために1byte多く読み込みます
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxFetchBodySize+1))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if len(body) > maxFetchBodySize {
+		return 0, nil, nil, fmt.Errorf("fetch: response body is larger than %d bytes", maxFetchBodySize)
+	}
+	return resp.StatusCode, resp.Header, body, nil
+}
+
+// storeGet はスクリプトのstore.get(key)の実装です
+func (s *Script) storeGet(call goja.FunctionCall) goja.Value {
+	var v string
+	err := s.withStore(func(store *Store) (err error) {
+		v, err = store.Get(call.Argument(0).String())
+		return err
+	})
+	if err == ErrKeyNotFound {
+		return goja.Null()
+	}
+	s.throw(err)
+	return s.vm.ToValue(v)
+}
+
+// storeSet はスクリプトのstore.set(key, value, ttl)の実装です
+func (s *Script) storeSet(call goja.FunctionCall) goja.Value {
+	ttl := time.Duration(call.Argument(2).ToFloat() * float64(time.Millisecond))
+	s.throw(s.withStore(func(store *Store) error {
+		return store.Set(call.Argument(0).String(), call.Argument(1).String(), ttl)
+	}))
+	return goja.Undefined()
+}
+
+// storeIncr はスクリプトのstore.incr(key, delta)の実装です
+func (s *Script) storeIncr(call goja.FunctionCall) goja.Value {
+	delta := int64(1)
+	if d := call.Argument(1); !goja.IsUndefined(d) {
+		delta = d.ToInteger()
+	}
+	var n int64
+	s.throw(s.withStore(func(store *Store) (err error) {
+		n, err = store.Incr(call.Argument(0).String(), delta)
+		return err
+	}))
+	return s.vm.ToValue(n)
+}
+
+// storeExpire はスクリプトのstore.expire(key, ttl)の実装です
+func (s *Script) storeExpire(call goja.FunctionCall) goja.Value {
+	ttl := time.Duration(call.Argument(1).ToFloat() * float64(time.Millisecond))
+	s.throw(s.withStore(func(store *Store) error {
+		return store.Expire(call.Argument(0).String(), ttl)
+	}))
+	return goja.Undefined()
+}
+
+// storeDel はスクリプトのstore.del(key)の実装です
+func (s *Script) storeDel(call goja.FunctionCall) goja.Value {
+	s.throw(s.withStore(func(store *Store) error {
+		return store.Delete(call.Argument(0).String())
+	}))
+	return goja.Undefined()
+}
+
+// withStore は実行中の呼び出しのctxのStoreでfを呼びます
+//
+// DBを待つ間はfetchと同じようにCPULimitのタイマーを止めます
+func (s *Script) withStore(f func(store *Store) error) error {
+	store := StoreFromContext(s.ctx)
+	if store == nil {
+		return errors.New("store is not available")
+	}
+	s.cpu.pause()
+	defer s.cpu.resume()
+	return f(store)
+}
+
+// conversationActive はスクリプトのconversation.active()の実装です
+func (s *Script) conversationActive(call goja.FunctionCall) goja.Value {
+	var active bool
+	s.throw(s.withConversation(func(c *Conversation) error {
+		active = c.Active()
+		return nil
+	}))
+	return s.vm.ToValue(active)
+}
+
+// conversationState はスクリプトのconversation.state()の実装です
+func (s *Script) conversationState(call goja.FunctionCall) goja.Value {
+	var state string
+	s.throw(s.withConversation(func(c *Conversation) error {
+		state = c.State()
+		return nil
+	}))
+	return s.vm.ToValue(state)
+}
+
+// conversationStart はスクリプトのconversation.start(state, ttl)の実装です
+func (s *Script) conversationStart(call goja.FunctionCall) goja.Value {
+	var state string
+	if v := call.Argument(0); !goja.IsUndefined(v) && !goja.IsNull(v) {
+		state = v.String()
+	}
+	ttl := time.Duration(call.Argument(1).ToFloat() * float64(time.Millisecond))
+	s.throw(s.withConversation(func(c *Conversation) error {
+		return c.Start(state, ttl)
+	}))
+	return goja.Undefined()
+}
+
+// conversationEnd はスクリプトのconversation.end()の実装です
+func (s *Script) conversationEnd(call goja.FunctionCall) goja.Value {
+	s.throw(s.withConversation(func(c *Conversation) error {
+		return c.End()
+	}))
+	return goja.Undefined()
+}
+
+// withConversation は実行中の呼び出しのctxのConversationでfを呼びます
+//
+// DBを待つ間はCPULimitのタイマーを止めます
+func (s *Script) withConversation(f func(c *Conversation) error) error {
+	c := ConversationFromContext(s.ctx)
+	if c == nil {
+		return errors.New("conversation is not available")
+	}
+	s.cpu.pause()
+	defer s.cpu.resume()
+	return f(c)
+}
+
+// throw はerrがnilでなければスクリプトに例外を投げます
+func (s *Script) throw(err error) {
+	if err != nil {
+		panic(s.vm.NewGoError(err))
+	}
+}
+
+// log はスクリプトのconsole.logの実装です
+func (s *Script) log(call goja.FunctionCall) goja.Value {
+	args := make([]string, len(call.Arguments))
+	for i, a := range call.Arguments {
+		args[i] = a.String()
+	}
+	log.Printf("%s: %s", s.name, strings.Join(args, " "))
+	return goja.Undefined()
+}
+
+// exported はスクリプトがexportsに代入するか、トップレベルに定義したnameの関数を返します
+func (s *Script) exported(name string) (goja.Callable, error) {
+	if module := s.vm.Get("module"); module != nil {
+		if exports := module.ToObject(s.vm).Get("exports"); exports != nil && !goja.IsUndefined(exports) && !goja.IsNull(exports) {
+			if fn, ok := goja.AssertFunction(exports.ToObject(s.vm).Get(name)); ok {
+				return fn, nil
+			}
+		}
+	}
+	if fn, ok := goja.AssertFunction(s.vm.Get(name)); ok {
+		return fn, nil
+	}
+	return nil, fmt.Errorf("%s: function %s is not defined", s.name, name)
+}
+
+// allows はfetchでuにアクセスできるか判定します
+func (c *ScriptConfig) allows(u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	for _, h := range c.AllowedHosts {
+		if h == u.Host || h == u.Hostname() {
+			return true
+		}
+	}
+	return false
+}
+
+// resume はスクリプトの実行時間を数え始めます
+func (l *cpuLimit) resume() {
+	l.resumed = time.Now()
+	l.timer = time.AfterFunc(l.remaining, func() {
+		l.vm.Interrupt(errScriptCPULimit)
+	})
+}
+
+// pause はスクリプトの実行時間を数えるのを止めます
+func (l *cpuLimit) pause() {
+	l.timer.Stop()
+	l.remaining -= time.Since(l.resumed)
+}
+
+// NewScript はnameの名前のsrcのスクリプトを実行し、checkとprocessを呼び出す新しいScript構造体のポインタを返します
+func NewScript(name, src string, config ScriptConfig) (*Script, error) {
+	if config.CPULimit <= 0 {
+		config.CPULimit = DefaultScriptCPULimit
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultScriptTimeout
+	}
+
+	s := &Script{
+		name:   name,
+		config: config,
+		vm:     goja.New(),
+	}
+	s.client = &http.Client{
+		// リダイレクト先もAllowedHostsに含まれている必要があります
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if !s.config.allows(req.URL) {
+				return fmt.Errorf("%s: %s", errFetchNotAllowed, req.URL)
+			}
+			if len(via) >= 10 {
+				return errors.New("fetch: stopped after 10 redirects")
+			}
+			return nil
+		},
+	}
+	s.vm.SetMaxCallStackSize(maxScriptCallStackSize)
+	s.vm.SetFieldNameMapper(goja.TagFieldNameMapper("json", true))
+
+	exports := s.vm.NewObject()
+	module := s.vm.NewObject()
+	module.Set("exports", exports)
+	console := s.vm.NewObject()
+	console.Set("log", s.log)
+	s.vm.Set("module", module)
+	s.vm.Set("exports", exports)
+	s.vm.Set("console", console)
+	s.vm.Set("fetch", s.fetch)
+	store := s.vm.NewObject()
+	store.Set("get", s.storeGet)
+	store.Set("set", s.storeSet)
+	store.Set("incr", s.storeIncr)
+	store.Set("expire", s.storeExpire)
+	store.Set("del", s.storeDel)
+	s.vm.Set("store", store)
+	conversation := s.vm.NewObject()
+	conversation.Set("active", s.conversationActive)
+	conversation.Set("state", s.conversationState)
+	conversation.Set("start", s.conversationStart)
+	conversation.Set("end", s.conversationEnd)
+	s.vm.Set("conversation", conversation)
+
+	// トップレベルの実行にも同じ制限を付けます
+	if _, err := s.run(context.Background(), func() (goja.Value, error) {
+		return s.vm.RunScript(name, src)
+	}); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if s.check, err = s.exported("check"); err != nil {
+		return nil, err
+	}
+	if s.process, err = s.exported("process"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewScriptBot はsrcのスクリプトで反応して返信する、nameの名前の新しいBotの構造体のポインタを返します
+func NewScriptBot(name, src string, config ScriptConfig, out chan *model.Message) (*Bot, error) {
+	script, err := NewScript(name, src, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Bot{
+		name:      name,
+		in:        make(chan *model.Event),
+		out:       out,
+		checker:   script,
+		processor: script,
+	}, nil
+}
@@ -0,0 +1,152 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+)
+
+// scriptExt はScriptLoaderが読み込むスクリプトの拡張子です
+const scriptExt = ".js"
+
+// ScriptLoader はディレクトリにあるJavaScriptのスクリプトをbotとしてMulticasterに登録し、変更されたら登録し直す構造体です
+//
+// botの名前はファイル名から拡張子を除いたものです。ファイルが消されたbotは登録を解除し、書き換えられたbotは作り直します。
+// 読み込めないスクリプトはログに出して、そのファイルの前回読み込んだbotをそのまま動かします。
+// APIなどで同じ名前のbotが先に登録されていた場合は、そのbotを残してスクリプトは登録しません
+//
+//   fields
+//     Dir         string
+//     Interval    time.Duration
+//     Config      ScriptConfig
+//     multicaster *Multicaster
+//     out         chan *model.Message
+//     contents    map[string][]byte
+//     bots        map[string]*Bot 登録したbot。解除する時は名前ではなくこのbotを指定します
+type ScriptLoader struct {
+	Dir         string
+	Interval    time.Duration
+	Config      ScriptConfig
+	multicaster *Multicaster
+	out         chan *model.Message
+	contents    map[string][]byte
+	bots        map[string]*Bot
+}
+
+// Run はスクリプトを読み込み、ctxが終了するまでInterval毎に変更を確認します
+func (l *ScriptLoader) Run(ctx context.Context) {
+	l.reload()
+
+	ticker := time.NewTicker(l.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.reload()
+		}
+	}
+}
+
+// reload は前回から変わったスクリプトを読み込み直します
+func (l *ScriptLoader) reload() {
+	contents, err := l.read()
+	if err != nil {
+		log.Printf("scripts: %s", err)
+		return
+	}
+
+	for name := range l.contents {
+		if _, ok := contents[name]; ok {
+			continue
+		}
+		l.unregister(name)
+		delete(l.contents, name)
+		log.Printf("scripts: unloaded %s", name)
+	}
+
+	for name, content := range contents {
+		if old, ok := l.contents[name]; ok && bytes.Equal(old, content) {
+			continue
+		}
+		// 読み込めなかった内容を何度も読み込まないように、先に覚えておきます
+		l.contents[name] = content
+
+		b, err := NewScriptBot(name, string(content), l.Config, l.out)
+		if err != nil {
+			log.Printf("scripts: %s: %s", name, err)
+			continue
+		}
+		l.unregister(name)
+		if err := l.multicaster.Register(b); err != nil {
+			log.Printf("scripts: %s: %s", name, err)
+			// 登録できなかったスクリプトは、書き換えられていなくても次の確認で登録し直します
+			delete(l.contents, name)
+			continue
+		}
+		l.bots[name] = b
+		log.Printf("scripts: loaded %s", name)
+	}
+}
+
+// unregister はnameのスクリプトから登録したbotの登録を解除します
+//
+// APIなどで登録を解除され、同じ名前で登録し直されたbotは解除しません
+func (l *ScriptLoader) unregister(name string) {
+	b, ok := l.bots[name]
+	if !ok {
+		return
+	}
+	if err := l.multicaster.unregisterBot(b); err != nil && err != ErrBotNotFound {
+		log.Printf("scripts: %s: %s", name, err)
+	}
+	delete(l.bots, name)
+}
+
+// read はDirにあるスクリプトの内容を、botの名前をキーにして返します
+//
+// Dirがない場合は空のmapを返します
+func (l *ScriptLoader) read() (map[string][]byte, error) {
+	contents := map[string][]byte{}
+	files, err := ioutil.ReadDir(l.Dir)
+	if os.IsNotExist(err) {
+		return contents, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != scriptExt {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(l.Dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		contents[strings.TrimSuffix(f.Name(), scriptExt)] = content
+	}
+	return contents, nil
+}
+
+// NewScriptLoader はdirにあるスクリプトのbotをmcに登録する新しいScriptLoader構造体のポインタを返します
+//
+// 登録したbotはoutに投稿用messageを渡します
+func NewScriptLoader(dir string, mc *Multicaster, out chan *model.Message) *ScriptLoader {
+	return &ScriptLoader{
+		Dir:         dir,
+		Interval:    DefaultReloadInterval,
+		multicaster: mc,
+		out:         out,
+		contents:    map[string][]byte{},
+		bots:        map[string]*Bot{},
+	}
+}
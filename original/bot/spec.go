@@ -0,0 +1,88 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+)
+
+const (
+	// KindHelloWorld はNewHelloWorldBotと同じように反応するbotです
+	KindHelloWorld = "helloworld"
+	// KindOmikuji はNewOmikujiBotと同じように反応するbotです
+	KindOmikuji = "omikuji"
+	// KindKeyword はNewKeywordBotと同じように反応するbotです
+	KindKeyword = "keyword"
+	// KindReaction はNewReactionBotと同じように反応するbotです
+	KindReaction = "reaction"
+	// KindCommand はNewBuiltinCommandRouterのコマンドに返信するbotです
+	KindCommand = "command"
+	// KindReply はPatternにマッチしたメッセージにReplyを返すbotです
+	KindReply = "reply"
+)
+
+// ErrInvalidSpec はbotを作れない設定が指定された場合のエラーです
+var ErrInvalidSpec = errors.New("invalid bot spec")
+
+// Spec は実行中に登録するbotの設定です
+//
+//   fields
+//     Name    string       botの名前。チャンネルでbotを有効にする時に使います
+//     Kind    string       botの種類。Kindから始まる定数のいずれかです
+//     Pattern string       KindReplyの場合に反応するメッセージ本文の正規表現
+//     Reply   string       KindReplyの場合に返すメッセージ本文。$1などでPatternのグループを参照できます
+//     OnError *ErrorPolicy 返信を作れなかった時の扱い。省略した場合はDefaultErrorReplyを返信します
+type Spec struct {
+	Name    string       `json:"name"`
+	Kind    string       `json:"kind"`
+	Pattern string       `json:"pattern,omitempty"`
+	Reply   string       `json:"reply,omitempty"`
+	OnError *ErrorPolicy `json:"on_error,omitempty"`
+}
+
+// NewBotFromSpec はspecの設定で、outに投稿用messageを渡す新しいBotの構造体のポインタを返します
+//
+// KindKeywordとKindCommandのbotはextractorでキーワードを抽出します。specが不正な場合はErrInvalidSpecを含んだエラーを返します
+func NewBotFromSpec(spec *Spec, extractor KeywordExtractor, out chan *model.Message) (*Bot, error) {
+	if spec.Name == "" {
+		return nil, fmt.Errorf("%s: name is missing", ErrInvalidSpec)
+	}
+
+	var b *Bot
+	switch spec.Kind {
+	case KindHelloWorld:
+		b = NewHelloWorldBot(out)
+	case KindOmikuji:
+		b = NewOmikujiBot(out)
+	case KindKeyword:
+		b = NewKeywordBot(extractor, out)
+	case KindReaction:
+		b = NewReactionBot(out)
+	case KindCommand:
+		b = NewCommandBot(spec.Name, NewBuiltinCommandRouter(extractor), out)
+	case KindReply:
+		if spec.Pattern == "" || spec.Reply == "" {
+			return nil, fmt.Errorf("%s: pattern and reply are required for %s bot", ErrInvalidSpec, KindReply)
+		}
+		r, err := regexp.Compile(spec.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", ErrInvalidSpec, err)
+		}
+		b = &Bot{
+			in:        make(chan *model.Event),
+			out:       out,
+			checker:   &RegexpChecker{regexp: r},
+			processor: WithContext(&ReplyProcessor{regexp: r, template: spec.Reply}),
+		}
+	default:
+		return nil, fmt.Errorf("%s: unknown kind %q", ErrInvalidSpec, spec.Kind)
+	}
+	b.name = spec.Name
+	if spec.OnError != nil {
+		b.onError = *spec.OnError
+	}
+
+	return b, nil
+}
@@ -0,0 +1,121 @@
+package bot
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+)
+
+// ErrKeyNotFound はStoreに値が存在しないか、期限を過ぎていた場合のエラーです
+var ErrKeyNotFound = errors.New("key not found")
+
+// storeKey はctxにStoreを入れるためのキーです
+type storeKey struct{}
+
+// Store はbotがDBに値を保存し、再起動した後も使えるようにするKVSです
+//
+// 値はnamespaceごとに分かれています。MulticasterはBotを登録する時に、botの名前のnamespaceのStoreを渡します。
+// processorはStoreFromContextでStoreを受け取ります
+//
+//   fields
+//     db        *sql.DB
+//     namespace string
+//     now       func() time.Time テストでは時刻を差し替えます
+type Store struct {
+	db        *sql.DB
+	namespace string
+	now       func() time.Time
+}
+
+// Get はkeyの値を返します。値がない場合はErrKeyNotFoundを返します
+func (s *Store) Get(key string) (string, error) {
+	v, err := model.BotValueByKey(s.db, s.namespace, key, s.now())
+	switch {
+	case err == sql.ErrNoRows:
+		return "", ErrKeyNotFound
+	case err != nil:
+		return "", err
+	}
+	return v.Value, nil
+}
+
+// Set はkeyにvalueを保存します。ttlが0より大きい場合は、ttlが経つと値を消します
+func (s *Store) Set(key, value string, ttl time.Duration) error {
+	v := &model.BotValue{
+		Namespace: s.namespace,
+		Key:       key,
+		Value:     value,
+	}
+	if ttl > 0 {
+		v.Expires = s.now().Add(ttl)
+	}
+	return v.Save(s.db)
+}
+
+// Incr はkeyの整数の値にdeltaを足して、足した後の値を返します。値がない場合は0に足します
+//
+// 値が整数でない場合はmodel.ErrNotIntegerを返します
+func (s *Store) Incr(key string, delta int64) (int64, error) {
+	return model.IncrBotValue(s.db, s.namespace, key, delta, s.now())
+}
+
+// Expire はkeyの値をttlが経つと消すようにします。ttlが0以下の場合は期限をなくします
+//
+// 値がない場合はErrKeyNotFoundを返します
+func (s *Store) Expire(key string, ttl time.Duration) error {
+	var expires time.Time
+	if ttl > 0 {
+		expires = s.now().Add(ttl)
+	}
+	ok, err := model.ExpireBotValue(s.db, s.namespace, key, expires, s.now())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+// Delete はkeyの値を消します
+func (s *Store) Delete(key string) error {
+	return model.DeleteBotValue(s.db, s.namespace, key)
+}
+
+// Namespace はnameのnamespaceの値を読み書きする新しいStore構造体のポインタを返します
+func (s *Store) Namespace(name string) *Store {
+	return &Store{
+		db:        s.db,
+		namespace: name,
+		now:       s.now,
+	}
+}
+
+// Clean は期限を過ぎた全てのnamespaceの値を消します
+func (s *Store) Clean() error {
+	return model.DeleteExpiredBotValues(s.db, s.now())
+}
+
+// WithStore はsを入れたctxを返します
+func WithStore(ctx context.Context, s *Store) context.Context {
+	return context.WithValue(ctx, storeKey{}, s)
+}
+
+// StoreFromContext はctxに入っているStoreを返します。ない場合はnilを返します
+func StoreFromContext(ctx context.Context) *Store {
+	s, _ := ctx.Value(storeKey{}).(*Store)
+	return s
+}
+
+// NewStore はdbに値を保存する新しいStore構造体のポインタを返します
+//
+// namespaceは空なので、Namespaceでbotごとのnamespaceにして使います
+func NewStore(db *sql.DB) *Store {
+	return &Store{
+		db:  db,
+		now: time.Now,
+	}
+}
@@ -1,39 +1,31 @@
 package bot
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
-	"net/url"
+	"strings"
 	"time"
 )
 
-// get はurlにGETします
-func get(url string, out interface{}) error {
-	resp, err := http.Get(url)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
+// defaultHTTPTimeout はbotが外部のAPIを呼ぶ時に、ctxに期限がなくても待つ最大の時間です
+const defaultHTTPTimeout = 30 * time.Second
 
-	respBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return err
-	}
+// httpClient はbotが外部のAPIを呼ぶためのクライアントです
+var httpClient = &http.Client{Timeout: defaultHTTPTimeout}
 
-	err = json.Unmarshal(respBody, out)
+// get はurlにGETします
+//
+// ctxが終了したらリクエストを中断します
+func get(ctx context.Context, url string, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		return err
 	}
-
-	return nil
-}
-
-// post はurlにparamsをPOSTします
-func post(url string, params url.Values, out interface{}) error {
-	resp, err := http.PostForm(url, params)
+	resp, err := httpClient.Do(req.WithContext(ctx))
 	if err != nil {
 		return err
 	}
@@ -52,33 +44,42 @@ func post(url string, params url.Values, out interface{}) error {
 	return nil
 }
 
-// postJSON はinputをJSON形式でurlにPOSTします
-func postJSON(url string, input interface{}, output interface{}) error {
-	data, err := json.Marshal(input)
-	if err != nil {
-		return err
-	}
+// randIntn は0からn-1までのintの乱数を返します
+func randIntn(n int) int {
+	rand.Seed(time.Now().UnixNano())
+	return rand.Intn(n)
+}
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(data))
+// doJSON はurlにmethodでbodyを送り、JSONのレスポンスをoutに読み込みます
+//
+// ctxが終了したらリクエストを中断します
+func doJSON(ctx context.Context, method, url string, header http.Header, body string, out interface{}) error {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
 	if err != nil {
 		return err
 	}
+	for k, vs := range header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	if body != "" && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	resp, err := httpClient.Do(req.WithContext(ctx))
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
-	err = json.Unmarshal(body, &output)
+	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return err
 	}
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("%s %s: %s", method, url, resp.Status)
+	}
 
-	return nil
-}
-
-// randIntn は0からn-1までのintの乱数を返します
-func randIntn(n int) int {
-	rand.Seed(time.Now().UnixNano())
-	return rand.Intn(n)
+	return json.Unmarshal(respBody, out)
 }
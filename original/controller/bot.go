@@ -0,0 +1,115 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/bot"
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/httputil"
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+	"github.com/gin-gonic/gin"
+)
+
+// Bot is controller for requests to bots
+//
+// Outは実行中に登録したbotが投稿用messageを渡す先です。Keywordsはbotがキーワードを抽出する時に使います
+type Bot struct {
+	Multicaster *bot.Multicaster
+	Out         chan *model.Message
+	Keywords    bot.KeywordExtractor
+}
+
+// All は登録されている全botの状態をJSONで返します
+func (b *Bot) All(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"result": b.Multicaster.Bots(),
+		"error":  nil,
+	})
+}
+
+// Create はリクエストボディのbot.Specで新しいbotを作って登録し、botの状態をJSONで返します
+//
+// 登録したbotはチャンネルで有効にするまで反応しません
+func (b *Bot) Create(c *gin.Context) {
+	var spec bot.Spec
+
+	if c.Request.ContentLength == 0 {
+		resp := httputil.NewErrorResponse(errors.New("body is missing"))
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	if err := c.BindJSON(&spec); err != nil {
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	nb, err := bot.NewBotFromSpec(&spec, b.Keywords, b.Out)
+	if err != nil {
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	err = b.Multicaster.Register(nb)
+	switch {
+	case err == bot.ErrBotExists:
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusConflict, resp)
+		return
+	case err != nil:
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"result": bot.BotStatus{Name: nb.Name()},
+		"error":  nil,
+	})
+}
+
+// DeleteByName はパラメーターで受け取ったnameのbotの登録を解除し、botが停止してから返します
+func (b *Bot) DeleteByName(c *gin.Context) {
+	b.write(c, b.Multicaster.Unregister(c.Param("name")), nil)
+}
+
+// Pause はパラメーターで受け取ったnameのbotを一時停止し、botの状態をJSONで返します
+func (b *Bot) Pause(c *gin.Context) {
+	name := c.Param("name")
+	b.write(c, b.Multicaster.Pause(name), &bot.BotStatus{Name: name, Paused: true})
+}
+
+// Resume はパラメーターで受け取ったnameのbotを再開し、botの状態をJSONで返します
+func (b *Bot) Resume(c *gin.Context) {
+	name := c.Param("name")
+	b.write(c, b.Multicaster.Resume(name), &bot.BotStatus{Name: name, Paused: false})
+}
+
+// Queues は全botのキューの長さや捨てたeventの数をJSONで返します
+func (b *Bot) Queues(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"result": b.Multicaster.Stats(),
+		"error":  nil,
+	})
+}
+
+// write はbotの操作の結果errに対応するレスポンスを書き込みます
+func (b *Bot) write(c *gin.Context, err error, result interface{}) {
+	switch {
+	case err == bot.ErrBotNotFound:
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusNotFound, resp)
+		return
+	case err != nil:
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result": result,
+		"error":  nil,
+	})
+}
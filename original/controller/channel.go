@@ -0,0 +1,160 @@
+package controller
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/httputil"
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/service"
+	"github.com/gin-gonic/gin"
+)
+
+// maxChannelNameLength はチャンネル名の最大文字数です
+const maxChannelNameLength = 32
+
+// errChannelNotFound は存在しないチャンネルが指定された場合のエラーです
+var errChannelNotFound = errors.New("channel not found")
+
+// Channel is controller for requests to channels
+type Channel struct {
+	DB   *sql.DB
+	Bots *service.ChannelBots
+}
+
+// All は全てのチャンネルを取得してJSONで返します
+func (ch *Channel) All(c *gin.Context) {
+	channels, err := model.ChannelsAll(ch.DB)
+	if err != nil {
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result": channels,
+		"error":  nil,
+	})
+}
+
+// GetByID はパラメーターで受け取ったidのチャンネルを取得してJSONで返します
+func (ch *Channel) GetByID(c *gin.Context) {
+	channel, ok := ch.find(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result": channel,
+		"error":  nil,
+	})
+}
+
+// Create は新しいチャンネルを保存し、作成したチャンネルをJSONで返します
+func (ch *Channel) Create(c *gin.Context) {
+	var channel model.Channel
+
+	if c.Request.ContentLength == 0 {
+		resp := httputil.NewErrorResponse(errors.New("body is missing"))
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	if err := c.BindJSON(&channel); err != nil {
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	if channel.Name == "" || utf8.RuneCountInString(channel.Name) > maxChannelNameLength {
+		resp := httputil.NewErrorResponse(errors.New("name must be 1 to 32 characters"))
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	inserted, err := channel.Insert(ch.DB)
+	switch {
+	case err == model.ErrChannelExists:
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusConflict, resp)
+		return
+	case err != nil:
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"result": inserted,
+		"error":  nil,
+	})
+}
+
+// EnableBot はパラメーターで受け取ったidのチャンネルでnameのbotを有効にし、チャンネルをJSONで返します
+func (ch *Channel) EnableBot(c *gin.Context) {
+	ch.setBot(c, true)
+}
+
+// DisableBot はパラメーターで受け取ったidのチャンネルでnameのbotを無効にし、チャンネルをJSONで返します
+func (ch *Channel) DisableBot(c *gin.Context) {
+	ch.setBot(c, false)
+}
+
+// setBot はチャンネルでbotを有効または無効にします
+func (ch *Channel) setBot(c *gin.Context, enabled bool) {
+	channel, ok := ch.find(c)
+	if !ok {
+		return
+	}
+
+	var err error
+	if enabled {
+		err = ch.Bots.Enable(channel, c.Param("name"))
+	} else {
+		err = ch.Bots.Disable(channel, c.Param("name"))
+	}
+	if err != nil {
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	channel, ok = ch.find(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result": channel,
+		"error":  nil,
+	})
+}
+
+// find はパラメーターで受け取ったidのチャンネルを取得します
+//
+// 取得できなかった場合はエラーレスポンスを書き込み、falseを返します
+func (ch *Channel) find(c *gin.Context) (*model.Channel, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusBadRequest, resp)
+		return nil, false
+	}
+
+	channel, err := model.ChannelByID(ch.DB, id)
+	switch {
+	case err == sql.ErrNoRows:
+		resp := httputil.NewErrorResponse(errChannelNotFound)
+		c.JSON(http.StatusNotFound, resp)
+		return nil, false
+	case err != nil:
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return nil, false
+	}
+
+	return channel, true
+}
@@ -3,41 +3,134 @@ package controller
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/auth"
 	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/httputil"
 	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/service"
 	"github.com/gin-gonic/gin"
 )
 
+var (
+	// errForbidden はメッセージの投稿者でも管理者でもないユーザーが編集・削除しようとした場合のエラーです
+	errForbidden = errors.New("only the author or an admin can modify this message")
+)
+
 // Message is controller for requests to messages
+//
+// メッセージの投稿・更新・削除はServiceに任せます
 type Message struct {
-	DB     *sql.DB
-	Stream chan *model.Message
+	DB      *sql.DB
+	Service *service.Message
 }
 
-// All は全てのメッセージを取得してJSONで返します
+const (
+	// defaultMessagesLimit はlimitが指定されなかった場合に返すメッセージの件数です
+	defaultMessagesLimit = 100
+	// maxMessagesLimit は1回のリクエストで返すメッセージの最大件数です
+	maxMessagesLimit = 1000
+)
+
+// All はクエリパラメーターの条件を満たすメッセージを取得してJSONで返します
+//
+//   query parameters
+//     limit    最大件数(デフォルト100, 最大1000)
+//     before   このIDより前のメッセージを返します
+//     after    このIDより後のメッセージを返します
+//     since    この日時(RFC3339)以降に作成されたメッセージを返します
+//     username このユーザーのメッセージだけを返します
+//     channel_id このチャンネルのメッセージだけを返します。/api/channels/:id/messagesではパスのidを使います
+//
+// 続きがある場合はnext_cursorを返すので、同じパラメーター(afterだけを指定した場合はafter、それ以外はbefore)に指定して次のページを取得します
 func (m *Message) All(c *gin.Context) {
-	msgs, err := model.MessagesAll(m.DB)
+	q, err := newMessageQuery(c)
 	if err != nil {
 		resp := httputil.NewErrorResponse(err)
-		c.JSON(http.StatusInternalServerError, resp)
+		c.JSON(http.StatusBadRequest, resp)
 		return
 	}
 
-	if len(msgs) == 0 {
-		c.JSON(http.StatusOK, make([]*model.Message, 0))
+	msgs, next, err := model.MessagesByQuery(m.DB, q)
+	if err != nil {
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"result": msgs,
-		"error":  nil,
-	})
+	c.JSON(http.StatusOK, httputil.NewPageResponse(msgs, next))
+}
+
+// newMessageQuery はクエリパラメーターからmodel.MessageQueryを作ります
+func newMessageQuery(c *gin.Context) (*model.MessageQuery, error) {
+	q := &model.MessageQuery{
+		Limit:    defaultMessagesLimit,
+		Username: c.Query("username"),
+	}
+
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid limit: %s", v)
+		}
+		if limit > maxMessagesLimit {
+			limit = maxMessagesLimit
+		}
+		q.Limit = limit
+	}
+
+	if v := c.Query("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || before <= 0 {
+			return nil, fmt.Errorf("invalid before: %s", v)
+		}
+		q.Before = before
+	}
+
+	if v := c.Query("after"); v != "" {
+		after, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || after <= 0 {
+			return nil, fmt.Errorf("invalid after: %s", v)
+		}
+		q.After = after
+	}
+
+	channelID := c.Param("id")
+	if channelID == "" {
+		channelID = c.Query("channel_id")
+	}
+	if channelID != "" {
+		id, err := strconv.ParseInt(channelID, 10, 64)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("invalid channel id: %s", channelID)
+		}
+		q.ChannelID = id
+	}
+
+	if v := c.Query("since"); v != "" {
+		since, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid since: %s", v)
+		}
+		q.Since = since
+	}
+
+	return q, nil
 }
 
 // GetByID はパラメーターで受け取ったidのメッセージを取得してJSONで返します
+//
+// gin v1.2では/messages/:idと同じ階層に/messages/searchを登録できないので、idがsearchの場合はSearchで処理します
 func (m *Message) GetByID(c *gin.Context) {
+	if c.Param("id") == "search" {
+		m.Search(c)
+		return
+	}
+
 	msg, err := model.MessageByID(m.DB, c.Param("id"))
 
 	switch {
@@ -51,12 +144,104 @@ func (m *Message) GetByID(c *gin.Context) {
 		return
 	}
 
+	c.Header("ETag", msg.ETag())
 	c.JSON(http.StatusOK, gin.H{
 		"result": msg,
 		"error":  nil,
 	})
 }
 
+// Search はクエリパラメーターqで全文検索したメッセージを、関連度の高い順にJSONで返します
+//
+//   query parameters
+//     q          検索語。空白で区切った語を全て含むメッセージを返します
+//     limit      最大件数(デフォルト100, 最大1000)
+//     offset     先頭から読み飛ばす件数
+//     channel_id このチャンネルのメッセージだけを返します
+//
+// 結果のsnippetは検索語を<mark>と</mark>で囲んだ本文の抜粋です。本文はHTMLエスケープしてあるので、そのままHTMLとして表示できます。
+// 続きがある場合はnext_cursorを返すので、offsetに指定して次のページを取得します
+func (m *Message) Search(c *gin.Context) {
+	q, err := newMessageSearchQuery(c)
+	if err != nil {
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	results, next, err := model.MessagesBySearch(m.DB, q)
+	if err != nil {
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	c.JSON(http.StatusOK, httputil.NewPageResponse(results, next))
+}
+
+// newMessageSearchQuery はクエリパラメーターからmodel.MessageSearchQueryを作ります
+func newMessageSearchQuery(c *gin.Context) (*model.MessageSearchQuery, error) {
+	q := &model.MessageSearchQuery{
+		Query: strings.TrimSpace(c.Query("q")),
+		Limit: defaultMessagesLimit,
+	}
+	if q.Query == "" {
+		return nil, errors.New("q is missing")
+	}
+
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid limit: %s", v)
+		}
+		if limit > maxMessagesLimit {
+			limit = maxMessagesLimit
+		}
+		q.Limit = limit
+	}
+
+	if v := c.Query("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("invalid offset: %s", v)
+		}
+		q.Offset = offset
+	}
+
+	if v := c.Query("channel_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("invalid channel id: %s", v)
+		}
+		q.ChannelID = id
+	}
+
+	return q, nil
+}
+
+// Thread はパラメーターで受け取ったidのメッセージのスレッドを、先頭メッセージと返信の古い順でJSONで返します
+//
+// idが返信の場合は、その返信先のスレッドを返します
+func (m *Message) Thread(c *gin.Context) {
+	msgs, err := model.MessageThread(m.DB, c.Param("id"))
+
+	switch {
+	case err == sql.ErrNoRows:
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusNotFound, resp)
+		return
+	case err != nil:
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result": msgs,
+		"error":  nil,
+	})
+}
+
 // Create は新しいメッセージ保存し、作成したメッセージをJSONで返します
 func (m *Message) Create(c *gin.Context) {
 	var msg model.Message
@@ -73,35 +258,155 @@ func (m *Message) Create(c *gin.Context) {
 		return
 	}
 
-	// Tutorial 1-2. ユーザー名を追加しよう
-	// できる人は、ユーザー名が空だったら`anonymous`等適当なユーザー名で投稿するようにしてみよう
+	// /api/channels/:id/messagesではパスのidのチャンネルに、それ以外ではchannel_idのチャンネル(省略時はgeneral)に投稿します
+	if v := c.Param("id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			resp := httputil.NewErrorResponse(err)
+			c.JSON(http.StatusBadRequest, resp)
+			return
+		}
+		msg.ChannelID = id
+	}
 
-	inserted, err := msg.Insert(m.DB)
-	if err != nil {
+	// Tutorial 1-2. ユーザー名を追加しよう
+	// 投稿者はリクエストボディではなくログイン中のユーザーにします
+	inserted, err := m.Service.Create(c.Request.Context(), auth.CurrentUser(c), &msg)
+	switch {
+	case err == service.ErrParentNotFound, err == service.ErrChannelNotFound:
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusNotFound, resp)
+		return
+	case err != nil:
 		resp := httputil.NewErrorResponse(err)
 		c.JSON(http.StatusInternalServerError, resp)
 		return
 	}
 
-	// bot対応
-	m.Stream <- inserted
-
+	c.Header("ETag", inserted.ETag())
 	c.JSON(http.StatusCreated, gin.H{
 		"result": inserted,
 		"error":  nil,
 	})
 }
 
-// UpdateByID は...
+// UpdateByID はパラメーターで受け取ったidのメッセージを更新し、更新したメッセージをJSONで返します
+//
+// If-Matchヘッダーが指定されている場合、メッセージのETagと一致しなければ412を返します
 func (m *Message) UpdateByID(c *gin.Context) {
-	// Mission 1-1. メッセージを編集しよう
-	// ...
-	c.JSON(http.StatusCreated, gin.H{})
+	var req model.Message
+
+	if c.Request.ContentLength == 0 {
+		resp := httputil.NewErrorResponse(errors.New("body is missing"))
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	if err := c.BindJSON(&req); err != nil {
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	msg, ok := m.current(c)
+	if !ok {
+		return
+	}
+
+	updated, err := m.Service.Update(c.Request.Context(), msg, req.Body)
+	if err != nil {
+		m.writeModifyError(c, err)
+		return
+	}
+
+	c.Header("ETag", updated.ETag())
+	c.JSON(http.StatusOK, gin.H{
+		"result": updated,
+		"error":  nil,
+	})
 }
 
-// DeleteByID は...
+// DeleteByID はパラメーターで受け取ったidのメッセージを削除し、削除したメッセージをJSONで返します
+//
+// スレッドの先頭メッセージの場合は全ての返信も削除します。
+// If-Matchヘッダーが指定されている場合、メッセージのETagと一致しなければ412を返します
 func (m *Message) DeleteByID(c *gin.Context) {
-	// Mission 1-2. メッセージを削除しよう
-	// ...
-	c.JSON(http.StatusOK, gin.H{})
+	msg, ok := m.current(c)
+	if !ok {
+		return
+	}
+
+	if err := m.Service.Delete(c.Request.Context(), msg); err != nil {
+		m.writeModifyError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result": msg,
+		"error":  nil,
+	})
+}
+
+// current は更新・削除対象のメッセージを取得し、ログイン中のユーザーの権限とIf-Matchヘッダーを確認します
+//
+// 取得できなかった場合や照合に失敗した場合はエラーレスポンスを書き込み、falseを返します
+func (m *Message) current(c *gin.Context) (*model.Message, bool) {
+	msg, err := model.MessageByID(m.DB, c.Param("id"))
+
+	switch {
+	case err == sql.ErrNoRows:
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusNotFound, resp)
+		return nil, false
+	case err != nil:
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return nil, false
+	}
+
+	if !auth.CurrentUser(c).CanModify(msg) {
+		resp := httputil.NewErrorResponse(errForbidden)
+		c.JSON(http.StatusForbidden, resp)
+		return nil, false
+	}
+
+	if !matchETag(c.GetHeader("If-Match"), msg.ETag()) {
+		resp := httputil.NewErrorResponse(model.ErrConflict)
+		c.Header("ETag", msg.ETag())
+		c.JSON(http.StatusPreconditionFailed, resp)
+		return nil, false
+	}
+
+	return msg, true
+}
+
+// writeModifyError はmodel.Message.Update, Deleteが返したエラーに対応するレスポンスを書き込みます
+func (m *Message) writeModifyError(c *gin.Context, err error) {
+	switch {
+	case err == sql.ErrNoRows:
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusNotFound, resp)
+	case err == model.ErrConflict:
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusPreconditionFailed, resp)
+	default:
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+	}
+}
+
+// matchETag はIf-Matchヘッダーの値ifMatchがetagに一致するか判定します
+//
+// ifMatchが空の場合は条件なしとみなしてtrueを返します
+func matchETag(ifMatch, etag string) bool {
+	if ifMatch == "" {
+		return true
+	}
+	for _, v := range strings.Split(ifMatch, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || v == etag {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,95 @@
+package controller
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/auth"
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/httputil"
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/service"
+	"github.com/gin-gonic/gin"
+)
+
+// maxEmojiLength はリアクションの絵文字の最大文字数です
+//
+// 肌の色や家族の絵文字はいくつかのコードポイントを組み合わせて1文字になるので、余裕を持たせています
+const maxEmojiLength = 16
+
+// errInvalidEmoji はリアクションに使えない文字列が指定された場合のエラーです
+var errInvalidEmoji = errors.New("emoji must be 1 to 16 characters without spaces")
+
+// Reaction is controller for requests to message reactions
+//
+// リアクションを付けたり取り消したりするのはServiceに任せます
+type Reaction struct {
+	DB      *sql.DB
+	Service *service.Message
+}
+
+// Create はパラメーターで受け取ったidのメッセージにログイン中のユーザーのemojiのリアクションを付け、メッセージをJSONで返します
+//
+// 既に同じリアクションを付けている場合は何もしません
+func (r *Reaction) Create(c *gin.Context) {
+	r.update(c, model.EventReactionAdded)
+}
+
+// DeleteByEmoji はパラメーターで受け取ったidのメッセージからログイン中のユーザーのemojiのリアクションを取り消し、メッセージをJSONで返します
+//
+// 同じリアクションを付けていない場合は何もしません
+func (r *Reaction) DeleteByEmoji(c *gin.Context) {
+	r.update(c, model.EventReactionRemoved)
+}
+
+// update はtの種類に応じてリアクションを付けるか取り消します
+func (r *Reaction) update(c *gin.Context, t model.EventType) {
+	emoji := c.Param("emoji")
+	if !validEmoji(emoji) {
+		resp := httputil.NewErrorResponse(errInvalidEmoji)
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	msg, err := model.MessageByID(r.DB, c.Param("id"))
+	switch {
+	case err == sql.ErrNoRows:
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusNotFound, resp)
+		return
+	case err != nil:
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	if t == model.EventReactionAdded {
+		msg, err = r.Service.AddReaction(c.Request.Context(), auth.CurrentUser(c), msg, emoji)
+	} else {
+		msg, err = r.Service.RemoveReaction(c.Request.Context(), auth.CurrentUser(c), msg, emoji)
+	}
+	if err != nil {
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result": msg,
+		"error":  nil,
+	})
+}
+
+// validEmoji はemojiがリアクションに使える文字列か判定します
+func validEmoji(emoji string) bool {
+	n := utf8.RuneCountInString(emoji)
+	if n == 0 || n > maxEmojiLength {
+		return false
+	}
+	return strings.IndexFunc(emoji, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}) < 0
+}
@@ -0,0 +1,250 @@
+package controller
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/httputil"
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/pubsub"
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// streamBufferSize は1つの接続が溜めておけるeventの数です。溢れた場合は切断します
+	streamBufferSize = 64
+	// streamWriteTimeout はフレーム1つの書き込みにかけられる時間です
+	streamWriteTimeout = 10 * time.Second
+	// streamPingInterval は接続を維持するためにpingを送る間隔です
+	streamPingInterval = 30 * time.Second
+	// streamPongTimeout はpingへの応答を待つ時間です
+	streamPongTimeout = streamPingInterval + 10*time.Second
+	// replayPageSize は再接続時にDBから読み出すメッセージの1回あたりの件数です
+	replayPageSize = 100
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// Stream is controller for requests to message streams
+type Stream struct {
+	DB  *sql.DB
+	Hub *pubsub.Hub
+}
+
+// WebSocket はWebSocketでメッセージの作成・更新・削除のeventをJSONで配信します
+//
+//   query parameters
+//     last_id 再接続時に最後に受け取ったメッセージのIDを指定すると、それより後に作成されたメッセージを先に配信します
+func (s *Stream) WebSocket(c *gin.Context) {
+	lastID, err := parseLastID(c.Query("last_id"))
+	if err != nil {
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// Upgradeがエラーレスポンスを書き込みます
+		log.Printf("websocket: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	// 取りこぼしがないように、DBから読み出す前に購読を始めます
+	sub := s.Hub.Subscribe(streamBufferSize)
+	defer s.Hub.Unsubscribe(sub)
+
+	closed := make(chan struct{})
+	go readLoop(conn, closed)
+
+	if lastID != 0 {
+		lastID, err = replay(s.DB, lastID, func(e *model.Event) error {
+			return writeEvent(conn, e)
+		})
+		if err != nil {
+			log.Printf("websocket: %s", err)
+			return
+		}
+	}
+
+	ticker := time.NewTicker(streamPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case e, ok := <-sub.C:
+			if !ok {
+				// 配信が追いつかなかったので、last_idを指定して再接続してもらいます
+				conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"))
+				return
+			}
+			if skipReplayed(e, lastID) {
+				break
+			}
+			if err := writeEvent(conn, e); err != nil {
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Events はServer-Sent Eventsでメッセージの作成・更新・削除のeventを配信します
+//
+// eventの種類をevent、メッセージのJSONをdataとして送ります。作成eventにはメッセージのIDをidとして付けるので、
+// 再接続時にLast-Event-IDヘッダー(またはlast_event_idクエリパラメーター)で、それより後に作成されたメッセージを先に配信します
+func (s *Stream) Events(c *gin.Context) {
+	// gin.Context.GetHeaderは正規化されていないキーを扱えないので、http.Header.Getを使います
+	v := c.Request.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = c.Query("last_event_id")
+	}
+	lastID, err := parseLastID(v)
+	if err != nil {
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	// 取りこぼしがないように、DBから読み出す前に購読を始めます
+	sub := s.Hub.Subscribe(streamBufferSize)
+	defer s.Hub.Unsubscribe(sub)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	if lastID != 0 {
+		lastID, err = replay(s.DB, lastID, func(e *model.Event) error {
+			c.Render(-1, newSSEvent(e))
+			return nil
+		})
+		if err != nil {
+			log.Printf("sse: %s", err)
+			return
+		}
+	}
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(streamPingInterval)
+	defer ticker.Stop()
+
+	done := c.Request.Context().Done()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-done:
+			return false
+		case e, ok := <-sub.C:
+			if !ok {
+				// 配信が追いつかなかったので、Last-Event-IDを指定して再接続してもらいます
+				return false
+			}
+			if !skipReplayed(e, lastID) {
+				c.Render(-1, newSSEvent(e))
+			}
+			return true
+		case <-ticker.C:
+			// プロキシに切断されないようにコメント行を送ります
+			_, err := io.WriteString(w, ": ping\n\n")
+			return err == nil
+		}
+	})
+}
+
+// newSSEvent はeからServer-Sent Eventsのeventを作ります
+func newSSEvent(e *model.Event) sse.Event {
+	ev := sse.Event{
+		Event: string(e.Type),
+		Data:  e.Message,
+	}
+	if e.Type == model.EventCreated {
+		ev.Id = strconv.FormatInt(e.Message.ID, 10)
+	}
+	return ev
+}
+
+// readLoop はクライアントからのフレームを読み捨て、切断されたらclosedを閉じます
+//
+// pong, closeなどの制御フレームを処理するために読み続ける必要があります
+func readLoop(conn *websocket.Conn, closed chan struct{}) {
+	defer close(closed)
+
+	conn.SetReadLimit(512)
+	conn.SetReadDeadline(time.Now().Add(streamPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(streamPongTimeout))
+	})
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			return
+		}
+	}
+}
+
+// writeEvent はeをJSONのテキストフレームとして書き込みます
+func writeEvent(conn *websocket.Conn, e *model.Event) error {
+	conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	return conn.WriteJSON(e)
+}
+
+// replay はlastIDより後に作成されたメッセージをDBから読み出し、作成eventとしてwriteに渡します
+//
+// 最後に渡したメッセージのIDを返します
+func replay(db *sql.DB, lastID int64, write func(*model.Event) error) (int64, error) {
+	q := &model.MessageQuery{
+		Limit: replayPageSize,
+		After: lastID,
+	}
+	for {
+		msgs, next, err := model.MessagesByQuery(db, q)
+		if err != nil {
+			return lastID, err
+		}
+		for _, msg := range msgs {
+			if err := write(model.NewEvent(model.EventCreated, msg)); err != nil {
+				return lastID, err
+			}
+			lastID = msg.ID
+		}
+		if next == 0 {
+			return lastID, nil
+		}
+		q.After = next
+	}
+}
+
+// skipReplayed はeがreplayで既に配信した作成eventの場合trueを返します
+func skipReplayed(e *model.Event, lastID int64) bool {
+	return e.Type == model.EventCreated && e.Message.ID <= lastID
+}
+
+// parseLastID は再接続時に指定された最後に受け取ったメッセージのIDを返します
+func parseLastID(v string) (int64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || id < 0 {
+		return 0, fmt.Errorf("invalid last event id: %s", v)
+	}
+	return id, nil
+}
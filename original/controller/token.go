@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/auth"
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/httputil"
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+	"github.com/gin-gonic/gin"
+)
+
+// Token is controller for requests to api tokens
+type Token struct {
+	DB *sql.DB
+}
+
+// All はログイン中のユーザーのAPIトークンを全て取得してJSONで返します
+//
+// トークンの値はハッシュ化して保存しているので返しません
+func (t *Token) All(c *gin.Context) {
+	tokens, err := model.TokensByUserID(t.DB, auth.CurrentUser(c).ID)
+	if err != nil {
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result": tokens,
+		"error":  nil,
+	})
+}
+
+// Create はログイン中のユーザーの新しいAPIトークンを作成し、トークンの値を含めてJSONで返します
+//
+// トークンの値を返すのはこの時だけです
+func (t *Token) Create(c *gin.Context) {
+	var req struct {
+		Name  string      `json:"name"`
+		Scope model.Scope `json:"scope"`
+	}
+
+	if c.Request.ContentLength == 0 {
+		resp := httputil.NewErrorResponse(errors.New("body is missing"))
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	if err := c.BindJSON(&req); err != nil {
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	if !req.Scope.Valid() {
+		resp := httputil.NewErrorResponse(model.ErrInvalidScope)
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	// 今のリクエストに許可されているより強いscopeのトークンは作れません。adminのトークンは管理者だけが作れます
+	if !auth.CurrentScope(c).Allows(req.Scope) || (req.Scope == model.ScopeAdmin && !auth.CurrentUser(c).Admin) {
+		resp := httputil.NewErrorResponse(auth.ErrInsufficientScope)
+		c.JSON(http.StatusForbidden, resp)
+		return
+	}
+
+	token, err := model.NewToken(t.DB, auth.CurrentUser(c).ID, req.Name, req.Scope)
+	if err != nil {
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"result": token,
+		"error":  nil,
+	})
+}
+
+// DeleteByID はログイン中のユーザーのパラメーターで受け取ったidのAPIトークンを失効させます
+func (t *Token) DeleteByID(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	err = model.DeleteToken(t.DB, auth.CurrentUser(c).ID, id)
+	switch {
+	case err == sql.ErrNoRows:
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusNotFound, resp)
+		return
+	case err != nil:
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result": nil,
+		"error":  nil,
+	})
+}
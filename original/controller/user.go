@@ -0,0 +1,167 @@
+package controller
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/auth"
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/httputil"
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// maxUserNameLength はユーザー名の最大文字数です
+	maxUserNameLength = 32
+	// minPasswordLength はパスワードの最小文字数です
+	minPasswordLength = 8
+)
+
+// User is controller for requests to users and sessions
+type User struct {
+	DB *sql.DB
+}
+
+// credentials はユーザー登録・ログインのリクエストボディです
+type credentials struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// SignUp は新しいユーザーを登録してログインし、登録したユーザーをJSONで返します
+func (u *User) SignUp(c *gin.Context) {
+	var req credentials
+
+	if c.Request.ContentLength == 0 {
+		resp := httputil.NewErrorResponse(errors.New("body is missing"))
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	if err := c.BindJSON(&req); err != nil {
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	if err := validateCredentials(&req); err != nil {
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	user, err := model.NewUser(req.Name, req.Password)
+	if err != nil {
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	inserted, err := user.Insert(u.DB)
+	switch {
+	case err == model.ErrUserExists:
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusConflict, resp)
+		return
+	case err != nil:
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	if err := auth.Login(c, u.DB, inserted); err != nil {
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"result": inserted,
+		"error":  nil,
+	})
+}
+
+// Login は名前とパスワードを確認してログインし、ログインしたユーザーをJSONで返します
+func (u *User) Login(c *gin.Context) {
+	var req credentials
+
+	if c.Request.ContentLength == 0 {
+		resp := httputil.NewErrorResponse(errors.New("body is missing"))
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	if err := c.BindJSON(&req); err != nil {
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	user, err := model.UserByName(u.DB, req.Name)
+	switch {
+	case err == sql.ErrNoRows:
+		// ユーザーが存在するかどうかを知られないように、パスワード間違いと同じエラーを返します
+		resp := httputil.NewErrorResponse(model.ErrInvalidPassword)
+		c.JSON(http.StatusUnauthorized, resp)
+		return
+	case err != nil:
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	if err := user.Authenticate(req.Password); err != nil {
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusUnauthorized, resp)
+		return
+	}
+
+	if err := auth.Login(c, u.DB, user); err != nil {
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result": user,
+		"error":  nil,
+	})
+}
+
+// Logout はログイン中のセッションを削除します
+func (u *User) Logout(c *gin.Context) {
+	if err := auth.Logout(c, u.DB); err != nil {
+		resp := httputil.NewErrorResponse(err)
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result": nil,
+		"error":  nil,
+	})
+}
+
+// Me はログイン中のユーザーをJSONで返します
+func (u *User) Me(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"result": auth.CurrentUser(c),
+		"error":  nil,
+	})
+}
+
+// validateCredentials はユーザー登録時の名前とパスワードを検証します
+func validateCredentials(req *credentials) error {
+	if req.Name == "" || utf8.RuneCountInString(req.Name) > maxUserNameLength {
+		return errors.New("name must be 1 to 32 characters")
+	}
+	if model.ReservedUserName(req.Name) {
+		return errors.New("name is reserved")
+	}
+	if utf8.RuneCountInString(req.Password) < minPasswordLength {
+		return errors.New("password must be at least 8 characters")
+	}
+	return nil
+}
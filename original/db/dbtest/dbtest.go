@@ -0,0 +1,90 @@
+// Package dbtest はmigrationsを適用したDBをテストで使うためのパッケージです
+package dbtest
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	// migrateUp と migrateDown はsql-migrateのmigrationファイルでUpとDownの始まりを示す行です
+	migrateUp   = "-- +migrate Up"
+	migrateDown = "-- +migrate Down"
+)
+
+// migrationsDir はmigrationファイルを置いているディレクトリです
+//
+// テストはパッケージのディレクトリで実行されるので、このファイルの場所から探します
+var migrationsDir = func() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(file), "..", "..", "migrations")
+}()
+
+// Open はmigrationsを全て適用した新しいDBを開きます。DBはテストが終わると閉じます
+//
+// 複数の接続から同時に使えるように、メモリ上ではなくテストごとの一時ディレクトリのファイルに作ります
+func Open(t testing.TB) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db")+"?loc=auto")
+	if err != nil {
+		t.Fatalf("failed to open db: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	files, err := filepath.Glob(filepath.Join(migrationsDir, "*.sql"))
+	if err != nil {
+		t.Fatalf("failed to find migrations: %s", err)
+	}
+	// sql-migrateと同じように、ファイル名の先頭の番号の順に適用します
+	sort.Slice(files, func(i, j int) bool {
+		return version(files[i]) < version(files[j])
+	})
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("failed to read migration: %s", err)
+		}
+		if _, err := db.Exec(up(string(b))); err != nil {
+			t.Fatalf("%s: failed to migrate: %s", filepath.Base(file), err)
+		}
+	}
+	return db
+}
+
+// InsertMessages は本文がbodiesのメッセージを順に追加します
+func InsertMessages(t testing.TB, db *sql.DB, bodies ...string) {
+	t.Helper()
+
+	for _, body := range bodies {
+		if _, err := db.Exec(`insert into message (body) values (?)`, body); err != nil {
+			t.Fatalf("failed to insert message: %s", err)
+		}
+	}
+}
+
+// version はmigrationファイルの名前の先頭の番号を返します
+func version(file string) int {
+	name := filepath.Base(file)
+	n, _ := strconv.Atoi(name[:strings.IndexByte(name, '_')])
+	return n
+}
+
+// up はmigrationファイルの内容からUpの部分を返します
+func up(content string) string {
+	if i := strings.Index(content, migrateUp); i >= 0 {
+		content = content[i+len(migrateUp):]
+	}
+	if i := strings.Index(content, migrateDown); i >= 0 {
+		content = content[:i]
+	}
+	return content
+}
@@ -15,9 +15,12 @@ func newAPIError(err error) *APIError {
 }
 
 // APIResponse は...このへんファイル分けるのがgoらしい
+//
+// NextCursorはページングされた結果で続きがある場合だけ返します
 type APIResponse struct {
-	Result *APIResult `json:"result"`
-	Error  *APIError  `json:"error"`
+	Error      *APIError   `json:"error"`
+	Result     interface{} `json:"result"`
+	NextCursor *int64      `json:"next_cursor,omitempty"`
 }
 
 // NewErrorResponse はエラーメッセージを含んだAPIResponse構造体のポインタを返します
@@ -26,3 +29,16 @@ func NewErrorResponse(err error) *APIResponse {
 		Error: newAPIError(err),
 	}
 }
+
+// NewPageResponse はページングされた結果を含んだAPIResponse構造体のポインタを返します
+//
+// nextが0の場合は続きがないものとしてnext_cursorを返しません
+func NewPageResponse(result interface{}, next int64) *APIResponse {
+	resp := &APIResponse{
+		Result: result,
+	}
+	if next != 0 {
+		resp.NextCursor = &next
+	}
+	return resp
+}
@@ -0,0 +1,14 @@
+-- +migrate Up
+-- botが再起動しても残しておきたい値です。namespaceはbotの名前で、botは自分のnamespaceの値だけを読み書きできます
+-- expiresは期限のUnix時間(ミリ秒)で、NULLの場合は期限がありません
+CREATE TABLE bot_kv (
+    namespace TEXT NOT NULL,
+    key TEXT NOT NULL,
+    value TEXT NOT NULL,
+    expires INTEGER,
+    updated TIMESTAMP NOT NULL DEFAULT (DATETIME('now', 'localtime')),
+    PRIMARY KEY (namespace, key)
+);
+
+-- +migrate Down
+DROP TABLE bot_kv;
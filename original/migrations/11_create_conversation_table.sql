@@ -0,0 +1,17 @@
+-- +migrate Up
+-- botとユーザーのチャンネルでの一続きのやりとりです。1人のユーザーは1つのチャンネルで1つのbotとだけやりとりします
+-- stateはbotが次の返信を作るために保存する値で、expiresは期限のUnix時間(ミリ秒)です
+-- ttlはやりとりの続きのメッセージが届いた時に期限をのばす長さ(ミリ秒)です
+CREATE TABLE conversation (
+    user_id INTEGER NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+    channel_id INTEGER NOT NULL REFERENCES channel(id) ON DELETE CASCADE,
+    bot_name TEXT NOT NULL,
+    state TEXT NOT NULL,
+    expires INTEGER NOT NULL,
+    ttl INTEGER NOT NULL,
+    updated TIMESTAMP NOT NULL DEFAULT (DATETIME('now', 'localtime')),
+    PRIMARY KEY (user_id, channel_id)
+);
+
+-- +migrate Down
+DROP TABLE conversation;
@@ -0,0 +1,7 @@
+-- +migrate Up
+-- scriptsに同梱のJavaScriptのbotをgeneralチャンネルで有効にします
+INSERT INTO channel_bot (channel_id, bot_name) VALUES (1, 'dicebot');
+INSERT INTO channel_bot (channel_id, bot_name) VALUES (1, 'remindbot');
+
+-- +migrate Down
+DELETE FROM channel_bot WHERE channel_id = 1 AND bot_name IN ('dicebot', 'remindbot');
@@ -0,0 +1,25 @@
+-- +migrate Up
+-- systemはbotなどサーバー内部から投稿するためのユーザーです。パスワードを持たず、ログインできません
+CREATE TABLE user (
+    id INTEGER NOT NULL PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    password_hash TEXT NOT NULL DEFAULT "",
+    admin INTEGER NOT NULL DEFAULT 0,
+    system INTEGER NOT NULL DEFAULT 0,
+    created TIMESTAMP NOT NULL DEFAULT (DATETIME('now', 'localtime')),
+    updated TIMESTAMP NOT NULL DEFAULT (DATETIME('now', 'localtime'))
+);
+
+CREATE TABLE session (
+    token_hash TEXT NOT NULL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+    expires INTEGER NOT NULL,
+    created TIMESTAMP NOT NULL DEFAULT (DATETIME('now', 'localtime'))
+);
+
+ALTER TABLE message ADD COLUMN user_id INTEGER REFERENCES user(id);
+
+-- +migrate Down
+ALTER TABLE message DROP COLUMN user_id;
+DROP TABLE session;
+DROP TABLE user;
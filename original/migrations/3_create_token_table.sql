@@ -0,0 +1,12 @@
+-- +migrate Up
+CREATE TABLE token (
+    id INTEGER NOT NULL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+    name TEXT NOT NULL DEFAULT "",
+    token_hash TEXT NOT NULL UNIQUE,
+    scope TEXT NOT NULL,
+    created TIMESTAMP NOT NULL DEFAULT (DATETIME('now', 'localtime'))
+);
+
+-- +migrate Down
+DROP TABLE token;
@@ -0,0 +1,25 @@
+-- +migrate Up
+CREATE TABLE channel (
+    id INTEGER NOT NULL PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    created TIMESTAMP NOT NULL DEFAULT (DATETIME('now', 'localtime')),
+    updated TIMESTAMP NOT NULL DEFAULT (DATETIME('now', 'localtime'))
+);
+
+-- channel_botに登録されたbotだけがそのチャンネルのメッセージに反応します
+CREATE TABLE channel_bot (
+    channel_id INTEGER NOT NULL REFERENCES channel(id) ON DELETE CASCADE,
+    bot_name TEXT NOT NULL,
+    PRIMARY KEY (channel_id, bot_name)
+);
+
+-- 既存のメッセージは全てgeneralチャンネルに入れ、これまで通り全てのbotを有効にします
+INSERT INTO channel (id, name) VALUES (1, 'general');
+INSERT INTO channel_bot (channel_id, bot_name) VALUES (1, 'helloworldbot'), (1, 'omikujibot'), (1, 'keywordbot');
+
+ALTER TABLE message ADD COLUMN channel_id INTEGER NOT NULL DEFAULT 1 REFERENCES channel(id);
+
+-- +migrate Down
+ALTER TABLE message DROP COLUMN channel_id;
+DROP TABLE channel_bot;
+DROP TABLE channel;
@@ -0,0 +1,7 @@
+-- +migrate Up
+ALTER TABLE message ADD COLUMN parent_id INTEGER REFERENCES message(id);
+CREATE INDEX message_parent_id ON message(parent_id);
+
+-- +migrate Down
+DROP INDEX message_parent_id;
+ALTER TABLE message DROP COLUMN parent_id;
@@ -0,0 +1,35 @@
+-- +migrate Up
+-- 日本語は単語の区切りが空白ではないので、trigramで3文字ずつに区切って索引を作ります
+CREATE VIRTUAL TABLE message_fts USING fts5(
+    body,
+    content='message',
+    content_rowid='id',
+    tokenize='trigram'
+);
+
+INSERT INTO message_fts (rowid, body) SELECT id, body FROM message;
+
+-- +migrate StatementBegin
+CREATE TRIGGER message_fts_insert AFTER INSERT ON message BEGIN
+    INSERT INTO message_fts (rowid, body) VALUES (new.id, new.body);
+END;
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE TRIGGER message_fts_delete AFTER DELETE ON message BEGIN
+    INSERT INTO message_fts (message_fts, rowid, body) VALUES ('delete', old.id, old.body);
+END;
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE TRIGGER message_fts_update AFTER UPDATE OF body ON message BEGIN
+    INSERT INTO message_fts (message_fts, rowid, body) VALUES ('delete', old.id, old.body);
+    INSERT INTO message_fts (rowid, body) VALUES (new.id, new.body);
+END;
+-- +migrate StatementEnd
+
+-- +migrate Down
+DROP TRIGGER message_fts_update;
+DROP TRIGGER message_fts_delete;
+DROP TRIGGER message_fts_insert;
+DROP TABLE message_fts;
@@ -0,0 +1,15 @@
+-- +migrate Up
+-- 同じユーザーは1つのメッセージに同じ絵文字で1回だけリアクションできます
+CREATE TABLE reaction (
+    message_id INTEGER NOT NULL REFERENCES message(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+    emoji TEXT NOT NULL,
+    created TIMESTAMP NOT NULL DEFAULT (DATETIME('now', 'localtime')),
+    PRIMARY KEY (message_id, user_id, emoji)
+);
+
+INSERT INTO channel_bot (channel_id, bot_name) VALUES (1, 'reactionbot');
+
+-- +migrate Down
+DELETE FROM channel_bot WHERE bot_name = 'reactionbot';
+DROP TABLE reaction;
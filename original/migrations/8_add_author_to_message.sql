@@ -0,0 +1,10 @@
+-- +migrate Up
+ALTER TABLE message ADD COLUMN author_kind TEXT NOT NULL DEFAULT 'user';
+ALTER TABLE message ADD COLUMN bot_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE message ADD COLUMN chain_depth INTEGER NOT NULL DEFAULT 0;
+UPDATE message SET author_kind = 'bot', chain_depth = 1 WHERE user_id IN (SELECT id FROM user WHERE name = 'bot');
+
+-- +migrate Down
+ALTER TABLE message DROP COLUMN chain_depth;
+ALTER TABLE message DROP COLUMN bot_name;
+ALTER TABLE message DROP COLUMN author_kind;
@@ -0,0 +1,6 @@
+-- +migrate Up
+-- 組み込みのコマンドのbotをgeneralチャンネルで有効にします
+INSERT INTO channel_bot (channel_id, bot_name) VALUES (1, 'commandbot');
+
+-- +migrate Down
+DELETE FROM channel_bot WHERE channel_id = 1 AND bot_name = 'commandbot';
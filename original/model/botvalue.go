@@ -0,0 +1,142 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// ErrNotInteger は整数でない値を増減しようとした場合のエラーです
+var ErrNotInteger = errors.New("value is not an integer")
+
+// BotValue はbotがbot_kvテーブルに保存する値の構造体です
+//
+// Expiresがゼロ値の場合は期限がありません。期限を過ぎた値はないものとして扱います
+type BotValue struct {
+	Namespace string
+	Key       string
+	Value     string
+	Expires   time.Time
+}
+
+// BotValueByKey はnamespaceのkeyの値を返します
+//
+// 値が存在しないか、nowの時点で期限を過ぎている場合はsql.ErrNoRowsを返します
+func BotValueByKey(db *sql.DB, namespace, key string, now time.Time) (*BotValue, error) {
+	return scanBotValue(db.QueryRow(`select namespace, key, value, expires from bot_kv where namespace = ? and key = ? and (expires is null or expires > ?)`,
+		namespace, key, unixMilli(now)))
+}
+
+// Save はbot_kvテーブルに値を保存します。同じkeyの値がある場合は置き換えます
+func (v *BotValue) Save(db *sql.DB) error {
+	_, err := db.Exec(`insert or replace into bot_kv (namespace, key, value, expires, updated) values (?, ?, ?, ?, ?)`,
+		v.Namespace, v.Key, v.Value, v.expires(), formatTimestamp(time.Now()))
+	return err
+}
+
+// IncrBotValue はnamespaceのkeyの整数の値にdeltaを足して、足した後の値を返します
+//
+// 値が存在しないか、nowの時点で期限を過ぎている場合は0に足し、期限のない値にします。
+// 値が整数でない場合はErrNotIntegerを返します
+func IncrBotValue(db *sql.DB, namespace, key string, delta int64, now time.Time) (int64, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	// 読んでから書くまでの間に他の接続が書き込まないように、最初に書き込みのロックを取ります。
+	// db.Beginのトランザクションでは、同時に読んだ接続同士がロックを上げられずにdatabase is lockedになります
+	if _, err := conn.ExecContext(ctx, `begin immediate`); err != nil {
+		return 0, err
+	}
+	n, err := incrBotValue(ctx, conn, namespace, key, delta, now)
+	if err == nil {
+		_, err = conn.ExecContext(ctx, `commit`)
+	}
+	if err != nil {
+		conn.ExecContext(ctx, `rollback`)
+		return 0, err
+	}
+	return n, nil
+}
+
+// incrBotValue はIncrBotValueのトランザクションの中で値を読んで足した値を書き込みます
+func incrBotValue(ctx context.Context, conn *sql.Conn, namespace, key string, delta int64, now time.Time) (int64, error) {
+	v, err := scanBotValue(conn.QueryRowContext(ctx, `select namespace, key, value, expires from bot_kv where namespace = ? and key = ? and (expires is null or expires > ?)`,
+		namespace, key, unixMilli(now)))
+	switch {
+	case err == sql.ErrNoRows:
+		v = &BotValue{Namespace: namespace, Key: key, Value: "0"}
+	case err != nil:
+		return 0, err
+	}
+
+	n, err := strconv.ParseInt(v.Value, 10, 64)
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+	n += delta
+	v.Value = strconv.FormatInt(n, 10)
+
+	if _, err := conn.ExecContext(ctx, `insert or replace into bot_kv (namespace, key, value, expires, updated) values (?, ?, ?, ?, ?)`,
+		v.Namespace, v.Key, v.Value, v.expires(), formatTimestamp(time.Now())); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// ExpireBotValue はnamespaceのkeyの値の期限をexpiresにします。expiresがゼロ値の場合は期限をなくします
+//
+// 値が存在しないか、nowの時点で期限を過ぎている場合は何もせず、falseを返します
+func ExpireBotValue(db *sql.DB, namespace, key string, expires, now time.Time) (bool, error) {
+	v := &BotValue{Expires: expires}
+	res, err := db.Exec(`update bot_kv set expires = ?, updated = ? where namespace = ? and key = ? and (expires is null or expires > ?)`,
+		v.expires(), formatTimestamp(time.Now()), namespace, key, unixMilli(now))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteBotValue はnamespaceのkeyの値を削除します
+func DeleteBotValue(db *sql.DB, namespace, key string) error {
+	_, err := db.Exec(`delete from bot_kv where namespace = ? and key = ?`, namespace, key)
+	return err
+}
+
+// DeleteExpiredBotValues はnowの時点で期限を過ぎた値を全て削除します
+func DeleteExpiredBotValues(db *sql.DB, now time.Time) error {
+	_, err := db.Exec(`delete from bot_kv where expires <= ?`, unixMilli(now))
+	return err
+}
+
+// expires はExpiresをbot_kvテーブルのexpiresカラムに保存する値にします
+func (v *BotValue) expires() interface{} {
+	if v.Expires.IsZero() {
+		return nil
+	}
+	return unixMilli(v.Expires)
+}
+
+// scanBotValue はbot_kvテーブルの1行を値にします
+func scanBotValue(sc scanner) (*BotValue, error) {
+	v := &BotValue{}
+	var expires sql.NullInt64
+	if err := sc.Scan(&v.Namespace, &v.Key, &v.Value, &expires); err != nil {
+		return nil, err
+	}
+	if expires.Valid {
+		v.Expires = time.Unix(0, expires.Int64*int64(time.Millisecond))
+	}
+	return v, nil
+}
+
+// unixMilli はtをUnix時間のミリ秒にします
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
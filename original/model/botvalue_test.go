@@ -0,0 +1,59 @@
+package model
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/db/dbtest"
+)
+
+func TestIncrBotValueが同時に呼ばれても全ての増分を足す(t *testing.T) {
+	db := dbtest.Open(t)
+	now := time.Date(2018, 6, 10, 9, 0, 0, 0, time.UTC)
+
+	const workers, times = 8, 20
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*times)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < times; j++ {
+				if _, err := IncrBotValue(db, "counter", "n", 1, now); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("failed to incr: %s", err)
+	}
+
+	v, err := BotValueByKey(db, "counter", "n", now)
+	if err != nil {
+		t.Fatalf("failed to get value: %s", err)
+	}
+	if expected := fmt.Sprint(workers * times); v.Value != expected {
+		t.Fatalf("value expected %s, but %s", expected, v.Value)
+	}
+}
+
+func TestIncrBotValueが整数でない値を増やさない(t *testing.T) {
+	db := dbtest.Open(t)
+	now := time.Date(2018, 6, 10, 9, 0, 0, 0, time.UTC)
+
+	if err := (&BotValue{Namespace: "counter", Key: "s", Value: "abc"}).Save(db); err != nil {
+		t.Fatalf("failed to save: %s", err)
+	}
+	if _, err := IncrBotValue(db, "counter", "s", 1, now); err != ErrNotInteger {
+		t.Fatalf("ErrNotInteger expected, but %v", err)
+	}
+	// 失敗した後も接続は使えます
+	if n, err := IncrBotValue(db, "counter", "n", 2, now); err != nil || n != 2 {
+		t.Fatalf("2 expected, but %d (%v)", n, err)
+	}
+}
@@ -0,0 +1,125 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// DefaultChannelID はチャンネルを指定せずに投稿されたメッセージが入るgeneralチャンネルのIDです
+const DefaultChannelID int64 = 1
+
+// ErrChannelExists は同じ名前のチャンネルが既に存在する場合のエラーです
+var ErrChannelExists = errors.New("channel already exists")
+
+// Channel はメッセージをまとめるチャンネルの構造体です
+//
+// Botsはこのチャンネルで有効になっているbotの名前です
+type Channel struct {
+	ID   int64    `json:"id"`
+	Name string   `json:"name"`
+	Bots []string `json:"bots"`
+}
+
+// ChannelsAll は全てのチャンネルを返します
+func ChannelsAll(db *sql.DB) ([]*Channel, error) {
+	rows, err := db.Query(`select id, name from channel order by id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cs := []*Channel{}
+	for rows.Next() {
+		c := &Channel{}
+		if err := rows.Scan(&c.ID, &c.Name); err != nil {
+			return nil, err
+		}
+		cs = append(cs, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, c := range cs {
+		if c.Bots, err = channelBots(db, c.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return cs, nil
+}
+
+// ChannelByID は指定されたIDのチャンネルを1つ返します
+func ChannelByID(db *sql.DB, id int64) (*Channel, error) {
+	c := &Channel{}
+	if err := db.QueryRow(`select id, name from channel where id = ?`, id).Scan(&c.ID, &c.Name); err != nil {
+		return nil, err
+	}
+
+	bots, err := channelBots(db, c.ID)
+	if err != nil {
+		return nil, err
+	}
+	c.Bots = bots
+
+	return c, nil
+}
+
+// Insert はchannelテーブルに新規データを1件追加します
+func (c *Channel) Insert(db *sql.DB) (*Channel, error) {
+	var exists bool
+	if err := db.QueryRow(`select exists(select 1 from channel where name = ?)`, c.Name).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, ErrChannelExists
+	}
+
+	now := formatTimestamp(time.Now())
+	res, err := db.Exec(`insert into channel (name, created, updated) values (?, ?, ?)`, c.Name, now, now)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Channel{
+		ID:   id,
+		Name: c.Name,
+		Bots: []string{},
+	}, nil
+}
+
+// EnableBot はチャンネルでnameのbotを有効にします
+func (c *Channel) EnableBot(db *sql.DB, name string) error {
+	_, err := db.Exec(`insert or ignore into channel_bot (channel_id, bot_name) values (?, ?)`, c.ID, name)
+	return err
+}
+
+// DisableBot はチャンネルでnameのbotを無効にします
+func (c *Channel) DisableBot(db *sql.DB, name string) error {
+	_, err := db.Exec(`delete from channel_bot where channel_id = ? and bot_name = ?`, c.ID, name)
+	return err
+}
+
+// channelBots はchannelIDのチャンネルで有効になっているbotの名前を返します
+func channelBots(db *sql.DB, channelID int64) ([]string, error) {
+	rows, err := db.Query(`select bot_name from channel_bot where channel_id = ? order by bot_name`, channelID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
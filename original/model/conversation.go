@@ -0,0 +1,84 @@
+package model
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Conversation はbotとユーザーのチャンネルでの一続きのやりとりの構造体です
+//
+// 1人のユーザーは1つのチャンネルで1つのbotとだけやりとりします。期限を過ぎたやりとりはないものとして扱います
+//
+//   fields
+//     UserID    int64
+//     ChannelID int64
+//     BotName   string
+//     State     string        botが次の返信を作るために保存する値
+//     Expires   time.Time
+//     TTL       time.Duration Extendで期限をのばす長さ
+type Conversation struct {
+	UserID    int64
+	ChannelID int64
+	BotName   string
+	State     string
+	Expires   time.Time
+	TTL       time.Duration
+}
+
+// ConversationByUser はuserIDのユーザーのchannelIDのチャンネルでのやりとりを返します
+//
+// やりとりが存在しないか、nowの時点で期限を過ぎている場合はsql.ErrNoRowsを返します
+func ConversationByUser(db *sql.DB, userID, channelID int64, now time.Time) (*Conversation, error) {
+	c := &Conversation{}
+	var expires, ttl int64
+	err := db.QueryRow(`select user_id, channel_id, bot_name, state, expires, ttl from conversation where user_id = ? and channel_id = ? and expires > ?`,
+		userID, channelID, unixMilli(now)).Scan(&c.UserID, &c.ChannelID, &c.BotName, &c.State, &expires, &ttl)
+	if err != nil {
+		return nil, err
+	}
+	c.Expires = time.Unix(0, expires*int64(time.Millisecond))
+	c.TTL = time.Duration(ttl) * time.Millisecond
+	return c, nil
+}
+
+// Save はconversationテーブルにやりとりを保存します。同じユーザーとチャンネルのやりとりがある場合は置き換えます
+func (c *Conversation) Save(db *sql.DB) error {
+	_, err := db.Exec(`insert or replace into conversation (user_id, channel_id, bot_name, state, expires, ttl, updated) values (?, ?, ?, ?, ?, ?, ?)`,
+		c.UserID, c.ChannelID, c.BotName, c.State, unixMilli(c.Expires), int64(c.TTL/time.Millisecond), formatTimestamp(time.Now()))
+	return err
+}
+
+// Extend はやりとりの期限をnowからTTLが経つまでにのばします。TTLが0の場合は何もしません
+//
+// nowの時点で期限を過ぎていたり、他のbotのやりとりに置き換わっていた場合も何もしません
+func (c *Conversation) Extend(db *sql.DB, now time.Time) error {
+	if c.TTL <= 0 {
+		return nil
+	}
+	expires := now.Add(c.TTL)
+	res, err := db.Exec(`update conversation set expires = ?, updated = ? where user_id = ? and channel_id = ? and bot_name = ? and expires > ?`,
+		unixMilli(expires), formatTimestamp(time.Now()), c.UserID, c.ChannelID, c.BotName, unixMilli(now))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	c.Expires = expires
+	return nil
+}
+
+// Delete はconversationテーブルからやりとりを削除します
+//
+// 他のbotが同じユーザーとチャンネルで新しいやりとりを始めていた場合は、それを削除しません
+func (c *Conversation) Delete(db *sql.DB) error {
+	_, err := db.Exec(`delete from conversation where user_id = ? and channel_id = ? and bot_name = ?`,
+		c.UserID, c.ChannelID, c.BotName)
+	return err
+}
+
+// DeleteExpiredConversations はnowの時点で期限を過ぎたやりとりを全て削除します
+func DeleteExpiredConversations(db *sql.DB, now time.Time) error {
+	_, err := db.Exec(`delete from conversation where expires <= ?`, unixMilli(now))
+	return err
+}
@@ -0,0 +1,45 @@
+package model
+
+// EventType はメッセージに対して行われた操作の種類です
+type EventType string
+
+const (
+	// EventCreated はメッセージが作成されたことを表します
+	EventCreated EventType = "created"
+	// EventUpdated はメッセージが編集されたことを表します
+	EventUpdated EventType = "updated"
+	// EventDeleted はメッセージが削除されたことを表します
+	EventDeleted EventType = "deleted"
+	// EventReactionAdded はメッセージにリアクションが付けられたことを表します
+	EventReactionAdded EventType = "reaction_added"
+	// EventReactionRemoved はメッセージのリアクションが取り消されたことを表します
+	EventReactionRemoved EventType = "reaction_removed"
+)
+
+// Event はメッセージに対して行われた操作を通知するための構造体です
+//
+// EventDeletedの場合、Messageには削除される直前のメッセージが入ります。
+// EventReactionAdded, EventReactionRemovedの場合、Reactionには付けられた・取り消されたリアクションが、
+// Messageにはその後のリアクションの数を含んだメッセージが入ります
+type Event struct {
+	Type     EventType `json:"type"`
+	Message  *Message  `json:"message"`
+	Reaction *Reaction `json:"reaction,omitempty"`
+}
+
+// NewEvent は新しいEvent構造体のポインタを返します
+func NewEvent(t EventType, m *Message) *Event {
+	return &Event{
+		Type:    t,
+		Message: m,
+	}
+}
+
+// NewReactionEvent はリアクションの操作を通知する新しいEvent構造体のポインタを返します
+func NewReactionEvent(t EventType, m *Message, r *Reaction) *Event {
+	return &Event{
+		Type:     t,
+		Message:  m,
+		Reaction: r,
+	}
+}
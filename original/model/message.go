@@ -2,6 +2,27 @@ package model
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// timestampFormat はcreated, updatedカラムに書き込む日時の書式です
+//
+// 同じ秒に2回編集されても区別できるようにミリ秒まで保存します
+const timestampFormat = "2006-01-02 15:04:05.000"
+
+// ErrConflict は更新・削除しようとしたメッセージが他のリクエストによって既に変更されていた場合のエラーです
+var ErrConflict = errors.New("message has been modified by another request")
+
+// 投稿者の種類です
+const (
+	// AuthorUser はユーザーが投稿したメッセージです
+	AuthorUser = "user"
+	// AuthorBot はbotが投稿したメッセージです
+	AuthorBot = "bot"
 )
 
 // Message はメッセージの構造体です
@@ -9,23 +30,161 @@ type Message struct {
 	ID   int64  `json:"id"`
 	Body string `json:"body"`
 	// Tutorial 1-1. ユーザー名を表示しよう
+	Username string `json:"username"`
+	// UserID は投稿したユーザーのIDです。ユーザー登録が導入される前のメッセージは0です
+	UserID int64 `json:"user_id"`
+	// ChannelID はメッセージが投稿されたチャンネルのIDです
+	ChannelID int64 `json:"channel_id"`
+	// ParentID は返信先のスレッドの先頭メッセージのIDです。返信でなければ0です
+	ParentID int64 `json:"parent_id"`
+	// ReplyCount はこのメッセージへの返信の数です
+	ReplyCount int `json:"reply_count"`
+	// Reactions は絵文字ごとのリアクションの数です
+	Reactions map[string]int `json:"reactions"`
+	// AuthorKind は投稿者の種類で、AuthorUserかAuthorBotです
+	AuthorKind string `json:"author_kind"`
+	// BotName は投稿したbotの名前です。botの投稿でなければ空です
+	BotName string `json:"bot_name"`
+	// ChainDepth はbotの返信が連鎖した深さです。ユーザーの投稿は0で、botの返信は返信先の深さに1を足したものです
+	ChainDepth int `json:"chain_depth"`
+
+	// Updated は最終更新日時です。楽観的排他制御に使うためETagとして返します
+	Updated time.Time `json:"-"`
 }
 
-// MessagesAll は全てのメッセージを返します
-func MessagesAll(db *sql.DB) ([]*Message, error) {
+// messageColumns はscanMessageで読み出すためのmessageテーブルのカラムです
+const messageColumns = `message.id, message.body, message.username, message.user_id, message.channel_id, message.parent_id,
+	message.author_kind, message.bot_name, message.chain_depth,
+	(select count(*) from message reply where reply.parent_id = message.id),
+	(select json_group_object(emoji, n) from (select emoji, count(*) as n from reaction where reaction.message_id = message.id group by emoji)),
+	message.updated`
+
+// scanner はsql.Rowとsql.Rowsに共通するメソッドのインターフェースです
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
 
+// scanMessage はmessageColumnsで読み出した1行をメッセージにします
+//
+// extraにはmessageColumnsの後に読み出したカラムの読み出し先を指定します
+func scanMessage(sc scanner, extra ...interface{}) (*Message, error) {
+	m := &Message{}
+	var userID, parentID sql.NullInt64
+	var reactions string
 	// Tutorial 1-1. ユーザー名を表示しよう
-	rows, err := db.Query(`select id, body from message`)
-	if err != nil {
+	dest := append([]interface{}{&m.ID, &m.Body, &m.Username, &userID, &m.ChannelID, &parentID, &m.AuthorKind, &m.BotName, &m.ChainDepth, &m.ReplyCount, &reactions, &m.Updated}, extra...)
+	if err := sc.Scan(dest...); err != nil {
+		return nil, err
+	}
+	m.UserID = userID.Int64
+	m.ParentID = parentID.Int64
+	if err := json.Unmarshal([]byte(reactions), &m.Reactions); err != nil {
 		return nil, err
 	}
+	return m, nil
+}
+
+// ETag はメッセージの現在のバージョンを表すETagを返します
+func (m *Message) ETag() string {
+	return fmt.Sprintf(`"%d-%d"`, m.ID, m.Updated.UnixNano())
+}
+
+// MessageQuery はメッセージ一覧の取得条件です
+//
+//   fields
+//     Limit     int       最大件数
+//     Before    int64     0でなければ、このIDより前のメッセージを返します
+//     After     int64     0でなければ、このIDより後のメッセージを返します
+//     Since     time.Time ゼロ値でなければ、この日時以降に作成されたメッセージを返します
+//     Username  string    空でなければ、このユーザーのメッセージだけを返します
+//     ChannelID int64     0でなければ、このチャンネルのメッセージだけを返します
+type MessageQuery struct {
+	Limit     int
+	Before    int64
+	After     int64
+	Since     time.Time
+	Username  string
+	ChannelID int64
+}
+
+// MessagesByQuery はqの条件を満たすメッセージをID順に最大q.Limit件返します
+//
+// 続きがある場合、次のページを取得するためのカーソルを2番目の戻り値で返します。続きがなければ0を返します
+//
+// Afterだけが指定された場合はAfterより後を古い順に、それ以外の場合は新しいものからq.Limit件を取得します。
+// カーソルは前者の場合はAfter、後者の場合はBeforeに指定する値です
+func MessagesByQuery(db *sql.DB, q *MessageQuery) ([]*Message, int64, error) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+	if q.Before != 0 {
+		conds = append(conds, `id < ?`)
+		args = append(args, q.Before)
+	}
+	if q.After != 0 {
+		conds = append(conds, `id > ?`)
+		args = append(args, q.After)
+	}
+	if !q.Since.IsZero() {
+		conds = append(conds, `strftime('%Y-%m-%d %H:%M:%f', created) >= ?`)
+		args = append(args, formatTimestamp(q.Since.In(time.Local)))
+	}
+	if q.Username != "" {
+		conds = append(conds, `username = ?`)
+		args = append(args, q.Username)
+	}
+	if q.ChannelID != 0 {
+		conds = append(conds, `channel_id = ?`)
+		args = append(args, q.ChannelID)
+	}
+
+	forward := q.After != 0 && q.Before == 0
+
+	query := `select ` + messageColumns + ` from message`
+	if len(conds) > 0 {
+		query += ` where ` + strings.Join(conds, ` and `)
+	}
+	if forward {
+		query += ` order by id asc`
+	} else {
+		query += ` order by id desc`
+	}
+	// 続きがあるか判定するために1件多く取得します
+	query += ` limit ?`
+	args = append(args, q.Limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
 	defer rows.Close()
 
-	var ms []*Message
+	ms, err := scanMessages(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var next int64
+	if len(ms) > q.Limit {
+		ms = ms[:q.Limit]
+		next = ms[len(ms)-1].ID
+	}
+	if !forward {
+		for i, j := 0, len(ms)-1; i < j; i, j = i+1, j-1 {
+			ms[i], ms[j] = ms[j], ms[i]
+		}
+	}
+
+	return ms, next, nil
+}
+
+// scanMessages はrowsから全てのメッセージを読み出します
+func scanMessages(rows *sql.Rows) ([]*Message, error) {
+	ms := []*Message{}
 	for rows.Next() {
-		m := &Message{}
-		// Tutorial 1-1. ユーザー名を表示しよう
-		if err := rows.Scan(&m.ID, &m.Body); err != nil {
+		m, err := scanMessage(rows)
+		if err != nil {
 			return nil, err
 		}
 		ms = append(ms, m)
@@ -39,20 +198,60 @@ func MessagesAll(db *sql.DB) ([]*Message, error) {
 
 // MessageByID は指定されたIDのメッセージを1つ返します
 func MessageByID(db *sql.DB, id string) (*Message, error) {
-	m := &Message{}
-
 	// Tutorial 1-1. ユーザー名を表示しよう
-	if err := db.QueryRow(`select id, body from message where id = ?`, id).Scan(&m.ID, &m.Body); err != nil {
+	return scanMessage(db.QueryRow(`select `+messageColumns+` from message where id = ?`, id))
+}
+
+// MessageThread はidのメッセージのスレッドの先頭メッセージと、その全ての返信を古い順に返します
+//
+// idが返信の場合は、その返信先のスレッドを返します
+func MessageThread(db *sql.DB, id string) ([]*Message, error) {
+	m, err := MessageByID(db, id)
+	if err != nil {
 		return nil, err
 	}
+	if m.ParentID != 0 {
+		if m, err = MessageByID(db, fmt.Sprint(m.ParentID)); err != nil {
+			return nil, err
+		}
+	}
 
-	return m, nil
+	replies, err := MessageReplies(db, m.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]*Message{m}, replies...), nil
+}
+
+// MessageReplies はidのメッセージへの全ての返信を古い順に返します
+func MessageReplies(db *sql.DB, id int64) ([]*Message, error) {
+	rows, err := db.Query(`select `+messageColumns+` from message where parent_id = ? order by id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanMessages(rows)
 }
 
 // Insert はmessageテーブルに新規データを1件追加します
 func (m *Message) Insert(db *sql.DB) (*Message, error) {
+	now := time.Now()
+
+	userID := sql.NullInt64{Int64: m.UserID, Valid: m.UserID != 0}
+	parentID := sql.NullInt64{Int64: m.ParentID, Valid: m.ParentID != 0}
+	channelID := m.ChannelID
+	if channelID == 0 {
+		channelID = DefaultChannelID
+	}
+	authorKind := m.AuthorKind
+	if authorKind == "" {
+		authorKind = AuthorUser
+	}
 	// Tutorial 1-2. ユーザー名を追加しよう
-	res, err := db.Exec(`insert into message (body) values (?)`, m.Body)
+	res, err := db.Exec(`insert into message (body, username, user_id, channel_id, parent_id, author_kind, bot_name, chain_depth, created, updated) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		m.Body, m.Username, userID, channelID, parentID, authorKind, m.BotName, m.ChainDepth, formatTimestamp(now), formatTimestamp(now))
 	if err != nil {
 		return nil, err
 	}
@@ -65,11 +264,121 @@ func (m *Message) Insert(db *sql.DB) (*Message, error) {
 		ID:   id,
 		Body: m.Body,
 		// Tutorial 1-2. ユーザー名を追加しよう
+		Username:   m.Username,
+		UserID:     m.UserID,
+		ChannelID:  channelID,
+		ParentID:   m.ParentID,
+		Reactions:  map[string]int{},
+		AuthorKind: authorKind,
+		BotName:    m.BotName,
+		ChainDepth: m.ChainDepth,
+		Updated:    parseTimestamp(now),
+	}, nil
+}
+
+// Update はmessageテーブルのデータを1件更新します
+//
+// mのUpdatedがDBの値と一致しない場合、他のリクエストによって既に変更されているとみなしてErrConflictを返します
+func (m *Message) Update(db *sql.DB) (*Message, error) {
+	now := time.Now()
+
+	res, err := db.Exec(`update message set body = ?, updated = ? where id = ? and strftime('%Y-%m-%d %H:%M:%f', updated) = ?`,
+		m.Body, formatTimestamp(now), m.ID, m.Updated.UTC().Format(timestampFormat))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAffected(db, res, m.ID); err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		ID:         m.ID,
+		Body:       m.Body,
+		Username:   m.Username,
+		UserID:     m.UserID,
+		ChannelID:  m.ChannelID,
+		ParentID:   m.ParentID,
+		ReplyCount: m.ReplyCount,
+		Reactions:  m.Reactions,
+		AuthorKind: m.AuthorKind,
+		BotName:    m.BotName,
+		ChainDepth: m.ChainDepth,
+		Updated:    parseTimestamp(now),
 	}, nil
 }
 
-// Mission 1-1. メッセージを編集しよう
-// ...
+// Delete はmessageテーブルのデータを1件削除します
+//
+// mのUpdatedがDBの値と一致しない場合、他のリクエストによって既に変更されているとみなしてErrConflictを返します。
+// mがスレッドの先頭メッセージの場合は全ての返信も一緒に削除し、削除した返信を返します
+func (m *Message) Delete(db *sql.DB) ([]*Message, error) {
+	replies, err := MessageReplies(db, m.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	res, err := tx.Exec(`delete from message where id = ? and strftime('%Y-%m-%d %H:%M:%f', updated) = ?`,
+		m.ID, m.Updated.UTC().Format(timestampFormat))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		tx.Rollback()
+		if err != nil {
+			return nil, err
+		}
+		return nil, checkAffected(db, res, m.ID)
+	}
+	// foreign_keysを有効にしていないのでON DELETE CASCADEが効かず、リアクションは自分で削除します
+	if _, err := tx.Exec(`delete from reaction where message_id = ? or message_id in (select id from message where parent_id = ?)`, m.ID, m.ID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if _, err := tx.Exec(`delete from message where parent_id = ?`, m.ID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return replies, nil
+}
+
+// checkAffected はresで1行も変更されていない場合に、メッセージが存在しなければsql.ErrNoRowsを、存在すればErrConflictを返します
+func checkAffected(db *sql.DB, res sql.Result, id int64) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
 
-// Mission 1-2. メッセージを削除しよう
-// ...
+	var exists bool
+	if err := db.QueryRow(`select exists(select 1 from message where id = ?)`, id).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return sql.ErrNoRows
+	}
+	return ErrConflict
+}
+
+// formatTimestamp はtをDBに保存する書式の文字列にします
+func formatTimestamp(t time.Time) string {
+	return t.Format(timestampFormat)
+}
+
+// parseTimestamp はtをDBから読み出した場合と同じ値に変換します
+//
+// go-sqlite3はタイムゾーンのない日時をUTCとして読み出すため、それに合わせます
+func parseTimestamp(t time.Time) time.Time {
+	pt, _ := time.ParseInLocation(timestampFormat, formatTimestamp(t), time.UTC)
+	return pt
+}
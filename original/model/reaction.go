@@ -0,0 +1,39 @@
+package model
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Reaction はメッセージに付けられた絵文字のリアクションの構造体です
+type Reaction struct {
+	MessageID int64  `json:"message_id"`
+	UserID    int64  `json:"user_id"`
+	Emoji     string `json:"emoji"`
+}
+
+// Insert はreactionテーブルにリアクションを追加します
+//
+// 同じユーザーが同じ絵文字で既にリアクションしている場合は何もせず、falseを返します
+func (r *Reaction) Insert(db *sql.DB) (bool, error) {
+	res, err := db.Exec(`insert or ignore into reaction (message_id, user_id, emoji, created) values (?, ?, ?, ?)`,
+		r.MessageID, r.UserID, r.Emoji, formatTimestamp(time.Now()))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Delete はreactionテーブルからリアクションを削除します
+//
+// 該当するリアクションがない場合は何もせず、falseを返します
+func (r *Reaction) Delete(db *sql.DB) (bool, error) {
+	res, err := db.Exec(`delete from reaction where message_id = ? and user_id = ? and emoji = ?`,
+		r.MessageID, r.UserID, r.Emoji)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
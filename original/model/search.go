@@ -0,0 +1,240 @@
+package model
+
+import (
+	"database/sql"
+	"html"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// trigramLength はmessage_ftsのtrigramトークナイザーが索引を作る文字数です
+	//
+	// これより短い語は索引から探せないので、LIKEで探します
+	trigramLength = 3
+	// snippetTokens はsnippetに含めるトークンの数です
+	snippetTokens = 32
+
+	// HighlightStart はsnippetで検索語の前に付ける文字列です
+	HighlightStart = "<mark>"
+	// HighlightEnd はsnippetで検索語の後に付ける文字列です
+	HighlightEnd = "</mark>"
+	// snippetStart とsnippetEnd はFTS5のsnippetが検索語を囲む文字列です
+	//
+	// 本文をHTMLエスケープしてからHighlightStartとHighlightEndに置き換えるので、エスケープされない制御文字にします
+	snippetStart = "\x02"
+	snippetEnd   = "\x03"
+	// snippetEllipsis はsnippetで省略した部分に付ける文字列です
+	snippetEllipsis = "…"
+	// maxCountTerms はMessagesCountContainingEachが1つのクエリで数える語の数の上限です
+	maxCountTerms = 500
+)
+
+// MessageSearchQuery はMessagesBySearchでメッセージを全文検索する条件です
+//
+//   fields
+//     Query     string 空白で区切った語を全て含むメッセージを返します
+//     ChannelID int64  0でなければ、このチャンネルのメッセージだけを返します
+//     Limit     int    最大件数
+//     Offset    int    先頭から読み飛ばす件数
+type MessageSearchQuery struct {
+	Query     string
+	ChannelID int64
+	Limit     int
+	Offset    int
+}
+
+// MessageSearchResult は全文検索にヒットしたメッセージです
+//
+// Snippetは本文のうち検索語の周辺を、検索語をHighlightStartとHighlightEndで囲んで切り出したものです。
+// HTMLとして表示できるように、本文はエスケープしてあります
+type MessageSearchResult struct {
+	*Message
+	Snippet string `json:"snippet"`
+}
+
+// MessagesBySearch はqの条件で全文検索したメッセージを、関連度の高い順に返します
+//
+// 3文字以上の語があればmessage_ftsの索引を使い、関連度の高い順に並べます。
+// 全ての語が3文字未満の場合はLIKEで探して新しい順に並べ、本文全体をSnippetにします。
+// 続きがある場合は次のページのOffsetをnextとして返し、ない場合は0を返します
+func MessagesBySearch(db *sql.DB, q *MessageSearchQuery) ([]*MessageSearchResult, int64, error) {
+	var phrases, short []string
+	for _, term := range strings.Fields(q.Query) {
+		if utf8.RuneCountInString(term) >= trigramLength {
+			phrases = append(phrases, quotePhrase(term))
+		} else {
+			short = append(short, term)
+		}
+	}
+
+	var (
+		query string
+		conds []string
+		args  []interface{}
+	)
+	if len(phrases) > 0 {
+		query = `select ` + messageColumns + `, snippet(message_fts, 0, ?, ?, ?, ?) from message_fts join message on message.id = message_fts.rowid`
+		args = append(args, snippetStart, snippetEnd, snippetEllipsis, snippetTokens)
+		conds = append(conds, `message_fts match ?`)
+		args = append(args, strings.Join(phrases, ` AND `))
+	} else {
+		query = `select ` + messageColumns + `, message.body from message`
+	}
+	for _, term := range short {
+		conds = append(conds, `message.body like ? escape '\'`)
+		args = append(args, "%"+escapeLike(term)+"%")
+	}
+	if q.ChannelID != 0 {
+		conds = append(conds, `message.channel_id = ?`)
+		args = append(args, q.ChannelID)
+	}
+	if len(conds) > 0 {
+		query += ` where ` + strings.Join(conds, ` and `)
+	}
+	if len(phrases) > 0 {
+		query += ` order by message_fts.rank, message.id desc`
+	} else {
+		query += ` order by message.id desc`
+	}
+	// 続きがあるか判定するために1件多く取得します
+	query += ` limit ? offset ?`
+	args = append(args, q.Limit+1, q.Offset)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	rs := []*MessageSearchResult{}
+	for rows.Next() {
+		r := &MessageSearchResult{}
+		m, err := scanMessage(rows, &r.Snippet)
+		if err != nil {
+			return nil, 0, err
+		}
+		r.Message = m
+		if len(phrases) == 0 {
+			r.Snippet = highlightTerms(r.Snippet, short)
+		} else {
+			r.Snippet = highlightSnippet(r.Snippet)
+		}
+		rs = append(rs, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	var next int64
+	if len(rs) > q.Limit {
+		rs = rs[:q.Limit]
+		next = int64(q.Offset + q.Limit)
+	}
+
+	return rs, next, nil
+}
+
+// MessagesCountContainingEach は全てのメッセージの件数と、本文にtermsのそれぞれを含むメッセージの件数をtermsの順に返します
+//
+// termsがmaxCountTerms個までなら、メッセージを1度読むだけで全てを数えます
+func MessagesCountContainingEach(db *sql.DB, terms []string) (int64, []int64, error) {
+	var total int64
+	counts := make([]int64, 0, len(terms))
+	for {
+		n := len(terms)
+		if n > maxCountTerms {
+			n = maxCountTerms
+		}
+		cols := []string{`count(*)`}
+		args := make([]interface{}, 0, n)
+		for _, term := range terms[:n] {
+			cols = append(cols, `coalesce(sum(body like ? escape '\'), 0)`)
+			args = append(args, "%"+escapeLike(term)+"%")
+		}
+		row := make([]int64, n+1)
+		dest := make([]interface{}, len(row))
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		if err := db.QueryRow(`select `+strings.Join(cols, `, `)+` from message`, args...).Scan(dest...); err != nil {
+			return 0, nil, err
+		}
+		total = row[0]
+		counts = append(counts, row[1:]...)
+
+		terms = terms[n:]
+		if len(terms) == 0 {
+			return total, counts, nil
+		}
+	}
+}
+
+// quotePhrase はtermをFTS5のフレーズとして検索できるように二重引用符で囲みます
+func quotePhrase(term string) string {
+	return `"` + strings.Replace(term, `"`, `""`, -1) + `"`
+}
+
+// escapeLike はtermに含まれるLIKEの特殊文字をエスケープします
+func escapeLike(term string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return r.Replace(term)
+}
+
+// highlightTerms はsをHTMLエスケープし、termsの出現箇所をHighlightStartとHighlightEndで囲みます
+//
+// LIKEと同じように英字の大文字と小文字を区別しません。出現箇所が重なる場合はまとめて1つの箇所として囲みます
+func highlightTerms(s string, terms []string) string {
+	folded := foldASCII(s)
+	marked := make([]bool, len(s))
+	for _, term := range terms {
+		term = foldASCII(term)
+		if term == "" {
+			continue
+		}
+		for i := 0; i+len(term) <= len(s); {
+			j := strings.Index(folded[i:], term)
+			if j < 0 {
+				break
+			}
+			for k := i + j; k < i+j+len(term); k++ {
+				marked[k] = true
+			}
+			i += j + len(term)
+		}
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		j := i
+		for j < len(s) && marked[j] == marked[i] {
+			j++
+		}
+		if marked[i] {
+			b.WriteString(HighlightStart + html.EscapeString(s[i:j]) + HighlightEnd)
+		} else {
+			b.WriteString(html.EscapeString(s[i:j]))
+		}
+		i = j
+	}
+	return b.String()
+}
+
+// highlightSnippet はFTS5のsnippetをHTMLエスケープし、snippetStartとsnippetEndをHighlightStartとHighlightEndに置き換えます
+func highlightSnippet(s string) string {
+	r := strings.NewReplacer(snippetStart, HighlightStart, snippetEnd, HighlightEnd)
+	return r.Replace(html.EscapeString(s))
+}
+
+// foldASCII はsの英字の大文字を小文字にします
+//
+// SQLiteのLIKEは英字だけ大文字と小文字を区別しないので、それに合わせます。バイト数は変わりません
+func foldASCII(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,70 @@
+package model
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/db/dbtest"
+)
+
+func TestMessagesCountContainingEachが語ごとにメッセージを数える(t *testing.T) {
+	db := dbtest.Open(t)
+	dbtest.InsertMessages(t, db, "100%オレンジ", "オレンジ", "りんご_ジュース", "オレンジとりんご")
+
+	// LIKEの特殊文字も文字として数えます
+	total, counts, err := MessagesCountContainingEach(db, []string{"オレンジ", "りんご", "%", "_", "ぶどう"})
+	if err != nil {
+		t.Fatalf("failed to count: %s", err)
+	}
+	if expected := []int64{3, 2, 1, 1, 0}; total != 4 || !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("expected 4 %v, but %d %v", expected, total, counts)
+	}
+
+	// 1つのクエリで数えられる数より多い語も数えます
+	terms := make([]string, maxCountTerms+1)
+	for i := range terms {
+		terms[i] = fmt.Sprintf("語%d", i)
+	}
+	terms[maxCountTerms] = "りんご"
+	total, counts, err = MessagesCountContainingEach(db, terms)
+	if err != nil {
+		t.Fatalf("failed to count: %s", err)
+	}
+	if total != 4 || len(counts) != len(terms) || counts[0] != 0 || counts[maxCountTerms] != 2 {
+		t.Fatalf("expected %d counts ending with 2, but %d %d counts", len(terms), total, len(counts))
+	}
+}
+
+func TestMessagesCountContainingEachがメッセージがなければ0を返す(t *testing.T) {
+	db := dbtest.Open(t)
+
+	total, counts, err := MessagesCountContainingEach(db, []string{"オレンジ"})
+	if err != nil {
+		t.Fatalf("failed to count: %s", err)
+	}
+	if total != 0 || !reflect.DeepEqual(counts, []int64{0}) {
+		t.Fatalf("expected 0 [0], but %d %v", total, counts)
+	}
+}
+
+func TestHighlightTermsが本文をエスケープして検索語を囲む(t *testing.T) {
+	cases := []struct {
+		name     string
+		s        string
+		terms    []string
+		expected string
+	}{
+		{"escape", `<b>"天気"</b> & 晴れ`, []string{"天気"}, `&lt;b&gt;&#34;<mark>天気</mark>&#34;&lt;/b&gt; &amp; 晴れ`},
+		{"escaped term", "a<b", []string{"<"}, "a<mark>&lt;</mark>b"},
+		// LIKEと同じように英字の大文字と小文字を区別しません
+		{"case", "Go と go", []string{"gO"}, "<mark>Go</mark> と <mark>go</mark>"},
+		{"overlap", "abcd", []string{"ab", "bc"}, "<mark>abc</mark>d"},
+		{"none", "<i>", []string{"x"}, "&lt;i&gt;"},
+	}
+	for _, tc := range cases {
+		if actual := highlightTerms(tc.s, tc.terms); actual != tc.expected {
+			t.Fatalf("%s: expected %s, but %s", tc.name, tc.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+// Session はログインセッションの構造体です
+//
+// DBにはTokenのハッシュ値だけを保存するので、Tokenは作成した時にしか分かりません
+type Session struct {
+	Token   string
+	UserID  int64
+	Expires time.Time
+}
+
+// NewSession はuserIDのユーザーの新しいセッションを作成し、sessionテーブルに保存します
+func NewSession(db *sql.DB, userID int64, ttl time.Duration) (*Session, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{
+		Token:   token,
+		UserID:  userID,
+		Expires: time.Now().Add(ttl),
+	}
+
+	if _, err := db.Exec(`insert into session (token_hash, user_id, expires) values (?, ?, ?)`, hashToken(token), userID, s.Expires.Unix()); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// UserBySessionToken はtokenのセッションのユーザーを返します
+//
+// セッションが存在しないか期限切れの場合はsql.ErrNoRowsを返します
+func UserBySessionToken(db *sql.DB, token string) (*User, error) {
+	u := &User{}
+	err := db.QueryRow(`select user.id, user.name, user.admin, user.password_hash from session join user on user.id = session.user_id where session.token_hash = ? and session.expires > ?`,
+		hashToken(token), time.Now().Unix()).Scan(&u.ID, &u.Name, &u.Admin, &u.PasswordHash)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// DeleteSession はtokenのセッションを削除します
+func DeleteSession(db *sql.DB, token string) error {
+	_, err := db.Exec(`delete from session where token_hash = ?`, hashToken(token))
+	return err
+}
+
+// DeleteExpiredSessions は期限切れのセッションを全て削除します
+func DeleteExpiredSessions(db *sql.DB) error {
+	_, err := db.Exec(`delete from session where expires <= ?`, time.Now().Unix())
+	return err
+}
+
+// newToken は推測できないランダムなトークンを返します
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken はトークンをDBに保存するためのハッシュ値にします
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
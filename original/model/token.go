@@ -0,0 +1,151 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Scope はAPIトークンで許可する操作の範囲です
+type Scope string
+
+const (
+	// ScopeRead はメッセージなどの読み出しだけを許可します
+	ScopeRead Scope = "read"
+	// ScopeWrite はScopeReadに加えて、メッセージの投稿・編集・削除を許可します
+	ScopeWrite Scope = "write"
+	// ScopeAdmin はScopeWriteに加えて、トークンの管理や管理者としての操作を許可します
+	ScopeAdmin Scope = "admin"
+)
+
+// tokenPrefix はAPIトークンであることが分かるように付ける接頭辞です
+const tokenPrefix = "vg1_"
+
+// ErrInvalidScope は存在しないscopeが指定された場合のエラーです
+var ErrInvalidScope = errors.New("scope must be one of read, write or admin")
+
+// level はscopeの強さを返します。存在しないscopeは0です
+func (s Scope) level() int {
+	switch s {
+	case ScopeRead:
+		return 1
+	case ScopeWrite:
+		return 2
+	case ScopeAdmin:
+		return 3
+	}
+	return 0
+}
+
+// Valid はscopeが存在するものか判定します
+func (s Scope) Valid() bool {
+	return s.level() > 0
+}
+
+// Allows はscopeがrequiredの操作を許可するか判定します
+func (s Scope) Allows(required Scope) bool {
+	return s.Valid() && s.level() >= required.level()
+}
+
+// Token はAPIトークンの構造体です
+//
+// DBにはトークンのハッシュ値だけを保存するので、Valueは作成した時にしか分かりません
+type Token struct {
+	ID      int64     `json:"id"`
+	UserID  int64     `json:"user_id"`
+	Name    string    `json:"name"`
+	Scope   Scope     `json:"scope"`
+	Value   string    `json:"token,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// NewToken はuserIDのユーザーの新しいAPIトークンを作成し、tokenテーブルに保存します
+func NewToken(db *sql.DB, userID int64, name string, scope Scope) (*Token, error) {
+	if !scope.Valid() {
+		return nil, ErrInvalidScope
+	}
+
+	v, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	t := &Token{
+		UserID:  userID,
+		Name:    name,
+		Scope:   scope,
+		Value:   tokenPrefix + v,
+		Created: parseTimestamp(time.Now()),
+	}
+
+	res, err := db.Exec(`insert into token (user_id, name, token_hash, scope, created) values (?, ?, ?, ?, ?)`,
+		t.UserID, t.Name, hashToken(t.Value), t.Scope, t.Created.Format(timestampFormat))
+	if err != nil {
+		return nil, err
+	}
+	if t.ID, err = res.LastInsertId(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// TokensByUserID はuserIDのユーザーのAPIトークンを全て返します
+func TokensByUserID(db *sql.DB, userID int64) ([]*Token, error) {
+	rows, err := db.Query(`select id, user_id, name, scope, created from token where user_id = ? order by id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ts := []*Token{}
+	for rows.Next() {
+		t := &Token{}
+		if err := rows.Scan(&t.ID, &t.UserID, &t.Name, &t.Scope, &t.Created); err != nil {
+			return nil, err
+		}
+		ts = append(ts, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ts, nil
+}
+
+// UserByToken はAPIトークンvalueのユーザーとscopeを返します
+//
+// トークンが存在しない場合はsql.ErrNoRowsを返します
+func UserByToken(db *sql.DB, value string) (*User, Scope, error) {
+	u := &User{}
+	var scope Scope
+	err := db.QueryRow(`select user.id, user.name, user.admin, user.password_hash, token.scope from token join user on user.id = token.user_id where token.token_hash = ?`,
+		hashToken(value)).Scan(&u.ID, &u.Name, &u.Admin, &u.PasswordHash, &scope)
+	if err != nil {
+		return nil, "", err
+	}
+	return u, scope, nil
+}
+
+// DeleteToken はuserIDのユーザーのidのAPIトークンを削除します
+//
+// 該当するトークンが存在しない場合はsql.ErrNoRowsを返します
+func DeleteToken(db *sql.DB, userID, id int64) error {
+	res, err := db.Exec(`delete from token where id = ? and user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteTokensByName はuserIDのユーザーの名前がnameのAPIトークンを全て削除します
+func DeleteTokensByName(db *sql.DB, userID int64, name string) error {
+	_, err := db.Exec(`delete from token where user_id = ? and name = ?`, userID, name)
+	return err
+}
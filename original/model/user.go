@@ -0,0 +1,170 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrUserExists は同じ名前のユーザーが既に存在する場合のエラーです
+	ErrUserExists = errors.New("user already exists")
+	// ErrInvalidPassword は名前またはパスワードが間違っている場合のエラーです
+	ErrInvalidPassword = errors.New("invalid name or password")
+	// ErrNotSystemUser はシステムユーザーの名前が通常のユーザーに使われている場合のエラーです
+	ErrNotSystemUser = errors.New("user exists but is not a system user")
+)
+
+// BotUserName はbotが投稿に使うシステムユーザーの名前です
+const BotUserName = "bot"
+
+// reservedUserNames はシステムユーザーのために取っておく、ユーザー登録に使えない名前です
+var reservedUserNames = map[string]bool{
+	BotUserName: true,
+}
+
+// User はユーザーの構造体です
+//
+// パスワードはbcryptでハッシュ化した値だけを保持します。Systemはbotなどサーバー内部から投稿するためのユーザーです
+type User struct {
+	ID           int64  `json:"id"`
+	Name         string `json:"name"`
+	Admin        bool   `json:"admin"`
+	System       bool   `json:"-"`
+	PasswordHash string `json:"-"`
+}
+
+// ReservedUserName はnameがシステムユーザーのために取っておく名前か判定します
+func ReservedUserName(name string) bool {
+	return reservedUserNames[name]
+}
+
+// NewUser はpasswordをハッシュ化して新しいUser構造体のポインタを返します
+func NewUser(name, password string) (*User, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	return &User{
+		Name:         name,
+		PasswordHash: string(hash),
+	}, nil
+}
+
+// Authenticate はpasswordがユーザーのパスワードと一致するか判定します
+//
+// パスワードが設定されていないユーザー(botなど)は常に失敗します
+func (u *User) Authenticate(password string) error {
+	if u.PasswordHash == "" {
+		return ErrInvalidPassword
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)); err != nil {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// CanModify はユーザーがmを編集・削除できるか判定します
+//
+// メッセージの投稿者と管理者だけが編集・削除できます
+func (u *User) CanModify(m *Message) bool {
+	if u == nil {
+		return false
+	}
+	return u.Admin || (m.UserID != 0 && m.UserID == u.ID)
+}
+
+// UserByID は指定されたIDのユーザーを返します
+func UserByID(db *sql.DB, id int64) (*User, error) {
+	u := &User{}
+	if err := db.QueryRow(`select id, name, admin, system, password_hash from user where id = ?`, id).Scan(&u.ID, &u.Name, &u.Admin, &u.System, &u.PasswordHash); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// UserByName は指定された名前のユーザーを返します
+func UserByName(db *sql.DB, name string) (*User, error) {
+	u := &User{}
+	if err := db.QueryRow(`select id, name, admin, system, password_hash from user where name = ?`, name).Scan(&u.ID, &u.Name, &u.Admin, &u.System, &u.PasswordHash); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Insert はuserテーブルに新規データを1件追加します
+//
+// u.Adminがtrueでない限り管理者にはしません。管理者はGrantAdminで明示的に指定します
+func (u *User) Insert(db *sql.DB) (*User, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow(`select exists(select 1 from user where name = ?)`, u.Name).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, ErrUserExists
+	}
+
+	now := formatTimestamp(time.Now())
+	res, err := tx.Exec(`insert into user (name, password_hash, admin, system, created, updated) values (?, ?, ?, ?, ?, ?)`, u.Name, u.PasswordHash, u.Admin, u.System, now, now)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &User{
+		ID:           id,
+		Name:         u.Name,
+		Admin:        u.Admin,
+		System:       u.System,
+		PasswordHash: u.PasswordHash,
+	}, nil
+}
+
+// GrantAdmin は名前がnameのユーザーを管理者にします。ユーザーが存在しない場合はsql.ErrNoRowsを返します
+func GrantAdmin(db *sql.DB, name string) error {
+	res, err := db.Exec(`update user set admin = 1, updated = ? where name = ?`, formatTimestamp(time.Now()), name)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// FindOrCreateSystemUser は名前がnameのシステムユーザーを返します。存在しなければ作成します
+//
+// botなどサーバー内部から投稿するためのユーザーに使います。
+// 同じ名前の通常のユーザーが存在する場合は、そのユーザーをシステムユーザーとして扱わずにErrNotSystemUserを返します
+func FindOrCreateSystemUser(db *sql.DB, name string) (*User, error) {
+	u, err := UserByName(db, name)
+	switch {
+	case err == sql.ErrNoRows:
+		return (&User{Name: name, System: true}).Insert(db)
+	case err != nil:
+		return nil, err
+	}
+	if !u.System {
+		return nil, ErrNotSystemUser
+	}
+	return u, nil
+}
@@ -0,0 +1,99 @@
+package model
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/db/dbtest"
+)
+
+func TestInsertは最初のユーザーも管理者にしない(t *testing.T) {
+	db := dbtest.Open(t)
+
+	for _, name := range []string{"first", "second"} {
+		u, err := NewUser(name, "password")
+		if err != nil {
+			t.Fatalf("failed to create user: %s", err)
+		}
+		inserted, err := u.Insert(db)
+		if err != nil {
+			t.Fatalf("failed to insert user: %s", err)
+		}
+		if inserted.Admin {
+			t.Fatalf("%s: inserted user expected not to be admin", name)
+		}
+		stored, err := UserByName(db, name)
+		if err != nil {
+			t.Fatalf("failed to get user: %s", err)
+		}
+		if stored.Admin {
+			t.Fatalf("%s: stored user expected not to be admin", name)
+		}
+	}
+
+	system, err := FindOrCreateSystemUser(db, "bot")
+	if err != nil {
+		t.Fatalf("failed to create system user: %s", err)
+	}
+	if system.Admin {
+		t.Fatalf("system user expected not to be admin")
+	}
+}
+
+func TestGrantAdminで指定したユーザーだけが管理者になる(t *testing.T) {
+	db := dbtest.Open(t)
+
+	for _, name := range []string{"alice", "bob"} {
+		u, err := NewUser(name, "password")
+		if err != nil {
+			t.Fatalf("failed to create user: %s", err)
+		}
+		if _, err := u.Insert(db); err != nil {
+			t.Fatalf("failed to insert user: %s", err)
+		}
+	}
+
+	if err := GrantAdmin(db, "bob"); err != nil {
+		t.Fatalf("failed to grant admin: %s", err)
+	}
+	if err := GrantAdmin(db, "nobody"); err != sql.ErrNoRows {
+		t.Fatalf("error expected %v, but %v", sql.ErrNoRows, err)
+	}
+
+	for name, expected := range map[string]bool{"alice": false, "bob": true} {
+		u, err := UserByName(db, name)
+		if err != nil {
+			t.Fatalf("failed to get user: %s", err)
+		}
+		if u.Admin != expected {
+			t.Fatalf("%s: admin expected %v, but %v", name, expected, u.Admin)
+		}
+	}
+}
+
+func TestFindOrCreateSystemUserが通常のユーザーをシステムユーザーにしない(t *testing.T) {
+	db := dbtest.Open(t)
+
+	system, err := FindOrCreateSystemUser(db, BotUserName)
+	if err != nil {
+		t.Fatalf("failed to create system user: %s", err)
+	}
+	if !system.System {
+		t.Fatalf("system user expected to be system")
+	}
+	again, err := FindOrCreateSystemUser(db, BotUserName)
+	if err != nil || again.ID != system.ID {
+		t.Fatalf("same system user %d expected, but %v (%v)", system.ID, again, err)
+	}
+
+	u, err := NewUser("impostor", "password")
+	if err != nil {
+		t.Fatalf("failed to create user: %s", err)
+	}
+	if _, err := u.Insert(db); err != nil {
+		t.Fatalf("failed to insert user: %s", err)
+	}
+	if _, err := FindOrCreateSystemUser(db, "impostor"); err != ErrNotSystemUser {
+		t.Fatalf("error expected %v, but %v", ErrNotSystemUser, err)
+	}
+}
@@ -0,0 +1,17 @@
+#!/usr/bin/env python3
+# reversebotのプラグインです。"reverse "より後ろの文字列を逆順にして返します
+#
+# 標準入力から1行に1つのリクエストを読み、同じidのレスポンスを1行ずつ標準出力に書きます
+import json
+import sys
+
+PREFIX = "reverse "
+
+for line in sys.stdin:
+    request = json.loads(line)
+    body = request["message"]["body"]
+    if body.startswith(PREFIX):
+        response = {"id": request["id"], "message": {"body": body[len(PREFIX):][::-1]}}
+    else:
+        response = {"id": request["id"], "message": None}
+    print(json.dumps(response, ensure_ascii=False), flush=True)
@@ -0,0 +1,119 @@
+// Package pubsub はメッセージのeventをWebSocketなどの購読者に配信するためのパッケージです
+package pubsub
+
+import (
+	"context"
+	"log"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+)
+
+type (
+	// Hub はinで受け取ったeventをoutに渡し、Subscribeしている全てのSubscriptionにも配信します
+	//
+	// inに送った側を待たせないように、outへもブロックせずに渡します。outのバッファが溢れた場合はeventを捨ててログに出します。
+	// Subscriptionのバッファが溢れた場合は、そのSubscriptionを閉じて配信を打ち切ります
+	//
+	//   fields
+	//     in          chan *model.Event
+	//     out         chan *model.Event
+	//     subscribe   chan *Subscription
+	//     unsubscribe chan *Subscription
+	//     subs        map[*Subscription]bool
+	//     done        chan struct{}
+	Hub struct {
+		in          chan *model.Event
+		out         chan *model.Event
+		subscribe   chan *Subscription
+		unsubscribe chan *Subscription
+		subs        map[*Subscription]bool
+		done        chan struct{}
+	}
+
+	// Subscription はHubからeventを受け取るための構造体です
+	//
+	// バッファが溢れるなどしてHubから切断された場合、Cは閉じられます
+	Subscription struct {
+		C chan *model.Event
+	}
+)
+
+// Run はHubを起動します
+func (h *Hub) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			for s := range h.subs {
+				h.remove(s)
+			}
+			close(h.done)
+			return
+		case s := <-h.subscribe:
+			h.subs[s] = true
+		case s := <-h.unsubscribe:
+			h.remove(s)
+		case e := <-h.in:
+			if h.out != nil {
+				select {
+				case h.out <- e:
+				default:
+					// 受け取りが追いつかない場合は、Hubを止めずにeventを捨てます
+					log.Printf("hub: dropped %s event of message %d", e.Type, e.Message.ID)
+				}
+			}
+			for s := range h.subs {
+				select {
+				case s.C <- e:
+				default:
+					// 受け取りが追いつかない購読者は切断します
+					h.remove(s)
+				}
+			}
+		}
+	}
+}
+
+// Subscribe はバッファサイズがbufferSizeの新しいSubscriptionを登録して返します
+func (h *Hub) Subscribe(bufferSize int) *Subscription {
+	s := &Subscription{
+		C: make(chan *model.Event, bufferSize),
+	}
+	select {
+	case h.subscribe <- s:
+	case <-h.done:
+		// Hubが停止している場合は閉じたSubscriptionを返します
+		close(s.C)
+	}
+	return s
+}
+
+// Unsubscribe はsの登録を解除します
+func (h *Hub) Unsubscribe(s *Subscription) {
+	select {
+	case h.unsubscribe <- s:
+	case <-h.done:
+	}
+}
+
+// remove はsの登録を解除してCを閉じます
+func (h *Hub) remove(s *Subscription) {
+	if !h.subs[s] {
+		return
+	}
+	delete(h.subs, s)
+	close(s.C)
+}
+
+// NewHub は新しいHub構造体のポインタを返します
+//
+// outがnilの場合はSubscriptionにだけ配信します。outにはバッファのあるチャネルを渡します
+func NewHub(in chan *model.Event, out chan *model.Event) *Hub {
+	return &Hub{
+		in:          in,
+		out:         out,
+		subscribe:   make(chan *Subscription),
+		unsubscribe: make(chan *Subscription),
+		subs:        map[*Subscription]bool{},
+		done:        make(chan struct{}),
+	}
+}
@@ -0,0 +1,27 @@
+// dicebot は"dice 2d6"のようなメッセージに、サイコロを振った結果を返信します
+//
+// 関数はexportsに代入するか、トップレベルに定義します。msgはAPIが返すメッセージと同じ形のオブジェクトです
+
+var pattern = /^dice (\d+)d(\d+)$/;
+
+exports.check = function(msg) {
+  return pattern.test(msg.body);
+};
+
+exports.process = function(msg) {
+  var m = pattern.exec(msg.body);
+  var count = parseInt(m[1], 10);
+  var faces = parseInt(m[2], 10);
+  if (count < 1 || count > 100 || faces < 1) {
+    return "サイコロが振れないパカ";
+  }
+
+  var rolls = [];
+  var sum = 0;
+  for (var i = 0; i < count; i++) {
+    var n = Math.floor(Math.random() * faces) + 1;
+    rolls.push(n);
+    sum += n;
+  }
+  return {body: rolls.join(" + ") + " = " + sum};
+};
@@ -0,0 +1,22 @@
+// remindbot は"remind 10 お茶"のようなメッセージに、すぐに返事をしてから10秒後にもう一度返信します
+//
+// 配列を返すと複数の返信をします。delayにミリ秒を指定すると、その時間が経ってから投稿します
+
+var pattern = /^remind (\d+) (.+)$/;
+
+exports.check = function(msg) {
+  return pattern.test(msg.body);
+};
+
+exports.process = function(msg) {
+  var m = pattern.exec(msg.body);
+  var seconds = parseInt(m[1], 10);
+  if (seconds < 1 || seconds > 3600) {
+    return "1秒から1時間までにしてほしいパカ";
+  }
+
+  return [
+    seconds + "秒後にお知らせするパカ",
+    {body: m[2] + "の時間パカ！", delay: seconds * 1000}
+  ];
+};
@@ -7,22 +7,51 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/auth"
 	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/bot"
 	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/controller"
 	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/db"
 	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/pubsub"
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/service"
 	"github.com/gin-gonic/gin"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// streamBufferSize はメッセージのeventをHubやbotに渡すチャネルのバッファの大きさです
+const streamBufferSize = 100
+
 // Server はAPIサーバーが実装された構造体です
+//
+// BotsFileはbotを定義したファイルのパスです。空の場合はInitでdbconfと同じディレクトリのbots.ymlにします。
+// ScriptsDirはJavaScriptのbotを置くディレクトリです。空の場合はInitでdbconfと同じディレクトリのscriptsにします。
+// ScriptFetchHostsはJavaScriptのbotがfetchでアクセスできるホストです。
+// MaxBotChainDepthはbotの返信にbotが返信し続けられる深さです。0の場合はbot.DefaultMaxChainDepthにします。
+// PosterURLが空でなければ、botの投稿をサーバー内で直接行わずに、このURLのAPIにPOSTします。
+// KeywordBackendはbotがキーワードを抽出する方法です。空の場合はbot.KeywordBackendLocalにします。
+// Clockは予定の時刻に投稿するbotが使う時計です。空の場合はInitでサーバーのタイムゾーンの実際の時刻にします。
+// Adminが空でなければ、Initでその名前のユーザーを管理者にします。ユーザー登録だけでは管理者になりません
 type Server struct {
-	db          *sql.DB
-	Engine      *gin.Engine
-	multicaster *bot.Multicaster
-	poster      *bot.Poster
-	bots        []*bot.Bot
+	db               *sql.DB
+	Engine           *gin.Engine
+	BotsFile         string
+	ScriptsDir       string
+	ScriptFetchHosts []string
+	MaxBotChainDepth int
+	PosterURL        string
+	KeywordBackend   string
+	Clock            bot.Clock
+	Admin            string
+	hub              *pubsub.Hub
+	multicaster      *bot.Multicaster
+	poster           *bot.Poster
+	loader           *bot.Loader
+	scripts          *bot.ScriptLoader
+	bots             []*bot.Bot
 }
 
 // NewServer は新しいServerの構造体のポインタを返します
@@ -62,27 +91,165 @@ func (s *Server) Init(dbconf, env string) error {
 		c.String(http.StatusOK, "pong")
 	})
 
-	msgStream := make(chan *model.Message)
-	mctr := &controller.Message{DB: db, Stream: msgStream}
+	api.Use(auth.Session(db), auth.Token(db))
+	read := auth.RequireScope(model.ScopeRead)
+	write := auth.RequireScope(model.ScopeWrite)
+	admin := auth.RequireAdmin()
+
+	uctr := &controller.User{DB: db}
+	api.POST("/users", uctr.SignUp)
+	api.POST("/login", uctr.Login)
+	api.POST("/logout", uctr.Logout)
+	api.GET("/me", read, uctr.Me)
+
+	// トークンは自分のものだけを扱います。盗まれたreadのトークンで他のトークンを作ったり失効させたりできないように、
+	// 作成と失効にはwriteが必要です。作れるscopeはControllerで制限します
+	tctr := &controller.Token{DB: db}
+	api.GET("/tokens", read, tctr.All)
+	api.POST("/tokens", write, tctr.Create)
+	api.DELETE("/tokens/:id", write, tctr.DeleteByID)
+
+	// 投稿したAPIのリクエストがbotやWebSocketの配信を待たないように、eventはバッファに溜めて渡します
+	msgStream := make(chan *model.Event, streamBufferSize)
+	msvc := &service.Message{DB: db, Stream: msgStream}
+	mctr := &controller.Message{DB: db, Service: msvc}
 	api.GET("/messages", mctr.All)
 	api.GET("/messages/:id", mctr.GetByID)
-	api.POST("/messages", mctr.Create)
-	api.PUT("/messages/:id", mctr.UpdateByID)
-	api.DELETE("/messages/:id", mctr.DeleteByID)
+	api.GET("/messages/:id/thread", mctr.Thread)
+	api.POST("/messages", write, mctr.Create)
+	api.PUT("/messages/:id", write, mctr.UpdateByID)
+	api.DELETE("/messages/:id", write, mctr.DeleteByID)
+
+	rctr := &controller.Reaction{DB: db, Service: msvc}
+	api.POST("/messages/:id/reactions/:emoji", write, rctr.Create)
+	api.DELETE("/messages/:id/reactions/:emoji", write, rctr.DeleteByEmoji)
+
+	channelBots := &service.ChannelBots{DB: db}
+	cctr := &controller.Channel{DB: db, Bots: channelBots}
+	api.GET("/channels", cctr.All)
+	api.POST("/channels", write, cctr.Create)
+	api.GET("/channels/:id", cctr.GetByID)
+	api.GET("/channels/:id/messages", mctr.All)
+	api.POST("/channels/:id/messages", write, mctr.Create)
+	// どのチャンネルでbotが反応するかは管理者だけが変えられます
+	api.PUT("/channels/:id/bots/:name", admin, cctr.EnableBot)
+	api.DELETE("/channels/:id/bots/:name", admin, cctr.DisableBot)
+
+	// stream
+	botStream := make(chan *model.Event, streamBufferSize)
+	hub := pubsub.NewHub(msgStream, botStream)
+	s.hub = hub
+
+	sctr := &controller.Stream{DB: db, Hub: hub}
+	api.GET("/stream", sctr.WebSocket)
+	api.GET("/events", sctr.Events)
 
 	// bot
-	mc := bot.NewMulticaster(msgStream)
+	mc := bot.NewMulticaster(botStream)
+	// botはチャンネルごとに有効にしたものだけが反応します
+	mc.Filter = func(b *bot.Bot, m *model.Message) bool {
+		enabled, err := channelBots.Enabled(m.ChannelID, b.Name())
+		if err != nil {
+			log.Printf("multicaster: %s", err)
+			return false
+		}
+		return enabled
+	}
+	// keywordbotはキーワードの抽出に時間がかかるので、溜め込まずに新しいものから捨てます
+	mc.Queues["keywordbot"] = bot.QueueConfig{Size: 10, Policy: bot.DropNewest}
+	if s.MaxBotChainDepth > 0 {
+		mc.MaxChainDepth = s.MaxBotChainDepth
+	}
+	// botは再起動しても残しておきたい値をDBに保存できます
+	mc.Store = bot.NewStore(db)
+	// botとユーザーのやりとりも再起動した後に続けられるようにDBに保存します
+	mc.Conversations = bot.NewConversations(db)
+	// 予定の時刻に投稿するbotは、サーバーのタイムゾーン(環境変数TZ)で時刻を決めます
+	if s.Clock == nil {
+		s.Clock = bot.NewClock(time.Local)
+	}
+	mc.Clock = s.Clock
 	s.multicaster = mc
 
-	poster := bot.NewPoster(10)
-	s.poster = poster
+	if err := model.DeleteExpiredSessions(db); err != nil {
+		return err
+	}
+	if s.Admin != "" {
+		err := model.GrantAdmin(db, s.Admin)
+		switch {
+		case err == sql.ErrNoRows:
+			log.Printf("admin user %s not found. sign up and restart the server", s.Admin)
+		case err != nil:
+			return err
+		}
+	}
+	if err := mc.Store.Clean(); err != nil {
+		return err
+	}
+	if err := mc.Conversations.Clean(); err != nil {
+		return err
+	}
+
+	// botはbotユーザーとして投稿します
+	botUser, err := model.FindOrCreateSystemUser(db, model.BotUserName)
+	if err != nil {
+		return fmt.Errorf("bot user %q: %s", model.BotUserName, err)
+	}
+	msvc.BotUserID = botUser.ID
+
+	// PosterURLが指定された場合はbotユーザーのAPIトークンでPOSTします。トークンは起動のたびに作り直します
+	if err := model.DeleteTokensByName(db, botUser.ID, "poster"); err != nil {
+		return err
+	}
+	if s.PosterURL != "" {
+		botToken, err := model.NewToken(db, botUser.ID, "poster", model.ScopeWrite)
+		if err != nil {
+			return err
+		}
+		s.poster = bot.NewHTTPPoster(10, s.PosterURL)
+		s.poster.Header.Set("Authorization", "Bearer "+botToken.Value)
+	} else {
+		s.poster = bot.NewPoster(10, func(ctx context.Context, m *model.Message) (*model.Message, error) {
+			return msvc.Create(ctx, botUser, m)
+		})
+	}
+
+	keywords, err := bot.NewKeywordExtractor(s.KeywordBackend, db)
+	if err != nil {
+		return err
+	}
+
+	bctr := &controller.Bot{Multicaster: mc, Out: s.poster.In, Keywords: keywords}
+	api.GET("/bots", admin, bctr.All)
+	api.POST("/bots", admin, bctr.Create)
+	api.GET("/bots/queues", admin, bctr.Queues)
+	api.DELETE("/bots/:name", admin, bctr.DeleteByName)
+	api.POST("/bots/:name/pause", admin, bctr.Pause)
+	api.POST("/bots/:name/resume", admin, bctr.Resume)
 
 	helloWorldBot := bot.NewHelloWorldBot(s.poster.In)
 	s.bots = append(s.bots, helloWorldBot)
 	omikujiBot := bot.NewOmikujiBot(s.poster.In)
 	s.bots = append(s.bots, omikujiBot)
-	keywordBot := bot.NewKeywordBot(s.poster.In)
+	keywordBot := bot.NewKeywordBot(keywords, s.poster.In)
 	s.bots = append(s.bots, keywordBot)
+	reactionBot := bot.NewReactionBot(s.poster.In)
+	s.bots = append(s.bots, reactionBot)
+	commandBot := bot.NewCommandBot("commandbot", bot.NewBuiltinCommandRouter(keywords), s.poster.In)
+	s.bots = append(s.bots, commandBot)
+
+	// その他のbotはbots.ymlに定義します
+	if s.BotsFile == "" {
+		s.BotsFile = filepath.Join(filepath.Dir(dbconf), "bots.yml")
+	}
+	s.loader = bot.NewLoader(s.BotsFile, mc, s.poster.In)
+
+	// JavaScriptのbotはscriptsディレクトリに置きます
+	if s.ScriptsDir == "" {
+		s.ScriptsDir = filepath.Join(filepath.Dir(dbconf), "scripts")
+	}
+	s.scripts = bot.NewScriptLoader(s.ScriptsDir, mc, s.poster.In)
+	s.scripts.Config.AllowedHosts = s.ScriptFetchHosts
 
 	return nil
 }
@@ -97,27 +264,47 @@ func (s *Server) Run(port string) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	go s.hub.Run(ctx)
+
 	// botを起動
 	go s.multicaster.Run(ctx)
-	go s.poster.Run(ctx, fmt.Sprintf("http://0.0.0.0:%s", port))
+	go s.poster.Run(ctx)
 
+	// botのgoroutineはMulticasterが起動します
 	for _, b := range s.bots {
-		go b.Run(ctx)
 		s.multicaster.BotIn <- b
 	}
+	go s.loader.Run(ctx)
+	go s.scripts.Run(ctx)
 
 	s.Engine.Run(fmt.Sprintf(":%s", port))
 }
 
 func main() {
 	var (
-		dbconf = flag.String("dbconf", "dbconfig.yml", "database configuration file.")
-		env    = flag.String("env", "development", "application envirionment (production, development etc.)")
-		port   = flag.String("port", "8080", "listening port.")
+		dbconf     = flag.String("dbconf", "dbconfig.yml", "database configuration file.")
+		env        = flag.String("env", "development", "application envirionment (production, development etc.)")
+		port       = flag.String("port", "8080", "listening port.")
+		bots       = flag.String("bots", "", "bot definition file. defaults to bots.yml next to dbconf.")
+		scripts    = flag.String("scripts", "", "directory of JavaScript bots. defaults to scripts next to dbconf.")
+		fetchHosts = flag.String("script-fetch-hosts", "", "comma separated hosts JavaScript bots are allowed to fetch.")
+		posterURL  = flag.String("poster-url", "", "post bot messages to the API at this URL instead of in-process.")
+		chainDepth = flag.Int("bot-chain-depth", bot.DefaultMaxChainDepth, "maximum depth of bots replying to bots.")
+		keywords   = flag.String("keyword-backend", bot.KeywordBackendLocal, "keyword extraction for bots (local, yahoo).")
+		admin      = flag.String("admin", "", "name of the user to make admin at startup.")
 	)
 	flag.Parse()
 
 	s := NewServer()
+	s.BotsFile = *bots
+	s.ScriptsDir = *scripts
+	s.MaxBotChainDepth = *chainDepth
+	s.PosterURL = *posterURL
+	s.KeywordBackend = *keywords
+	s.Admin = *admin
+	if *fetchHosts != "" {
+		s.ScriptFetchHosts = strings.Split(*fetchHosts, ",")
+	}
 	if err := s.Init(*dbconf, *env); err != nil {
 		log.Fatalf("fail to init server: %s", err)
 	}
@@ -1,39 +1,145 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/bot"
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+	"github.com/gorilla/websocket"
 )
 
 const (
 	dbconf = "dbconfig.yml"
 	env    = "test"
 	port   = "50000"
+
+	// waitTimeout はbotの返信などを待つ時間です。-raceを付けると遅くなるので余裕を持たせます
+	waitTimeout = 10 * time.Second
+	// pollInterval は待っている間に状態を確かめる間隔です
+	pollInterval = 50 * time.Millisecond
 )
 
 var tsURL = "http://localhost:" + port
 
+// botsFile はテスト中にbotの定義を書き換えるためのファイルです
+var botsFile string
+
+// scriptsDir はテスト中にJavaScriptのbotを置くディレクトリです
+var scriptsDir string
+
+// clock はテスト中に予定の時刻に投稿するbotが使う、Advanceで進める時計です
+var clock = &testClock{now: time.Date(2018, 6, 10, 8, 59, 0, 0, time.FixedZone("JST", 9*60*60))}
+
 func TestMain(m *testing.M) {
+	// ExecProcessorのテストでは、テストのバイナリ自体をプラグインとして起動します
+	if os.Getenv("BOT_PLUGIN") == "1" {
+		os.Exit(runBotPlugin())
+	}
 	os.Exit(realMain(m))
 }
 
 func realMain(m *testing.M) int {
+	f, err := ioutil.TempFile("", "bots.yml")
+	if err != nil {
+		panic(fmt.Sprintf("failed to create bots file: %v", err))
+	}
+	f.Close()
+	botsFile = f.Name()
+	defer os.Remove(botsFile)
+
+	scriptsDir, err = ioutil.TempDir("", "scripts")
+	if err != nil {
+		panic(fmt.Sprintf("failed to create scripts dir: %v", err))
+	}
+	defer os.RemoveAll(scriptsDir)
+
 	s := NewServer()
+	s.BotsFile = botsFile
+	s.ScriptsDir = scriptsDir
+	s.ScriptFetchHosts = []string{"127.0.0.1"}
+	s.Clock = clock
 	if err := s.Init(dbconf, env); err != nil {
 		panic(fmt.Sprintf("failed to init server: %v", err))
 	}
+	s.loader.Interval = 50 * time.Millisecond
+	// 返信しないbotのキューが一杯になっても投稿が止まらないことを確かめるために、長く待つキューにします
+	s.multicaster.Queues["blockbot"] = bot.QueueConfig{Size: 1, Policy: bot.Block, Timeout: 10 * time.Second}
+	s.scripts.Interval = 50 * time.Millisecond
 	go s.Run(port)
 	defer s.Close()
 
+	if err := waitForServer(5 * time.Second); err != nil {
+		panic(fmt.Sprintf("failed to start server: %v", err))
+	}
+
+	// 以降のリクエストは管理者のユーザーとしてログインした状態で行います
+	jar, err := newLoggedInJar("testuser", "password")
+	if err != nil {
+		panic(fmt.Sprintf("failed to sign up: %v", err))
+	}
+	http.DefaultClient.Jar = jar
+	// 管理者はユーザー登録では決まらないので、サーバーの起動時と同じように指定します
+	if err := model.GrantAdmin(s.db, "testuser"); err != nil {
+		panic(fmt.Sprintf("failed to grant admin: %v", err))
+	}
+
 	return m.Run()
 }
 
+// newLoggedInJar はユーザーを登録し、ログインしたセッションのcookieを持つcookiejarを返します
+func newLoggedInJar(name, password string) (http.CookieJar, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Jar: jar}
+
+	body := fmt.Sprintf(`{"name": "%s", "password": "%s"}`, name, password)
+	resp, err := client.Post(tsURL+"/api/users", "application/json", bytes.NewBuffer([]byte(body)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("status code expected %d but not, actual %d", http.StatusCreated, resp.StatusCode)
+	}
+	return jar, nil
+}
+
+// waitForServer はサーバーがリクエストを受け付けるようになるまで待ちます
+func waitForServer(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		resp, err := http.Get(tsURL + "/api/ping")
+		if err == nil {
+			resp.Body.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
 func TestTopページが200を返す(t *testing.T) {
 	resp, err := http.Get(tsURL + "/")
 	if err != nil {
@@ -87,7 +193,7 @@ func TestAPIがメッセージを全て返す(t *testing.T) {
 		t.Fatalf("failed to read http response, %s", err)
 	}
 
-	expected := `{"error":null,"result":[{"id":1,"body":"hoge"},{"id":2,"body":"fuga"},{"id":3,"body":"piyo"}]}`
+	expected := `{"error":null,"result":[{"id":1,"body":"hoge","username":"sampleuser","user_id":0,"channel_id":1,"parent_id":0,"reply_count":0,"reactions":{},"author_kind":"user","bot_name":"","chain_depth":0},{"id":2,"body":"fuga","username":"sampleuser","user_id":0,"channel_id":1,"parent_id":0,"reply_count":0,"reactions":{},"author_kind":"user","bot_name":"","chain_depth":0},{"id":3,"body":"piyo","username":"sampleuser","user_id":0,"channel_id":1,"parent_id":0,"reply_count":0,"reactions":{},"author_kind":"user","bot_name":"","chain_depth":0}]}`
 	// http responseの末尾に改行が含まれるので除去して比較します
 	actual := strings.TrimRight(string(b), "\n")
 	if actual != expected {
@@ -95,6 +201,71 @@ func TestAPIがメッセージを全て返す(t *testing.T) {
 	}
 }
 
+func TestAPIがメッセージをページングして返す(t *testing.T) {
+	cases := []struct {
+		query    string
+		expected string
+	}{
+		{
+			query:    "limit=2",
+			expected: `{"error":null,"result":[{"id":2,"body":"fuga","username":"sampleuser","user_id":0,"channel_id":1,"parent_id":0,"reply_count":0,"reactions":{},"author_kind":"user","bot_name":"","chain_depth":0},{"id":3,"body":"piyo","username":"sampleuser","user_id":0,"channel_id":1,"parent_id":0,"reply_count":0,"reactions":{},"author_kind":"user","bot_name":"","chain_depth":0}],"next_cursor":2}`,
+		},
+		{
+			query:    "limit=2&before=2",
+			expected: `{"error":null,"result":[{"id":1,"body":"hoge","username":"sampleuser","user_id":0,"channel_id":1,"parent_id":0,"reply_count":0,"reactions":{},"author_kind":"user","bot_name":"","chain_depth":0}]}`,
+		},
+		{
+			query:    "limit=1&after=1",
+			expected: `{"error":null,"result":[{"id":2,"body":"fuga","username":"sampleuser","user_id":0,"channel_id":1,"parent_id":0,"reply_count":0,"reactions":{},"author_kind":"user","bot_name":"","chain_depth":0}],"next_cursor":2}`,
+		},
+		{
+			query:    "username=nobody",
+			expected: `{"error":null,"result":[]}`,
+		},
+		{
+			query:    "since=2000-01-01T00:00:00Z&limit=1",
+			expected: `{"error":null,"result":[{"id":3,"body":"piyo","username":"sampleuser","user_id":0,"channel_id":1,"parent_id":0,"reply_count":0,"reactions":{},"author_kind":"user","bot_name":"","chain_depth":0}],"next_cursor":3}`,
+		},
+		{
+			query:    "since=2100-01-01T00:00:00Z",
+			expected: `{"error":null,"result":[]}`,
+		},
+	}
+
+	for _, tc := range cases {
+		resp, err := http.Get(tsURL + "/api/messages?" + tc.query)
+		if err != nil {
+			t.Fatalf("failed to get response: %s", err)
+		}
+		defer resp.Body.Close()
+
+		if expected := 200; resp.StatusCode != expected {
+			t.Fatalf("%s: status code expected %d but not, actual %d", tc.query, expected, resp.StatusCode)
+		}
+
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("failed to read http response, %s", err)
+		}
+
+		// http responseの末尾に改行が含まれるので除去して比較します
+		actual := strings.TrimRight(string(b), "\n")
+		if actual != tc.expected {
+			t.Fatalf("%s: response body expected %s, but %s", tc.query, tc.expected, string(b))
+		}
+	}
+
+	resp, err := http.Get(tsURL + "/api/messages?limit=foo")
+	if err != nil {
+		t.Fatalf("failed to get response: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if expected := 400; resp.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, resp.StatusCode)
+	}
+}
+
 func TestAPIが指定したIDのメッセージを返す(t *testing.T) {
 	resp, err := http.Get(tsURL + "/api/messages/1")
 	if err != nil {
@@ -115,7 +286,7 @@ func TestAPIが指定したIDのメッセージを返す(t *testing.T) {
 		t.Fatalf("failed to read http response, %s", err)
 	}
 
-	expected := `{"error":null,"result":{"id":1,"body":"hoge"}}`
+	expected := `{"error":null,"result":{"id":1,"body":"hoge","username":"sampleuser","user_id":0,"channel_id":1,"parent_id":0,"reply_count":0,"reactions":{},"author_kind":"user","bot_name":"","chain_depth":0}}`
 	// http responseの末尾に改行が含まれるので除去して比較します
 	actual := strings.TrimRight(string(b), "\n")
 	if actual != expected {
@@ -144,7 +315,7 @@ func TestAPIが新しいメッセージを作成する(t *testing.T) {
 		t.Fatalf("failed to read http response, %s", err)
 	}
 
-	expected := fmt.Sprintf(`{"error":null,"result":{"id":4,"body":"%s"}}`, tm)
+	expected := fmt.Sprintf(`{"error":null,"result":{"id":4,"body":"%s","username":"testuser","user_id":2,"channel_id":1,"parent_id":0,"reply_count":0,"reactions":{},"author_kind":"user","bot_name":"","chain_depth":0}}`, tm)
 	// http responseの末尾に改行が含まれるので除去して比較します
 	actual := strings.TrimRight(string(b), "\n")
 	if actual != expected {
@@ -173,14 +344,2049 @@ func TestHelloWorldBotが反応する(t *testing.T) {
 		t.Fatalf("failed to read http response, %s", err)
 	}
 
-	expected := `{"error":null,"result":{"id":6,"body":"hello, world!"}}`
+	expected := `{"error":null,"result":{"id":6,"body":"hello, world!","username":"bot","user_id":1,"channel_id":1,"parent_id":5,"reply_count":0,"reactions":{},"author_kind":"bot","bot_name":"helloworldbot","chain_depth":1}}`
+	// http responseの末尾に改行が含まれるので除去して比較します
+	actual := strings.TrimRight(string(b), "\n")
+	if actual != expected {
+		t.Fatalf("response body expected %s, but %s", expected, string(b))
+	}
+}
+
+func TestAPIが指定したIDのメッセージを更新する(t *testing.T) {
+	etag := getETag(t, tsURL+"/api/messages/1")
+
+	req, err := http.NewRequest(http.MethodPut, tsURL+"/api/messages/1", bytes.NewBuffer([]byte(`{"body": "updated"}`)))
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	req.Header.Set("If-Match", etag)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to put request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if expected := 200; resp.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, resp.StatusCode)
+	}
+
+	if resp.Header.Get("ETag") == etag {
+		t.Fatalf("ETag expected to be changed, but %s", etag)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read http response, %s", err)
+	}
+
+	expected := `{"error":null,"result":{"id":1,"body":"updated","username":"sampleuser","user_id":0,"channel_id":1,"parent_id":0,"reply_count":0,"reactions":{},"author_kind":"user","bot_name":"","chain_depth":0}}`
 	// http responseの末尾に改行が含まれるので除去して比較します
 	actual := strings.TrimRight(string(b), "\n")
 	if actual != expected {
 		t.Fatalf("response body expected %s, but %s", expected, string(b))
 	}
+
+	// 古いETagでは更新できない
+	req, err = http.NewRequest(http.MethodPut, tsURL+"/api/messages/1", bytes.NewBuffer([]byte(`{"body": "conflict"}`)))
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	req.Header.Set("If-Match", etag)
+	conflict, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to put request: %s", err)
+	}
+	defer conflict.Body.Close()
+
+	if expected := 412; conflict.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, conflict.StatusCode)
+	}
+}
+
+func TestAPIが指定したIDのメッセージを削除する(t *testing.T) {
+	// 古いETagでは削除できない
+	req, err := http.NewRequest(http.MethodDelete, tsURL+"/api/messages/2", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	req.Header.Set("If-Match", `"2-0"`)
+	conflict, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to delete request: %s", err)
+	}
+	defer conflict.Body.Close()
+
+	if expected := 412; conflict.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, conflict.StatusCode)
+	}
+
+	req, err = http.NewRequest(http.MethodDelete, tsURL+"/api/messages/2", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	req.Header.Set("If-Match", getETag(t, tsURL+"/api/messages/2"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to delete request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if expected := 200; resp.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, resp.StatusCode)
+	}
+
+	r, err := http.Get(tsURL + "/api/messages/2")
+	if err != nil {
+		t.Fatalf("failed to get response: %s", err)
+	}
+	defer r.Body.Close()
+
+	if expected := 404; r.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, r.StatusCode)
+	}
+}
+
+// getETag はurlにGETしてETagヘッダーを返します
+func getETag(t *testing.T, url string) string {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("failed to get response: %s", err)
+	}
+	defer resp.Body.Close()
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatalf("ETag header is missing: %s", url)
+	}
+	return etag
+}
+
+func TestStreamがメッセージの作成をWebSocketで配信する(t *testing.T) {
+	// last_idを指定すると、それより後に作成されたメッセージが先に配信される
+	conn, _, err := websocket.DefaultDialer.Dial("ws://localhost:"+port+"/api/stream?last_id=5", nil)
+	if err != nil {
+		t.Fatalf("failed to dial websocket: %s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, b, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read websocket frame: %s", err)
+	}
+	if expected := `{"type":"created","message":{"id":6,"body":"hello, world!","username":"bot","user_id":1,"channel_id":1,"parent_id":5,"reply_count":0,"reactions":{},"author_kind":"bot","bot_name":"helloworldbot","chain_depth":1}}`; strings.TrimRight(string(b), "\n") != expected {
+		t.Fatalf("frame expected %s, but %s", expected, string(b))
+	}
+
+	r, err := http.Post(tsURL+"/api/messages", "application/json", bytes.NewBuffer([]byte(`{"body": "streamed"}`)))
+	if err != nil {
+		t.Fatalf("failed to post request: %s", err)
+	}
+	defer r.Body.Close()
+
+	_, b, err = conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read websocket frame: %s", err)
+	}
+	if expected := `{"type":"created","message":{"id":7,"body":"streamed","username":"testuser","user_id":2,"channel_id":1,"parent_id":0,"reply_count":0,"reactions":{},"author_kind":"user","bot_name":"","chain_depth":0}}`; strings.TrimRight(string(b), "\n") != expected {
+		t.Fatalf("frame expected %s, but %s", expected, string(b))
+	}
+}
+
+func TestEventsがメッセージの作成をServerSentEventsで配信する(t *testing.T) {
+	// Last-Event-IDを指定すると、それより後に作成されたメッセージが先に配信される
+	req, err := http.NewRequest(http.MethodGet, tsURL+"/api/events", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	req.Header.Set("Last-Event-ID", "6")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to get response: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if expected := "text/event-stream"; resp.Header.Get("Content-Type") != expected {
+		t.Fatalf("response header expected %s but not, actual: %s", expected, resp.Header.Get("Content-Type"))
+	}
+
+	r := bufio.NewReader(resp.Body)
+	expected := "id:7\nevent:created\ndata:{\"id\":7,\"body\":\"streamed\",\"username\":\"testuser\",\"user_id\":2,\"channel_id\":1,\"parent_id\":0,\"reply_count\":0,\"reactions\":{},\"author_kind\":\"user\",\"bot_name\":\"\",\"chain_depth\":0}\n\n"
+	if actual := readSSEvent(t, r); actual != expected {
+		t.Fatalf("event expected %q, but %q", expected, actual)
+	}
+
+	p, err := http.Post(tsURL+"/api/messages", "application/json", bytes.NewBuffer([]byte(`{"body": "sent"}`)))
+	if err != nil {
+		t.Fatalf("failed to post request: %s", err)
+	}
+	defer p.Body.Close()
+
+	expected = "id:8\nevent:created\ndata:{\"id\":8,\"body\":\"sent\",\"username\":\"testuser\",\"user_id\":2,\"channel_id\":1,\"parent_id\":0,\"reply_count\":0,\"reactions\":{},\"author_kind\":\"user\",\"bot_name\":\"\",\"chain_depth\":0}\n\n"
+	if actual := readSSEvent(t, r); actual != expected {
+		t.Fatalf("event expected %q, but %q", expected, actual)
+	}
+}
+
+// readSSEvent はrから空行までの1つのeventを読み込みます
+func readSSEvent(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+
+	var event string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read event: %s", err)
+		}
+		event += line
+		if line == "\n" {
+			return event
+		}
+	}
+}
+
+func TestAPIがログインしていないユーザーの投稿を拒否する(t *testing.T) {
+	client := &http.Client{}
+	resp, err := client.Post(tsURL+"/api/messages", "application/json", bytes.NewBuffer([]byte(`{"body": "anonymous"}`)))
+	if err != nil {
+		t.Fatalf("failed to post request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if expected := 401; resp.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, resp.StatusCode)
+	}
+}
+
+func TestAPIが投稿者以外のユーザーによる削除を拒否する(t *testing.T) {
+	jar, err := newLoggedInJar("otheruser", "password")
+	if err != nil {
+		t.Fatalf("failed to sign up: %s", err)
+	}
+	client := &http.Client{Jar: jar}
+
+	// 管理者でないユーザーは、他のユーザーのメッセージを削除できない
+	req, err := http.NewRequest(http.MethodDelete, tsURL+"/api/messages/4", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("failed to delete request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if expected := 403; resp.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, resp.StatusCode)
+	}
+}
+
+func TestAPIが間違ったパスワードでのログインを拒否する(t *testing.T) {
+	client := &http.Client{}
+	resp, err := client.Post(tsURL+"/api/login", "application/json", bytes.NewBuffer([]byte(`{"name": "testuser", "password": "wrongpassword"}`)))
+	if err != nil {
+		t.Fatalf("failed to post request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if expected := 401; resp.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, resp.StatusCode)
+	}
+}
+
+func TestAPIがシステムユーザーの名前でのユーザー登録を拒否する(t *testing.T) {
+	expectStatus(t, http.MethodPost, tsURL+"/api/users", `{"name": "bot", "password": "password"}`, 400)
+}
+
+func TestAPIトークンのscopeで操作が制限される(t *testing.T) {
+	token := createToken(t, "read")
+
+	// readのトークンでは読み出しはできるが投稿はできない
+	req, err := http.NewRequest(http.MethodGet, tsURL+"/api/me", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token.Value)
+	resp, err := (&http.Client{}).Do(req)
+	if err != nil {
+		t.Fatalf("failed to get response: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if expected := 200; resp.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, resp.StatusCode)
+	}
+
+	req, err = http.NewRequest(http.MethodPost, tsURL+"/api/messages", bytes.NewBuffer([]byte(`{"body": "read only"}`)))
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token.Value)
+	forbidden, err := (&http.Client{}).Do(req)
+	if err != nil {
+		t.Fatalf("failed to post request: %s", err)
+	}
+	defer forbidden.Body.Close()
+
+	if expected := 403; forbidden.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, forbidden.StatusCode)
+	}
+
+	// 失効させたトークンは使えない
+	req, err = http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/api/tokens/%d", tsURL, token.ID), nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	revoked, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to delete request: %s", err)
+	}
+	defer revoked.Body.Close()
+
+	if expected := 200; revoked.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, revoked.StatusCode)
+	}
+
+	req, err = http.NewRequest(http.MethodGet, tsURL+"/api/me", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token.Value)
+	unauthorized, err := (&http.Client{}).Do(req)
+	if err != nil {
+		t.Fatalf("failed to get response: %s", err)
+	}
+	defer unauthorized.Body.Close()
+
+	if expected := 401; unauthorized.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, unauthorized.StatusCode)
+	}
+}
+
+func TestAPIが管理者でないユーザーにadminのトークンを作らせない(t *testing.T) {
+	jar, err := newLoggedInJar("tokenuser", "password")
+	if err != nil {
+		t.Fatalf("failed to sign up: %s", err)
+	}
+	client := &http.Client{Jar: jar}
+
+	// postToken はreqにAuthorizationヘッダーを付けてscopeのトークンの作成をリクエストし、ステータスコードを返します
+	postToken := func(client *http.Client, bearer, scope string) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, tsURL+"/api/tokens", bytes.NewBuffer([]byte(fmt.Sprintf(`{"name": "test", "scope": "%s"}`, scope))))
+		if err != nil {
+			t.Fatalf("failed to create request: %s", err)
+		}
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("failed to post request: %s", err)
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// 管理者でないユーザーもwriteまでのトークンは作れます
+	if expected, actual := 201, postToken(client, "", "write"); actual != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, actual)
+	}
+	if expected, actual := 403, postToken(client, "", "admin"); actual != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, actual)
+	}
+
+	// readのトークンでは、同じscopeのトークンも作れず、他のトークンも失効させられません
+	read := createToken(t, "read")
+	for _, scope := range []string{"write", "read"} {
+		if expected, actual := 403, postToken(&http.Client{}, read.Value, scope); actual != expected {
+			t.Fatalf("%s: status code expected %d but not, actual %d", scope, expected, actual)
+		}
+	}
+	other := createToken(t, "write")
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/api/tokens/%d", tsURL, other.ID), nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+read.Value)
+	resp, err := (&http.Client{}).Do(req)
+	if err != nil {
+		t.Fatalf("failed to delete request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if expected := 403; resp.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, resp.StatusCode)
+	}
 }
 
-func TestAPIが指定したIDのメッセージを更新する(t *testing.T) {}
+// createToken はログイン中のユーザーのscopeのAPIトークンを作成します
+func createToken(t *testing.T, scope string) *model.Token {
+	t.Helper()
+
+	body := fmt.Sprintf(`{"name": "test", "scope": "%s"}`, scope)
+	resp, err := http.Post(tsURL+"/api/tokens", "application/json", bytes.NewBuffer([]byte(body)))
+	if err != nil {
+		t.Fatalf("failed to post request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if expected := 201; resp.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, resp.StatusCode)
+	}
+
+	var r struct {
+		Result *model.Token `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	if !strings.HasPrefix(r.Result.Value, "vg1_") {
+		t.Fatalf("token value expected to start with vg1_, but %s", r.Result.Value)
+	}
+	return r.Result
+}
 
-func TestAPIが指定したIDのメッセージを削除する(t *testing.T) {}
+func TestBotがチャンネルで有効な場合だけ同じチャンネルに返信する(t *testing.T) {
+	resp, err := http.Post(tsURL+"/api/channels", "application/json", bytes.NewBuffer([]byte(`{"name": "random"}`)))
+	if err != nil {
+		t.Fatalf("failed to post request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if expected := 201; resp.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, resp.StatusCode)
+	}
+
+	var r struct {
+		Result *model.Channel `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	channelURL := fmt.Sprintf("%s/api/channels/%d", tsURL, r.Result.ID)
+
+	// botが有効になっていないチャンネルでは反応しない
+	postHello(t, channelURL+"/messages")
+	time.Sleep(200 * time.Millisecond)
+
+	// 管理者でないユーザーはbotを有効にも無効にもできない
+	jar, err := newLoggedInJar("channeluser", "password")
+	if err != nil {
+		t.Fatalf("failed to sign up: %s", err)
+	}
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		req, err := http.NewRequest(method, channelURL+"/bots/helloworldbot", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %s", err)
+		}
+		forbidden, err := (&http.Client{Jar: jar}).Do(req)
+		if err != nil {
+			t.Fatalf("failed to do request: %s", err)
+		}
+		forbidden.Body.Close()
+
+		if expected := 403; forbidden.StatusCode != expected {
+			t.Fatalf("%s: status code expected %d but not, actual %d", method, expected, forbidden.StatusCode)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPut, channelURL+"/bots/helloworldbot", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	enabled, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to put request: %s", err)
+	}
+	defer enabled.Body.Close()
+
+	if expected := 200; enabled.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, enabled.StatusCode)
+	}
+
+	postHello(t, channelURL+"/messages")
+
+	time.Sleep(1 * time.Second)
+	msgs, err := http.Get(channelURL + "/messages")
+	if err != nil {
+		t.Fatalf("failed to get response: %s", err)
+	}
+	defer msgs.Body.Close()
+
+	var page struct {
+		Result []*model.Message `json:"result"`
+	}
+	if err := json.NewDecoder(msgs.Body).Decode(&page); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+
+	var bodies []string
+	for _, m := range page.Result {
+		if m.ChannelID != r.Result.ID {
+			t.Fatalf("channel id expected %d, but %d", r.Result.ID, m.ChannelID)
+		}
+		bodies = append(bodies, m.Body)
+	}
+	if expected := "hello,hello,hello, world!"; strings.Join(bodies, ",") != expected {
+		t.Fatalf("messages expected %s, but %s", expected, strings.Join(bodies, ","))
+	}
+}
+
+// postHello はurlに"hello"を投稿します
+func postHello(t *testing.T, url string) {
+	t.Helper()
+
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer([]byte(`{"body": "hello"}`)))
+	if err != nil {
+		t.Fatalf("failed to post request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if expected := 201; resp.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, resp.StatusCode)
+	}
+}
+
+func TestAPIがスレッドの返信を返す(t *testing.T) {
+	root := postMessage(t, `{"body": "thread root"}`)
+	reply := postMessage(t, fmt.Sprintf(`{"body": "first reply", "parent_id": %d}`, root.ID))
+	// 返信への返信は先頭メッセージのスレッドにぶら下がる
+	nested := postMessage(t, fmt.Sprintf(`{"body": "second reply", "parent_id": %d}`, reply.ID))
+	if nested.ParentID != root.ID {
+		t.Fatalf("parent id expected %d, but %d", root.ID, nested.ParentID)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("%s/api/messages/%d/thread", tsURL, nested.ID))
+	if err != nil {
+		t.Fatalf("failed to get response: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if expected := 200; resp.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, resp.StatusCode)
+	}
+
+	var thread struct {
+		Result []*model.Message `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&thread); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+
+	var bodies []string
+	for _, m := range thread.Result {
+		bodies = append(bodies, m.Body)
+	}
+	if expected := "thread root,first reply,second reply"; strings.Join(bodies, ",") != expected {
+		t.Fatalf("messages expected %s, but %s", expected, strings.Join(bodies, ","))
+	}
+	if expected := 2; thread.Result[0].ReplyCount != expected {
+		t.Fatalf("reply count expected %d, but %d", expected, thread.Result[0].ReplyCount)
+	}
+
+	notFound, err := http.Post(tsURL+"/api/messages", "application/json", bytes.NewBuffer([]byte(`{"body": "orphan", "parent_id": 9999}`)))
+	if err != nil {
+		t.Fatalf("failed to post request: %s", err)
+	}
+	defer notFound.Body.Close()
+
+	if expected := 404; notFound.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, notFound.StatusCode)
+	}
+
+	// 先頭メッセージを削除すると返信も削除される
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/api/messages/%d", tsURL, root.ID), nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	deleted, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to delete request: %s", err)
+	}
+	defer deleted.Body.Close()
+
+	if expected := 200; deleted.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, deleted.StatusCode)
+	}
+
+	gone, err := http.Get(fmt.Sprintf("%s/api/messages/%d", tsURL, reply.ID))
+	if err != nil {
+		t.Fatalf("failed to get response: %s", err)
+	}
+	defer gone.Body.Close()
+
+	if expected := 404; gone.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, gone.StatusCode)
+	}
+}
+
+// postMessage はbodyを/api/messagesに投稿し、作成されたメッセージを返します
+func postMessage(t *testing.T, body string) *model.Message {
+	t.Helper()
+	return postMessageAs(t, http.DefaultClient, body)
+}
+
+// postMessageAs はclientのユーザーとしてbodyを/api/messagesに投稿し、作成されたメッセージを返します
+func postMessageAs(t *testing.T, client *http.Client, body string) *model.Message {
+	t.Helper()
+
+	resp, err := client.Post(tsURL+"/api/messages", "application/json", bytes.NewBuffer([]byte(body)))
+	if err != nil {
+		t.Fatalf("failed to post request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if expected := 201; resp.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, resp.StatusCode)
+	}
+
+	var r struct {
+		Result *model.Message `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	return r.Result
+}
+
+func TestAPIがメッセージを全文検索する(t *testing.T) {
+	postMessage(t, `{"body": "明日の天気は晴れのち雨です"}`)
+	second := postMessage(t, `{"body": "今日の天気は晴れです"}`)
+	postMessage(t, `{"body": "関係のないメッセージ"}`)
+	postMessage(t, `{"body": "<b>Qz</b>&xyzzy"}`)
+
+	cases := []struct {
+		query    string
+		snippets string
+	}{
+		// 3文字以上の語はtrigramの索引から探す
+		{query: "天気は晴れ", snippets: "今日の<mark>天気は晴れ</mark>です,明日の<mark>天気は晴れ</mark>のち雨です"},
+		// 3文字未満の語は新しい順に返す
+		{query: "天気", snippets: "今日の<mark>天気</mark>は晴れです,明日の<mark>天気</mark>は晴れのち雨です"},
+		{query: "晴れ 雨", snippets: "明日の天気は<mark>晴れ</mark>のち<mark>雨</mark>です"},
+		// 本文はHTMLエスケープし、英字の大文字と小文字を区別せずに囲む
+		{query: "xyzzy", snippets: "&lt;b&gt;Qz&lt;/b&gt;&amp;<mark>xyzzy</mark>"},
+		{query: "qz", snippets: "&lt;b&gt;<mark>Qz</mark>&lt;/b&gt;&amp;xyzzy"},
+	}
+	for _, tc := range cases {
+		page := searchMessages(t, url.Values{"q": {tc.query}})
+
+		var snippets []string
+		for _, r := range page.Result {
+			snippets = append(snippets, r.Snippet)
+		}
+		if strings.Join(snippets, ",") != tc.snippets {
+			t.Fatalf("q=%s: snippets expected %s, but %s", tc.query, tc.snippets, strings.Join(snippets, ","))
+		}
+	}
+
+	first := searchMessages(t, url.Values{"q": {"天気"}, "limit": {"1"}})
+	if len(first.Result) != 1 || first.Result[0].ID != second.ID {
+		t.Fatalf("limit=1: result expected id %d, but %v", second.ID, first.Result)
+	}
+	if first.NextCursor == nil || *first.NextCursor != 1 {
+		t.Fatalf("limit=1: next_cursor expected 1, but %v", first.NextCursor)
+	}
+	last := searchMessages(t, url.Values{"q": {"天気"}, "limit": {"1"}, "offset": {"1"}})
+	if len(last.Result) != 1 || last.NextCursor != nil {
+		t.Fatalf("offset=1: result expected last page, but %v, next_cursor %v", last.Result, last.NextCursor)
+	}
+}
+
+// searchMessages はparamsで/api/messages/searchを検索した結果を返します
+func searchMessages(t *testing.T, params url.Values) *struct {
+	Result     []*model.MessageSearchResult `json:"result"`
+	NextCursor *int64                       `json:"next_cursor"`
+} {
+	t.Helper()
+
+	resp, err := http.Get(tsURL + "/api/messages/search?" + params.Encode())
+	if err != nil {
+		t.Fatalf("failed to get response: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if expected := 200; resp.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, resp.StatusCode)
+	}
+
+	page := &struct {
+		Result     []*model.MessageSearchResult `json:"result"`
+		NextCursor *int64                       `json:"next_cursor"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(page); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	return page
+}
+
+func TestAPIがリアクションを集計してbotに通知する(t *testing.T) {
+	msg := postMessage(t, `{"body": "いいねしてね"}`)
+	reactionURL := fmt.Sprintf("%s/api/messages/%d/reactions/%s", tsURL, msg.ID, url.PathEscape("👍"))
+
+	clients := []*http.Client{http.DefaultClient}
+	for i := 0; i < 4; i++ {
+		jar, err := newLoggedInJar(fmt.Sprintf("reactor%d", i), "password")
+		if err != nil {
+			t.Fatalf("failed to sign up: %s", err)
+		}
+		clients = append(clients, &http.Client{Jar: jar})
+	}
+
+	// 同じユーザーが同じ絵文字で何度リアクションしても1つと数える
+	react(t, http.DefaultClient, http.MethodPost, reactionURL)
+	for i, client := range clients {
+		m := react(t, client, http.MethodPost, reactionURL)
+		if expected := i + 1; m.Reactions["👍"] != expected {
+			t.Fatalf("reactions expected %d, but %v", expected, m.Reactions)
+		}
+	}
+
+	m := react(t, http.DefaultClient, http.MethodDelete, reactionURL)
+	if expected := 4; m.Reactions["👍"] != expected {
+		t.Fatalf("reactions expected %d, but %v", expected, m.Reactions)
+	}
+
+	time.Sleep(1 * time.Second)
+	resp, err := http.Get(fmt.Sprintf("%s/api/messages/%d/thread", tsURL, msg.ID))
+	if err != nil {
+		t.Fatalf("failed to get response: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var thread struct {
+		Result []*model.Message `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&thread); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+
+	// 5個目の👍でreactionbotが返信する
+	var bodies []string
+	for _, m := range thread.Result {
+		bodies = append(bodies, m.Body)
+	}
+	if expected := "いいねしてね,👍が5個集まったパカ！"; strings.Join(bodies, ",") != expected {
+		t.Fatalf("messages expected %s, but %s", expected, strings.Join(bodies, ","))
+	}
+	if expected := 4; thread.Result[0].Reactions["👍"] != expected {
+		t.Fatalf("reactions expected %d, but %v", expected, thread.Result[0].Reactions)
+	}
+}
+
+// react はclientでurlのリアクションを付けるか取り消し、結果のメッセージを返します
+func react(t *testing.T, client *http.Client, method, url string) *model.Message {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("failed to request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if expected := 200; resp.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, resp.StatusCode)
+	}
+
+	var r struct {
+		Result *model.Message `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	return r.Result
+}
+
+func TestAPIがbotのキューの状態を返す(t *testing.T) {
+	resp, err := http.Get(tsURL + "/api/bots/queues")
+	if err != nil {
+		t.Fatalf("failed to get response: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if expected := 200; resp.StatusCode != expected {
+		t.Fatalf("status code expected %d but not, actual %d", expected, resp.StatusCode)
+	}
+
+	var r struct {
+		Result []*bot.QueueStats `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+
+	stats := map[string]*bot.QueueStats{}
+	for _, s := range r.Result {
+		stats[s.Bot] = s
+	}
+	if s := stats["helloworldbot"]; s == nil || s.Policy != bot.DropOldest || s.Size != bot.DefaultQueueConfig.Size || s.Dropped != 0 {
+		t.Fatalf("helloworldbot queue expected default config without drops, but %+v", s)
+	}
+	if s := stats["keywordbot"]; s == nil || s.Policy != bot.DropNewest || s.Size != 10 {
+		t.Fatalf("keywordbot queue expected drop_newest with size 10, but %+v", s)
+	}
+}
+
+func TestAPIが管理者でないユーザーにbotを操作させない(t *testing.T) {
+	jar, err := newLoggedInJar("botuser", "password")
+	if err != nil {
+		t.Fatalf("failed to sign up: %s", err)
+	}
+	client := &http.Client{Jar: jar}
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{http.MethodGet, "/api/bots", ""},
+		{http.MethodGet, "/api/bots/queues", ""},
+		{http.MethodPost, "/api/bots", `{"name": "intruder", "kind": "reply", "pattern": ".*", "reply": "hi"}`},
+		{http.MethodPost, "/api/bots/helloworldbot/pause", ""},
+		{http.MethodDelete, "/api/bots/helloworldbot", ""},
+	} {
+		req, err := http.NewRequest(tc.method, tsURL+tc.path, bytes.NewBuffer([]byte(tc.body)))
+		if err != nil {
+			t.Fatalf("failed to create request: %s", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("failed to do request: %s", err)
+		}
+		resp.Body.Close()
+
+		if expected := 403; resp.StatusCode != expected {
+			t.Fatalf("%s %s: status code expected %d but not, actual %d", tc.method, tc.path, expected, resp.StatusCode)
+		}
+	}
+}
+
+func TestAPIでbotを登録して一時停止と削除ができる(t *testing.T) {
+	spec := `{"name": "echobot", "kind": "reply", "pattern": "\\Aecho (.+)", "reply": "$1!"}`
+	expectStatus(t, http.MethodPost, tsURL+"/api/bots", spec, 201)
+	expectStatus(t, http.MethodPost, tsURL+"/api/bots", spec, 409)
+	expectStatus(t, http.MethodPost, tsURL+"/api/bots", `{"name": "brokenbot", "kind": "reply", "pattern": "("}`, 400)
+	expectStatus(t, http.MethodPut, tsURL+"/api/channels/1/bots/echobot", "", 200)
+
+	// botのreplyだけを返信のbodyとして集めます
+	replies := func(root *model.Message) string {
+		time.Sleep(500 * time.Millisecond)
+		resp, err := http.Get(fmt.Sprintf("%s/api/messages/%d/thread", tsURL, root.ID))
+		if err != nil {
+			t.Fatalf("failed to get response: %s", err)
+		}
+		defer resp.Body.Close()
+
+		var thread struct {
+			Result []*model.Message `json:"result"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&thread); err != nil {
+			t.Fatalf("failed to decode response: %s", err)
+		}
+		var bodies []string
+		for _, m := range thread.Result[1:] {
+			bodies = append(bodies, m.Body)
+		}
+		return strings.Join(bodies, ",")
+	}
+
+	if expected, actual := "yo!", replies(postMessage(t, `{"body": "echo yo"}`)); actual != expected {
+		t.Fatalf("replies expected %s, but %s", expected, actual)
+	}
+
+	expectStatus(t, http.MethodPost, tsURL+"/api/bots/echobot/pause", "", 200)
+	if expected, actual := "", replies(postMessage(t, `{"body": "echo paused"}`)); actual != expected {
+		t.Fatalf("replies expected none while paused, but %s", actual)
+	}
+
+	expectStatus(t, http.MethodPost, tsURL+"/api/bots/echobot/resume", "", 200)
+	if expected, actual := "resumed!", replies(postMessage(t, `{"body": "echo resumed"}`)); actual != expected {
+		t.Fatalf("replies expected %s, but %s", expected, actual)
+	}
+
+	expectStatus(t, http.MethodDelete, tsURL+"/api/bots/echobot", "", 200)
+	expectStatus(t, http.MethodDelete, tsURL+"/api/bots/echobot", "", 404)
+	if expected, actual := "", replies(postMessage(t, `{"body": "echo removed"}`)); actual != expected {
+		t.Fatalf("replies expected none after removal, but %s", actual)
+	}
+}
+
+// expectStatus はurlにmethodでbodyを送り、ステータスコードがexpectedであることを確認します
+func expectStatus(t *testing.T, method, url, body string, expected int) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, bytes.NewBuffer([]byte(body)))
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expected {
+		t.Fatalf("%s %s: status code expected %d but not, actual %d", method, url, expected, resp.StatusCode)
+	}
+}
+
+func TestBotsFileに定義したbotが書き換えると反映される(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"results": [{"reply": "%s"}]}`, r.URL.Query().Get("q"))
+	}))
+	defer api.Close()
+
+	writeBotsFile(t, fmt.Sprintf(`
+bots:
+  - name: gachabot
+    checker: {type: exact, pattern: gacha}
+    processor:
+      type: choice
+      choices:
+        - {text: SSR, weight: 1}
+        - {text: N, weight: 0}
+  - name: greetbot
+    checker: {type: regexp, pattern: '\A(おはよう)\z'}
+    processor: {type: template, template: "{{.Message.Username}}さん、{{.Text}}パカ"}
+  - name: apibot
+    checker: {type: prefix, pattern: "api "}
+    processor: {type: http, url: "%s?q={{urlquery .Text}}", result: results.0.reply, template: "APIは{{.Result}}と言っています"}
+`, api.URL))
+	waitForBots(t, "gachabot,greetbot,apibot")
+
+	for _, name := range []string{"gachabot", "greetbot", "apibot"} {
+		expectStatus(t, http.MethodPut, tsURL+"/api/channels/1/bots/"+name, "", 200)
+	}
+
+	cases := []struct {
+		body  string
+		reply string
+	}{
+		// weightを省略すると1なので、SSRとNが同じ確率で出ます
+		{body: "gacha", reply: "SSR|N"},
+		{body: "おはよう", reply: "testuserさん、おはようパカ"},
+		{body: "api hello", reply: "APIはhelloと言っています"},
+	}
+	for _, tc := range cases {
+		root := postMessage(t, fmt.Sprintf(`{"body": "%s"}`, tc.body))
+		if reply := waitForReply(t, root); !regexp.MustCompile(`\A(` + tc.reply + `)\z`).MatchString(reply) {
+			t.Fatalf("%s: reply expected %s, but %s", tc.body, tc.reply, reply)
+		}
+	}
+
+	// 定義が不正な場合は前回のbotを動かし続ける
+	writeBotsFile(t, `
+bots:
+  - name: gachabot
+    checker: {type: unknown, pattern: gacha}
+`)
+	time.Sleep(200 * time.Millisecond)
+	waitForBots(t, "gachabot,greetbot,apibot")
+
+	writeBotsFile(t, `
+bots:
+  - name: greetbot
+    checker: {type: exact, pattern: こんばんは}
+    processor: {type: template, template: "{{.Text}}パカ"}
+`)
+	waitForBots(t, "greetbot")
+
+	root := postMessage(t, `{"body": "こんばんは"}`)
+	if expected, reply := "こんばんはパカ", waitForReply(t, root); reply != expected {
+		t.Fatalf("reply expected %s, but %s", expected, reply)
+	}
+}
+
+func TestBotsFileやscriptsから消してもAPIで登録し直した同じ名前のbotは残る(t *testing.T) {
+	writeBotsFile(t, `
+bots:
+  - name: samebot
+    checker: {type: exact, pattern: same}
+    processor: {type: template, template: "file"}
+`)
+	writeScript(t, "samejsbot", `exports.check = function(msg) { return msg.body === "samejs"; };
+exports.process = function(msg) { return "script"; };
+`)
+	waitForBots(t, "samebot,samejsbot")
+
+	// ファイルから登録されたbotをAPIで消して、同じ名前で登録し直します
+	for _, name := range []string{"samebot", "samejsbot"} {
+		expectStatus(t, http.MethodDelete, tsURL+"/api/bots/"+name, "", 200)
+		expectStatus(t, http.MethodPost, tsURL+"/api/bots", fmt.Sprintf(`{"name": "%s", "kind": "reply", "pattern": "\\Aapi\\z", "reply": "api"}`, name), 201)
+	}
+
+	writeBotsFile(t, "")
+	if err := os.Remove(filepath.Join(scriptsDir, "samejsbot.js")); err != nil {
+		t.Fatalf("failed to remove script: %s", err)
+	}
+	// 読み込み直すまで待ってから、APIで登録したbotが残っていることを確かめます
+	time.Sleep(300 * time.Millisecond)
+	waitForBots(t, "samebot,samejsbot")
+
+	for _, name := range []string{"samebot", "samejsbot"} {
+		expectStatus(t, http.MethodDelete, tsURL+"/api/bots/"+name, "", 200)
+	}
+	waitForBots(t, "")
+}
+
+func TestBotsFileやscriptsのbotは同じ名前のbotが消えると登録し直される(t *testing.T) {
+	// 先にAPIで同じ名前のbotを登録しておくと、ファイルのbotは登録できません
+	for _, name := range []string{"pendingbot", "pendingjsbot"} {
+		expectStatus(t, http.MethodPost, tsURL+"/api/bots", fmt.Sprintf(`{"name": "%s", "kind": "reply", "pattern": "\\Aapi\\z", "reply": "api"}`, name), 201)
+	}
+	writeBotsFile(t, `
+bots:
+  - name: pendingbot
+    checker: {type: exact, pattern: pending}
+    processor: {type: template, template: "file"}
+`)
+	writeScript(t, "pendingjsbot", `exports.check = function(msg) { return msg.body === "pendingjs"; };
+exports.process = function(msg) { return "script"; };
+`)
+	time.Sleep(300 * time.Millisecond)
+
+	// ファイルを書き換えなくても、APIのbotが消えるとファイルのbotを登録します
+	for _, name := range []string{"pendingbot", "pendingjsbot"} {
+		expectStatus(t, http.MethodDelete, tsURL+"/api/bots/"+name, "", 200)
+	}
+	waitForBots(t, "pendingbot,pendingjsbot")
+	for _, name := range []string{"pendingbot", "pendingjsbot"} {
+		expectStatus(t, http.MethodPut, tsURL+"/api/channels/1/bots/"+name, "", 200)
+	}
+	for body, expected := range map[string]string{"pending": "file", "pendingjs": "script"} {
+		root := postMessage(t, fmt.Sprintf(`{"body": "%s"}`, body))
+		if reply := waitForReply(t, root); reply != expected {
+			t.Fatalf("%s: reply expected %s, but %s", body, expected, reply)
+		}
+	}
+
+	writeBotsFile(t, "")
+	if err := os.Remove(filepath.Join(scriptsDir, "pendingjsbot.js")); err != nil {
+		t.Fatalf("failed to remove script: %s", err)
+	}
+	waitForBots(t, "")
+}
+
+// writeBotsFile はbotの定義ファイルをcontentで書き換えます
+func writeBotsFile(t *testing.T, content string) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(botsFile, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write bots file: %s", err)
+	}
+}
+
+// waitForBots は組み込みのbot以外に登録されているbotの名前がnamesになるまで待ちます
+func waitForBots(t *testing.T, names string) {
+	t.Helper()
+
+	builtin := map[string]bool{"helloworldbot": true, "omikujibot": true, "keywordbot": true, "reactionbot": true, "commandbot": true}
+	var actual string
+	for deadline := time.Now().Add(waitTimeout); time.Now().Before(deadline); time.Sleep(pollInterval) {
+		resp, err := http.Get(tsURL + "/api/bots")
+		if err != nil {
+			t.Fatalf("failed to get response: %s", err)
+		}
+		var r struct {
+			Result []bot.BotStatus `json:"result"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&r)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("failed to decode response: %s", err)
+		}
+
+		var bots []string
+		for _, b := range r.Result {
+			if !builtin[b.Name] {
+				bots = append(bots, b.Name)
+			}
+		}
+		sort.Strings(bots)
+		actual = strings.Join(bots, ",")
+
+		expected := strings.Split(names, ",")
+		sort.Strings(expected)
+		if actual == strings.Join(expected, ",") {
+			return
+		}
+	}
+	t.Fatalf("bots expected %s, but %s", names, actual)
+}
+
+// waitForReply はrootへのbotの返信を待って、その本文を返します
+func waitForReply(t *testing.T, root *model.Message) string {
+	t.Helper()
+
+	for deadline := time.Now().Add(waitTimeout); time.Now().Before(deadline); time.Sleep(pollInterval) {
+		if thread := getThread(t, root); len(thread) > 1 {
+			return thread[1].Body
+		}
+	}
+	t.Fatalf("no reply to %q", root.Body)
+	return ""
+}
+
+// getThread はrootのスレッドのメッセージを返します
+func getThread(t *testing.T, root *model.Message) []*model.Message {
+	t.Helper()
+
+	resp, err := http.Get(fmt.Sprintf("%s/api/messages/%d/thread", tsURL, root.ID))
+	if err != nil {
+		t.Fatalf("failed to get response: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var thread struct {
+		Result []*model.Message `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&thread); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	return thread.Result
+}
+
+func TestExecProcessorのプラグインが返信して落ちたら再起動される(t *testing.T) {
+	writeBotsFile(t, fmt.Sprintf(`
+bots:
+  - name: pluginbot
+    checker: {type: prefix, pattern: "plugin "}
+    processor:
+      type: exec
+      command: %s
+      env: {BOT_PLUGIN: "1"}
+      timeout: 300ms
+`, os.Args[0]))
+	waitForBots(t, "pluginbot")
+	expectStatus(t, http.MethodPut, tsURL+"/api/channels/1/bots/pluginbot", "", 200)
+
+	cases := []struct {
+		body  string
+		reply string
+	}{
+		{body: "plugin hello", reply: "plugin: hello"},
+		// 返信を待ちきれなかった場合と、返信の前に終了した場合はエラーの返信をします
+		{body: "plugin slow", reply: "気が乗らないパカ"},
+		{body: "plugin crash", reply: "気が乗らないパカ"},
+	}
+	for _, tc := range cases {
+		root := postMessage(t, fmt.Sprintf(`{"body": "%s"}`, tc.body))
+		if reply := waitForReply(t, root); reply != tc.reply {
+			t.Fatalf("%s: reply expected %s, but %s", tc.body, tc.reply, reply)
+		}
+	}
+
+	// 再起動を待ちます
+	time.Sleep(1500 * time.Millisecond)
+	root := postMessage(t, `{"body": "plugin again"}`)
+	if expected, reply := "plugin: again", waitForReply(t, root); reply != expected {
+		t.Fatalf("reply expected %s, but %s", expected, reply)
+	}
+
+	writeBotsFile(t, "")
+	waitForBots(t, "")
+}
+
+// runBotPlugin はExecProcessorのプラグインとして、標準入出力でリクエストに返信します
+func runBotPlugin() int {
+	scanner := bufio.NewScanner(os.Stdin)
+	enc := json.NewEncoder(os.Stdout)
+	for scanner.Scan() {
+		var req bot.ExecRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		text := strings.TrimPrefix(req.Message.Body, "plugin ")
+		switch text {
+		case "crash":
+			return 1
+		case "slow":
+			time.Sleep(time.Second)
+		}
+		enc.Encode(&bot.ExecResponse{ID: req.ID, Message: &model.Message{Body: "plugin: " + text}})
+	}
+	return 0
+}
+
+func TestJavaScriptのbotがscriptsに置くと動いて書き換えると反映される(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"text": "hello, %s"}`, r.Header.Get("X-Name"))
+	}))
+	defer api.Close()
+
+	writeScript(t, "jsbot", fmt.Sprintf(`
+var api = %q;
+
+function check(msg) {
+  return msg.body.indexOf("js ") === 0;
+}
+
+function process(msg) {
+  var arg = msg.body.slice(3);
+  switch (arg) {
+  case "loop":
+    while (true) {}
+  case "fetch":
+    return fetch(api, {headers: {"X-Name": msg.username}}).json().text;
+  case "denied":
+    try {
+      fetch("http://example.com/");
+    } catch (e) {
+      return "denied";
+    }
+  case "sandbox":
+    return [typeof require, typeof setTimeout].join(",");
+  }
+  return {body: "js: " + arg};
+}
+`, api.URL))
+	waitForBots(t, "jsbot")
+	expectStatus(t, http.MethodPut, tsURL+"/api/channels/1/bots/jsbot", "", 200)
+
+	cases := []struct {
+		body  string
+		reply string
+	}{
+		{body: "js hello", reply: "js: hello"},
+		{body: "js fetch", reply: "hello, testuser"},
+		// 許可していないホストにはアクセスできません
+		{body: "js denied", reply: "denied"},
+		{body: "js sandbox", reply: "undefined,undefined"},
+		// 実行時間の上限を超えた場合はエラーの返信をします
+		{body: "js loop", reply: "気が乗らないパカ"},
+	}
+	for _, tc := range cases {
+		root := postMessage(t, fmt.Sprintf(`{"body": "%s"}`, tc.body))
+		if reply := waitForReply(t, root); reply != tc.reply {
+			t.Fatalf("%s: reply expected %s, but %s", tc.body, tc.reply, reply)
+		}
+	}
+
+	writeScript(t, "jsbot", `
+exports.check = function(msg) { return msg.body.indexOf("js ") === 0; };
+exports.process = function(msg) { return "js2: " + msg.body.slice(3); };
+`)
+	time.Sleep(300 * time.Millisecond)
+	root := postMessage(t, `{"body": "js hello"}`)
+	if expected, reply := "js2: hello", waitForReply(t, root); reply != expected {
+		t.Fatalf("reply expected %s, but %s", expected, reply)
+	}
+
+	// 読み込めないスクリプトに書き換えた場合は前のbotが動き続けます
+	writeScript(t, "jsbot", `function (`)
+	time.Sleep(300 * time.Millisecond)
+	root = postMessage(t, `{"body": "js hello"}`)
+	if expected, reply := "js2: hello", waitForReply(t, root); reply != expected {
+		t.Fatalf("reply expected %s, but %s", expected, reply)
+	}
+
+	if err := os.Remove(filepath.Join(scriptsDir, "jsbot.js")); err != nil {
+		t.Fatalf("failed to remove script: %s", err)
+	}
+	waitForBots(t, "")
+}
+
+// writeScript はscriptsDirのnameのbotのスクリプトをcontentで書き換えます
+func writeScript(t *testing.T, name, content string) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(filepath.Join(scriptsDir, name+".js"), []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write script: %s", err)
+	}
+}
+
+func TestBotが自分の投稿に反応せずbot同士の返信の連鎖が止まる(t *testing.T) {
+	writeBotsFile(t, `
+bots:
+  - name: pingbot
+    checker: {type: exact, pattern: "ping"}
+    processor: {type: template, template: "pong"}
+  - name: pongbot
+    checker: {type: exact, pattern: "pong"}
+    processor: {type: template, template: "ping"}
+  - name: selfbot
+    checker: {type: prefix, pattern: "self"}
+    processor: {type: template, template: "self again"}
+`)
+	waitForBots(t, "pingbot,pongbot,selfbot")
+	for _, name := range []string{"pingbot", "pongbot", "selfbot"} {
+		expectStatus(t, http.MethodPut, tsURL+"/api/channels/1/bots/"+name, "", 200)
+	}
+
+	// ユーザーはbotの投稿を装えません
+	m := postMessage(t, `{"body": "ping", "author_kind": "bot", "bot_name": "pongbot", "chain_depth": 5}`)
+	if m.AuthorKind != model.AuthorUser || m.BotName != "" || m.ChainDepth != 0 {
+		t.Fatalf("author expected user, but %s %q %d", m.AuthorKind, m.BotName, m.ChainDepth)
+	}
+
+	cases := []struct {
+		body     string
+		expected string
+	}{
+		// pingbotとpongbotはMaxChainDepthの3回まで返信し合います
+		{body: "ping", expected: "ping/user//0,pong/bot/pingbot/1,ping/bot/pongbot/2,pong/bot/pingbot/3"},
+		// selfbotは自分の返信には反応しません
+		{body: "self", expected: "self/user//0,self again/bot/selfbot/1"},
+	}
+	for _, tc := range cases {
+		root := postMessage(t, fmt.Sprintf(`{"body": "%s"}`, tc.body))
+		n := len(strings.Split(tc.expected, ","))
+		for deadline := time.Now().Add(waitTimeout); len(getThread(t, root)) < n && time.Now().Before(deadline); {
+			time.Sleep(pollInterval)
+		}
+		// 連鎖が止まったことを確かめるために、しばらく待ちます
+		time.Sleep(500 * time.Millisecond)
+
+		var actual []string
+		for _, m := range getThread(t, root) {
+			actual = append(actual, fmt.Sprintf("%s/%s/%s/%d", m.Body, m.AuthorKind, m.BotName, m.ChainDepth))
+		}
+		if strings.Join(actual, ",") != tc.expected {
+			t.Fatalf("thread expected %s, but %s", tc.expected, strings.Join(actual, ","))
+		}
+	}
+
+	writeBotsFile(t, "")
+	waitForBots(t, "")
+}
+
+func TestBotのキューが一杯で待っていても投稿がすぐに返る(t *testing.T) {
+	release := make(chan struct{})
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// テストが終わるまで返しません
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		fmt.Fprint(w, `{"text": "ok"}`)
+	}))
+	defer api.Close()
+	defer close(release)
+
+	writeBotsFile(t, fmt.Sprintf(`
+bots:
+  - name: blockbot
+    checker: {type: prefix, pattern: "block "}
+    processor: {type: http, url: "%s", result: text}
+    timeout: 30s
+`, api.URL))
+	defer func() {
+		writeBotsFile(t, "")
+		waitForBots(t, "")
+	}()
+	waitForBots(t, "blockbot")
+
+	expectStatus(t, http.MethodPut, tsURL+"/api/channels/1/bots/blockbot", "", 200)
+	defer expectStatus(t, http.MethodDelete, tsURL+"/api/channels/1/bots/blockbot", "", 200)
+
+	// 1つ目はbotが処理したまま返らず、2つ目でキューが一杯になり、それ以降はキューの空きを待ちます
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		postMessage(t, fmt.Sprintf(`{"body": "block %d"}`, i))
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("post %d expected to return promptly, but took %s", i, elapsed)
+		}
+	}
+}
+
+func TestHTTPPosterがAPIにPOSTして投稿する(t *testing.T) {
+	token := createToken(t, "write")
+	root := postMessage(t, `{"body": "remote worker"}`)
+
+	// サーバーとは別のプロセスで動くbotと同じように、APIトークンでPOSTします
+	poster := bot.NewHTTPPoster(1, tsURL)
+	poster.Header.Set("Authorization", "Bearer "+token.Value)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go poster.Run(ctx)
+
+	poster.In <- &model.Message{Body: "posted remotely", ParentID: root.ID}
+	if expected, reply := "posted remotely", waitForReply(t, root); reply != expected {
+		t.Fatalf("reply expected %s, but %s", expected, reply)
+	}
+}
+
+func TestBotの返信がtimeoutを過ぎると打ち切られる(t *testing.T) {
+	cancelled := make(chan struct{})
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hang" {
+			// botがリクエストを中断するまで返しません
+			<-r.Context().Done()
+			close(cancelled)
+			return
+		}
+		fmt.Fprint(w, `{"text": "ok"}`)
+	}))
+	defer api.Close()
+
+	writeBotsFile(t, fmt.Sprintf(`
+bots:
+  - name: hangbot
+    checker: {type: prefix, pattern: "hang "}
+    processor: {type: http, url: "%s/{{.Text}}", result: text}
+    timeout: 200ms
+`, api.URL))
+	waitForBots(t, "hangbot")
+	expectStatus(t, http.MethodPut, tsURL+"/api/channels/1/bots/hangbot", "", 200)
+
+	root := postMessage(t, `{"body": "hang hang"}`)
+	if expected, reply := "気が乗らないパカ", waitForReply(t, root); reply != expected {
+		t.Fatalf("reply expected %s, but %s", expected, reply)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("request to api was not cancelled")
+	}
+
+	// 打ち切った後も次のメッセージに反応します
+	root = postMessage(t, `{"body": "hang fast"}`)
+	if expected, reply := "ok", waitForReply(t, root); reply != expected {
+		t.Fatalf("reply expected %s, but %s", expected, reply)
+	}
+
+	writeBotsFile(t, "")
+	waitForBots(t, "")
+}
+
+func TestBotが複数の返信や遅れた返信をしてエラーの扱いを設定できる(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer api.Close()
+
+	writeScript(t, "multibot", `
+exports.check = function(msg) { return msg.body.indexOf("multi ") === 0; };
+exports.process = function(msg) {
+  if (msg.body === "multi quiet") {
+    return [];
+  }
+  if (msg.body === "multi elsewhere") {
+    return {body: "here", channel_id: 2, parent_id: 1};
+  }
+  return ["one", {body: "two", delay: 300}];
+};
+`)
+	writeBotsFile(t, fmt.Sprintf(`
+bots:
+  - name: customerrorbot
+    checker: {type: exact, pattern: "custom error"}
+    processor: {type: http, url: "%s"}
+    on_error: {reply: "APIが落ちてるパカ"}
+  - name: suppressedbot
+    checker: {type: exact, pattern: "suppressed error"}
+    processor: {type: http, url: "%s"}
+    on_error: {suppress: true}
+`, api.URL, api.URL))
+	waitForBots(t, "customerrorbot,multibot,suppressedbot")
+	for _, name := range []string{"customerrorbot", "multibot", "suppressedbot"} {
+		expectStatus(t, http.MethodPut, tsURL+"/api/channels/1/bots/"+name, "", 200)
+	}
+
+	// 遅れて投稿する返信は、すぐに投稿する返信の後に届きます
+	root := postMessage(t, `{"body": "multi reply"}`)
+	if expected, reply := "one", waitForReply(t, root); reply != expected {
+		t.Fatalf("reply expected %s, but %s", expected, reply)
+	}
+	if n := len(getThread(t, root)); n != 2 {
+		t.Fatalf("delayed reply expected not to be posted yet, but thread has %d messages", n)
+	}
+	time.Sleep(500 * time.Millisecond)
+	var bodies []string
+	for _, m := range getThread(t, root) {
+		bodies = append(bodies, m.Body)
+	}
+	if expected, actual := "multi reply,one,two", strings.Join(bodies, ","); actual != expected {
+		t.Fatalf("thread expected %s, but %s", expected, actual)
+	}
+
+	// スクリプトが返信先を指定しても、反応したメッセージのスレッドに投稿します
+	root = postMessage(t, `{"body": "multi elsewhere"}`)
+	if expected, reply := "here", waitForReply(t, root); reply != expected {
+		t.Fatalf("reply expected %s, but %s", expected, reply)
+	}
+
+	root = postMessage(t, `{"body": "custom error"}`)
+	if expected, reply := "APIが落ちてるパカ", waitForReply(t, root); reply != expected {
+		t.Fatalf("reply expected %s, but %s", expected, reply)
+	}
+
+	// 返信しないbotは、しばらく待ってもスレッドに何も投稿しません
+	for _, body := range []string{"multi quiet", "suppressed error"} {
+		root = postMessage(t, fmt.Sprintf(`{"body": "%s"}`, body))
+		time.Sleep(300 * time.Millisecond)
+		if n := len(getThread(t, root)); n != 1 {
+			t.Fatalf("%s: no reply expected, but thread has %d messages", body, n)
+		}
+	}
+
+	if err := os.Remove(filepath.Join(scriptsDir, "multibot.js")); err != nil {
+		t.Fatalf("failed to remove script: %s", err)
+	}
+	writeBotsFile(t, "")
+	waitForBots(t, "")
+}
+
+func TestCheckerを組み合わせて反応するメッセージを絞り込める(t *testing.T) {
+	now := time.Now()
+	// cooldownの時間が過ぎるかどうかはbot/checker_test.goで確かめるので、ここではテスト中に過ぎない長さにします
+	writeBotsFile(t, fmt.Sprintf(`
+bots:
+  - name: rollbot
+    checker:
+      and:
+        - {type: command, pattern: "!roll"}
+        - {type: author_kind, kind: user}
+        - {type: cooldown, duration: 1h}
+    processor: {type: template, template: "rolled {{.Text}}"}
+  - name: alwaysbot
+    checker:
+      and:
+        - {type: exact, pattern: "always"}
+        - {type: probability, probability: 1}
+        - {type: time_window, start: "%s", end: "%s"}
+        - {type: channel, channels: [1]}
+        - {type: username, usernames: [testuser]}
+    processor: {type: template, template: "always reply"}
+  - name: neverbot
+    checker:
+      or:
+        - and: [{type: exact, pattern: "never"}, {type: probability, probability: 0}]
+        - and: [{type: exact, pattern: "never"}, {type: time_window, start: "%s", end: "%s"}]
+        - and: [{type: exact, pattern: "never"}, {not: {type: author_kind, kind: bot}}, {type: username, usernames: [nobody]}]
+        - {type: exact, pattern: "sometimes"}
+    processor: {type: template, template: "sometimes reply"}
+`, now.Add(-time.Hour).Format("15:04"), now.Add(time.Hour).Format("15:04"),
+		now.Add(time.Hour).Format("15:04"), now.Add(2*time.Hour).Format("15:04")))
+	defer func() {
+		writeBotsFile(t, "")
+		waitForBots(t, "")
+	}()
+	waitForBots(t, "alwaysbot,neverbot,rollbot")
+	for _, name := range []string{"alwaysbot", "neverbot", "rollbot"} {
+		expectStatus(t, http.MethodPut, tsURL+"/api/channels/1/bots/"+name, "", 200)
+		defer expectStatus(t, http.MethodDelete, tsURL+"/api/channels/1/bots/"+name, "", 200)
+	}
+
+	root := postMessage(t, `{"body": "!roll 2d6"}`)
+	if expected, reply := "rolled 2d6", waitForReply(t, root); reply != expected {
+		t.Fatalf("reply expected %s, but %s", expected, reply)
+	}
+	root = postMessage(t, `{"body": "always"}`)
+	if expected, reply := "always reply", waitForReply(t, root); reply != expected {
+		t.Fatalf("reply expected %s, but %s", expected, reply)
+	}
+
+	// cooldown中のユーザー、コマンドの続きが空白でないメッセージ、条件を満たさないメッセージには返信しません
+	var ignored []*model.Message
+	for _, body := range []string{"!roll 3d6", "!rollx", "never"} {
+		ignored = append(ignored, postMessage(t, fmt.Sprintf(`{"body": "%s"}`, body)))
+	}
+
+	// botはeventを順番に処理して、返信も順番に投稿されるので、後のメッセージに返信した時には前のメッセージの処理は終わっています。
+	// cooldownは他のユーザーには影響しません
+	jar, err := newLoggedInJar("roller", "password")
+	if err != nil {
+		t.Fatalf("failed to sign up: %s", err)
+	}
+	root = postMessageAs(t, &http.Client{Jar: jar}, `{"body": "!roll 1d20"}`)
+	if expected, reply := "rolled 1d20", waitForReply(t, root); reply != expected {
+		t.Fatalf("reply expected %s, but %s", expected, reply)
+	}
+	root = postMessage(t, `{"body": "sometimes"}`)
+	if expected, reply := "sometimes reply", waitForReply(t, root); reply != expected {
+		t.Fatalf("reply expected %s, but %s", expected, reply)
+	}
+
+	for _, m := range ignored {
+		if n := len(getThread(t, m)); n != 1 {
+			t.Fatalf("%s: no reply expected, but thread has %d messages", m.Body, n)
+		}
+	}
+}
+
+func TestCommandBotがコマンドに返信してhelpで一覧を返す(t *testing.T) {
+	cases := []struct {
+		body     string
+		expected string
+	}{
+		{body: "/help", expected: "コマンド一覧\n" +
+			"/help [command] コマンドの一覧か、コマンドの使い方を表示します\n" +
+			"/omikuji おみくじを引きます\n" +
+			"/keyword <text...> 文章からキーワードを抽出します\n" +
+			"/dice <式> サイコロを振ります。式は2d6+3のように書きます"},
+		{body: "/help dice", expected: "/dice <式>\nサイコロを振ります。式は2d6+3のように書きます"},
+		{body: "/help nothing", expected: "/nothingというコマンドはないパカ\n使い方: /help [command]"},
+		{body: "/dice 3d1+2", expected: "3d1+2 = 5 (1+1+1+2)"},
+		{body: "/dice", expected: "式を指定してほしいパカ\n使い方: /dice <式>"},
+		{body: "/dice 2d6 2d6", expected: "引数が多すぎるパカ: 2d6\n使い方: /dice <式>"},
+		{body: "/dice x", expected: "サイコロの式が読めないパカ: x\n使い方: /dice <式>"},
+	}
+	for _, tc := range cases {
+		root := postMessage(t, fmt.Sprintf(`{"body": %q}`, tc.body))
+		if reply := waitForReply(t, root); reply != tc.expected {
+			t.Fatalf("%s: reply expected %q, but %q", tc.body, tc.expected, reply)
+		}
+	}
+
+	// 登録されていないコマンドには返信しません
+	root := postMessage(t, `{"body": "/nothing"}`)
+	time.Sleep(300 * time.Millisecond)
+	if n := len(getThread(t, root)); n != 1 {
+		t.Fatalf("no reply expected, but thread has %d messages", n)
+	}
+}
+
+func TestCommandRouterが引数とサブコマンドを読んで振り分ける(t *testing.T) {
+	router := bot.NewCommandRouter("!")
+	router.Handle(&bot.Command{
+		Name: "echo",
+		Args: []bot.Arg{{Name: "text"}, {Name: "times", Type: bot.ArgInt, Optional: true}},
+		Handler: func(ctx context.Context, m *model.Message, args bot.Args) (*model.Message, error) {
+			times := 1
+			if args.Has("times") {
+				times = args.Int("times")
+			}
+			if times < 1 {
+				return nil, bot.Usagef("timesは1以上にしてほしいパカ")
+			}
+			return &model.Message{Body: strings.TrimSpace(strings.Repeat(args.String("text")+" ", times))}, nil
+		},
+	})
+	router.Handle(&bot.Command{
+		Name: "remind",
+		Subcommands: []*bot.Command{
+			{
+				Name: "add",
+				Args: []bot.Arg{{Name: "minutes", Type: bot.ArgFloat}, {Name: "text", Type: bot.ArgRest}},
+				Handler: func(ctx context.Context, m *model.Message, args bot.Args) (*model.Message, error) {
+					return &model.Message{Body: fmt.Sprintf("%v分後: %s", args.Float("minutes"), args.String("text"))}, nil
+				},
+			},
+			{
+				Name: "list",
+				Handler: func(ctx context.Context, m *model.Message, args bot.Args) (*model.Message, error) {
+					return &model.Message{Body: "なし"}, nil
+				},
+			},
+		},
+	})
+	if err := router.Handle(&bot.Command{Name: "echo"}); err != bot.ErrCommandExists {
+		t.Fatalf("error expected %s, but %v", bot.ErrCommandExists, err)
+	}
+
+	cases := []struct {
+		body     string
+		checked  bool
+		expected string
+	}{
+		{body: `!echo "hello world" 2`, checked: true, expected: "hello world hello world"},
+		{body: `!echo 'say "hi"'`, checked: true, expected: `say "hi"`},
+		{body: `!echo a\ b`, checked: true, expected: "a b"},
+		{body: `!echo hi two`, checked: true, expected: "timesは整数で指定してほしいパカ: two\n使い方: !echo <text> [times]"},
+		{body: `!echo hi 0`, checked: true, expected: "timesは1以上にしてほしいパカ\n使い方: !echo <text> [times]"},
+		{body: `!echo "hi`, checked: true, expected: `"が閉じていないパカ`},
+		{body: `!remind add 1.5 牛乳を 買う`, checked: true, expected: "1.5分後: 牛乳を 買う"},
+		{body: `!remind list`, checked: true, expected: "なし"},
+		{body: `!remind`, checked: true, expected: "サブコマンドを指定してほしいパカ\n使い方: !remind <add|list>"},
+		{body: `!remind add soon`, checked: true, expected: "minutesは数で指定してほしいパカ: soon\n使い方: !remind add <minutes> <text...>"},
+		{body: `!help remind`, checked: true, expected: "!remind <add|list>\n!remind add <minutes> <text...>\n!remind list"},
+		{body: `!echoes hi`, checked: false},
+		{body: `/echo hi`, checked: false},
+	}
+	for _, tc := range cases {
+		m := &model.Message{Body: tc.body}
+		if checked := router.Check(m); checked != tc.checked {
+			t.Fatalf("%s: check expected %v, but %v", tc.body, tc.checked, checked)
+		}
+		if !tc.checked {
+			continue
+		}
+		reply, err := router.Process(context.Background(), m)
+		if err != nil {
+			t.Fatalf("%s: failed to process: %s", tc.body, err)
+		}
+		if reply.Body != tc.expected {
+			t.Fatalf("%s: reply expected %q, but %q", tc.body, tc.expected, reply.Body)
+		}
+	}
+}
+
+func TestKeywordBotがメッセージの履歴でキーワードを順位付けする(t *testing.T) {
+	// 多くのメッセージに出てくる語ほど順位が下がります
+	postMessage(t, `{"body": "今日も暑い"}`)
+	postMessage(t, `{"body": "今日は休み"}`)
+
+	cases := []struct {
+		body     string
+		expected string
+	}{
+		{body: "keyword 今日は渋谷でカレー", expected: "キーワード：渋谷, カレー, 今日"},
+		{body: "/keyword 形態素解析はテキストを単語に分割する処理です", expected: "キーワード：形態素解析, テキスト, 単語, 分割, 処理"},
+	}
+	for _, tc := range cases {
+		root := postMessage(t, fmt.Sprintf(`{"body": %q}`, tc.body))
+		if reply := waitForReply(t, root); reply != tc.expected {
+			t.Fatalf("%s: reply expected %q, but %q", tc.body, tc.expected, reply)
+		}
+	}
+}
+
+func TestBotがStoreに値を保存してbotごとに分けられる(t *testing.T) {
+	// prefixで始まるメッセージで、storeを操作するbotのスクリプトです
+	kvScript := func(prefix, comment string) string {
+		return fmt.Sprintf(`
+// %s
+var prefix = %q;
+exports.check = function(msg) { return msg.body.indexOf(prefix) === 0; };
+exports.process = function(msg) {
+  var args = msg.body.slice(prefix.length).split(" ");
+  switch (args[0]) {
+  case "count":
+    return store.incr("count") + "回目";
+  case "incr":
+    return String(store.incr(args[1], 10));
+  case "set":
+    store.set(args[1], args[2], args[3] ? parseInt(args[3], 10) : 0);
+    return "ok";
+  case "get":
+    var v = store.get(args[1]);
+    return v === null ? "ない" : v;
+  case "expire":
+    store.expire(args[1], parseInt(args[2], 10));
+    return "ok";
+  case "del":
+    store.del(args[1]);
+    return "ok";
+  }
+};
+`, comment, prefix)
+	}
+	writeScript(t, "kvbot", kvScript("kv ", "v1"))
+	writeScript(t, "otherkvbot", kvScript("otherkv ", "v1"))
+	waitForBots(t, "kvbot,otherkvbot")
+	for _, name := range []string{"kvbot", "otherkvbot"} {
+		expectStatus(t, http.MethodPut, tsURL+"/api/channels/1/bots/"+name, "", 200)
+	}
+
+	type step struct {
+		body  string
+		reply string
+		sleep time.Duration
+	}
+	run := func(steps []step) {
+		t.Helper()
+		for _, s := range steps {
+			root := postMessage(t, fmt.Sprintf(`{"body": %q}`, s.body))
+			if reply := waitForReply(t, root); reply != s.reply {
+				t.Fatalf("%s: reply expected %s, but %s", s.body, s.reply, reply)
+			}
+			time.Sleep(s.sleep)
+		}
+	}
+	run([]step{
+		{body: "kv count", reply: "1回目"},
+		{body: "kv count", reply: "2回目"},
+		// 他のbotの値は見えません
+		{body: "otherkv count", reply: "1回目"},
+		{body: "kv set color 青", reply: "ok"},
+		{body: "kv get color", reply: "青"},
+		{body: "otherkv get color", reply: "ない"},
+		// 整数でない値は増やせません
+		{body: "kv incr color", reply: "気が乗らないパカ"},
+		{body: "kv incr score", reply: "10"},
+		{body: "kv set temp x 200", reply: "ok"},
+		{body: "kv get temp", reply: "x", sleep: 300 * time.Millisecond},
+		{body: "kv get temp", reply: "ない"},
+		{body: "kv expire color 200", reply: "ok", sleep: 300 * time.Millisecond},
+		{body: "kv get color", reply: "ない"},
+		{body: "kv del score", reply: "ok"},
+		{body: "kv get score", reply: "ない"},
+	})
+
+	// botを作り直しても値は残ります
+	writeScript(t, "kvbot", kvScript("kv ", "v2"))
+	time.Sleep(300 * time.Millisecond)
+	run([]step{
+		{body: "kv count", reply: "3回目"},
+	})
+
+	// おみくじは同じ日に何度引いても同じ結果です
+	first := waitForReply(t, postMessage(t, `{"body": "omikuji"}`))
+	for i := 0; i < 3; i++ {
+		if reply := waitForReply(t, postMessage(t, `{"body": "omikuji"}`)); reply != first {
+			t.Fatalf("omikuji expected %s, but %s", first, reply)
+		}
+	}
+
+	for _, name := range []string{"kvbot", "otherkvbot"} {
+		if err := os.Remove(filepath.Join(scriptsDir, name+".js")); err != nil {
+			t.Fatalf("failed to remove script: %s", err)
+		}
+	}
+	waitForBots(t, "")
+}
+
+func TestBotがユーザーとのやりとりを続けて期限や終了で元に戻る(t *testing.T) {
+	// "quiz"で問題を出し、やりとりの途中のメッセージを答えとして判定するbotのスクリプトです
+	quizScript := func(comment string) string {
+		return fmt.Sprintf(`
+// %s
+exports.check = function(msg) { return msg.body.indexOf("quiz") === 0; };
+exports.process = function(msg) {
+  if (!conversation.active()) {
+    var ttl = parseInt(msg.body.slice(5), 10);
+    conversation.start("2", isNaN(ttl) ? 0 : ttl);
+    return "1+1は？";
+  }
+  if (msg.body === conversation.state()) {
+    conversation.end();
+    return "正解";
+  }
+  conversation.start(conversation.state(), 0);
+  return "ちがう";
+};
+`, comment)
+	}
+	writeScript(t, "quizbot", quizScript("v1"))
+	writeScript(t, "twobot", `
+exports.check = function(msg) { return msg.body === "2"; };
+exports.process = function(msg) { return "two"; };
+`)
+	waitForBots(t, "quizbot,twobot")
+	for _, name := range []string{"quizbot", "twobot"} {
+		expectStatus(t, http.MethodPut, tsURL+"/api/channels/1/bots/"+name, "", 200)
+	}
+
+	jar, err := newLoggedInJar("talker", "password")
+	if err != nil {
+		t.Fatalf("failed to sign up: %s", err)
+	}
+	talker := &http.Client{Jar: jar}
+
+	// replyOnly はbodyを投稿し、返信が1つだけであることを確かめます
+	replyOnly := func(client *http.Client, body, expected string) {
+		t.Helper()
+		root := postMessageAs(t, client, fmt.Sprintf(`{"body": %q}`, body))
+		if reply := waitForReply(t, root); reply != expected {
+			t.Fatalf("%s: reply expected %s, but %s", body, expected, reply)
+		}
+		time.Sleep(200 * time.Millisecond)
+		if n := len(getThread(t, root)); n != 2 {
+			t.Fatalf("%s: one reply expected, but thread has %d messages", body, n)
+		}
+	}
+
+	replyOnly(http.DefaultClient, "quiz", "1+1は？")
+	// やりとりの途中のメッセージはcheckerの条件を満たさなくてもquizbotにだけ渡ります
+	replyOnly(http.DefaultClient, "3", "ちがう")
+	// 他のユーザーのメッセージは今まで通り全botに渡ります
+	replyOnly(talker, "2", "two")
+	replyOnly(http.DefaultClient, "2", "正解")
+	// やりとりが終わると今まで通り全botに渡ります
+	replyOnly(http.DefaultClient, "2", "two")
+
+	// 期限を過ぎるとやりとりは終わります
+	replyOnly(http.DefaultClient, "quiz 200", "1+1は？")
+	time.Sleep(300 * time.Millisecond)
+	replyOnly(http.DefaultClient, "2", "two")
+
+	// botを作り直してもやりとりは続きます
+	replyOnly(http.DefaultClient, "quiz", "1+1は？")
+	writeScript(t, "quizbot", quizScript("v2"))
+	time.Sleep(300 * time.Millisecond)
+	replyOnly(http.DefaultClient, "2", "正解")
+
+	// やりとりしているbotがチャンネルで無効になると、メッセージは今まで通り他のbotに渡ります
+	replyOnly(http.DefaultClient, "quiz", "1+1は？")
+	expectStatus(t, http.MethodDelete, tsURL+"/api/channels/1/bots/quizbot", "", 200)
+	replyOnly(http.DefaultClient, "2", "two")
+
+	for _, name := range []string{"quizbot", "twobot"} {
+		if err := os.Remove(filepath.Join(scriptsDir, name+".js")); err != nil {
+			t.Fatalf("failed to remove script: %s", err)
+		}
+	}
+	waitForBots(t, "")
+}
+
+func TestScheduleのbotが予定の時刻に投稿して止まっていた間の分をmissedに従って扱う(t *testing.T) {
+	defs := `
+bots:
+  - name: morningbot
+    schedule: {cron: "0 9-11 * * *", channels: [1]}
+    processor: {type: template, template: '朝 {{.Message.Updated.Format "15:04"}}'}
+  - name: hourlybot
+    schedule: {every: 1h, channels: [1], missed: all}
+    processor: {type: template, template: '毎時 {{.Message.Updated.Format "15:04"}}'}
+  - name: halfbot
+    schedule: {cron: "30 * * * *", channels: [1], missed: once}
+    processor: {type: template, template: '毎時半 {{.Message.Updated.Format "15:04"}}'}
+`
+	calls := clock.afterCalls()
+	writeBotsFile(t, defs)
+	waitForBots(t, "halfbot,hourlybot,morningbot")
+	// 3つのbotが次の予定の時刻を待ち始めてから時計を進めます
+	clock.waitForAfter(t, calls+3)
+
+	since := latestMessageID(t)
+	clock.Advance(time.Minute)
+	expectBotPosts(t, since, "hourlybot: 毎時 09:00", "morningbot: 朝 09:00")
+	clock.waitForAfter(t, calls+5)
+
+	// botが止まっている間に12:00になります
+	writeBotsFile(t, "")
+	waitForBots(t, "")
+	clock.Advance(3 * time.Hour)
+
+	// 起動し直すと、allは全て、onceは最後の1回分を投稿し、skipは投稿しません
+	since = latestMessageID(t)
+	writeBotsFile(t, defs)
+	waitForBots(t, "halfbot,hourlybot,morningbot")
+	expectBotPosts(t, since, "halfbot: 毎時半 11:30", "hourlybot: 毎時 10:00", "hourlybot: 毎時 11:00", "hourlybot: 毎時 12:00")
+	clock.waitForAfter(t, calls+8)
+
+	since = latestMessageID(t)
+	clock.Advance(30 * time.Minute)
+	expectBotPosts(t, since, "halfbot: 毎時半 12:30")
+
+	writeBotsFile(t, "")
+	waitForBots(t, "")
+}
+
+// testClock はAdvanceで進めた時だけ時刻が進むbot.Clockです
+type testClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	calls   int
+	waiters []*testWaiter
+}
+
+// testWaiter はtestClockのAfterで時刻を待っているchannelです
+type testWaiter struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+// Now は進めた時刻を返します
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After はAdvanceでdだけ時刻が進むと時刻を送るchannelを返します
+func (c *testClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.calls++
+	w := &testWaiter{deadline: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.c <- c.now
+		return w.c
+	}
+	c.waiters = append(c.waiters, w)
+	return w.c
+}
+
+// Advance は時刻をdだけ進め、その時刻までを待っているchannelに時刻を送ります
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	var waiters []*testWaiter
+	for _, w := range c.waiters {
+		if w.deadline.After(c.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.c <- c.now
+	}
+	c.waiters = waiters
+}
+
+// afterCalls はAfterが呼ばれた回数を返します
+func (c *testClock) afterCalls() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls
+}
+
+// waitForAfter はAfterが呼ばれた回数がnになるまで待ちます
+func (c *testClock) waitForAfter(t *testing.T, n int) {
+	t.Helper()
+
+	for deadline := time.Now().Add(waitTimeout); time.Now().Before(deadline); time.Sleep(pollInterval) {
+		if c.afterCalls() >= n {
+			return
+		}
+	}
+	t.Fatalf("after expected to be called %d times, but %d", n, c.afterCalls())
+}
+
+// latestMessageID は最新のメッセージのIDを返します
+func latestMessageID(t *testing.T) int64 {
+	t.Helper()
+
+	ms := getMessages(t, "limit=1")
+	if len(ms) == 0 {
+		return 0
+	}
+	return ms[0].ID
+}
+
+// getMessages はqueryの条件で/api/messagesのメッセージを返します
+func getMessages(t *testing.T, query string) []*model.Message {
+	t.Helper()
+
+	resp, err := http.Get(tsURL + "/api/messages?" + query)
+	if err != nil {
+		t.Fatalf("failed to get response: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var r struct {
+		Result []*model.Message `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	return r.Result
+}
+
+// expectBotPosts はIDがsinceより後のbotの投稿が"botの名前: 本文"の形でexpectedの通りになることを確かめます
+func expectBotPosts(t *testing.T, since int64, expected ...string) {
+	t.Helper()
+
+	posts := func() []string {
+		var ps []string
+		for _, m := range getMessages(t, fmt.Sprintf("after=%d&limit=100", since)) {
+			if m.BotName != "" {
+				ps = append(ps, m.BotName+": "+m.Body)
+			}
+		}
+		sort.Strings(ps)
+		return ps
+	}
+	for deadline := time.Now().Add(waitTimeout); len(posts()) < len(expected) && time.Now().Before(deadline); {
+		time.Sleep(pollInterval)
+	}
+	// 余計な投稿がないことも確かめます
+	time.Sleep(200 * time.Millisecond)
+
+	sort.Strings(expected)
+	if actual := posts(); strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("posts expected %q, but %q", expected, actual)
+	}
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"database/sql"
+	"sync"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+)
+
+// ChannelBots はチャンネルごとに有効にしたbotを扱うサービスです
+//
+// Multicasterは全てのメッセージのeventでbotごとにEnabledを呼ぶので、チャンネルで有効なbotをメモリにキャッシュします。
+// キャッシュはEnableとDisableで更新するので、botの有効・無効はこのサービスを通して変えます
+//
+//   fields
+//     DB      *sql.DB
+//     mu      sync.Mutex
+//     enabled map[int64]map[string]bool チャンネルのIDごとの有効なbotの名前
+type ChannelBots struct {
+	DB      *sql.DB
+	mu      sync.Mutex
+	enabled map[int64]map[string]bool
+}
+
+// Enabled はchannelIDのチャンネルでnameのbotが有効になっているか判定します
+//
+// チャンネルごとに最初の1回だけDBから読み出します。存在しないチャンネルではどのbotも有効ではありません
+func (s *ChannelBots) Enabled(channelID int64, name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bots, ok := s.enabled[channelID]
+	if !ok {
+		channel, err := model.ChannelByID(s.DB, channelID)
+		switch {
+		case err == sql.ErrNoRows:
+			channel = &model.Channel{ID: channelID}
+		case err != nil:
+			return false, err
+		}
+		bots = map[string]bool{}
+		for _, b := range channel.Bots {
+			bots[b] = true
+		}
+		if s.enabled == nil {
+			s.enabled = map[int64]map[string]bool{}
+		}
+		s.enabled[channelID] = bots
+	}
+	return bots[name], nil
+}
+
+// Enable はchannelでnameのbotを有効にします
+func (s *ChannelBots) Enable(channel *model.Channel, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 読み出している途中のキャッシュと入れ違わないように、ロックしたまま書き込んでから捨てます
+	if err := channel.EnableBot(s.DB, name); err != nil {
+		return err
+	}
+	delete(s.enabled, channel.ID)
+	return nil
+}
+
+// Disable はchannelでnameのbotを無効にします
+func (s *ChannelBots) Disable(channel *model.Channel, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := channel.DisableBot(s.DB, name); err != nil {
+		return err
+	}
+	delete(s.enabled, channel.ID)
+	return nil
+}
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+
+	"github.com/VG-Tech-Dojo/vg-1day-2018-06-10/original/model"
+)
+
+var (
+	// ErrParentNotFound は存在しないメッセージに返信しようとした場合のエラーです
+	ErrParentNotFound = errors.New("parent message not found")
+	// ErrChannelNotFound は存在しないチャンネルに投稿しようとした場合のエラーです
+	ErrChannelNotFound = errors.New("channel not found")
+)
+
+// Message はメッセージの投稿・更新・削除とリアクションを扱うサービスです
+//
+// APIのコントローラーとbotの投稿は、どちらもCreateを呼んで同じ検証・保存・配信を行います。
+// メッセージを変更した場合はeventをStreamに送ります。eventを送るのはこのサービスだけです。
+// BotUserIDはbotが投稿に使うユーザーのIDです。このユーザーの投稿だけをbotの投稿として扱います
+//
+//   fields
+//     DB        *sql.DB
+//     Stream    chan *model.Event 変更したメッセージのeventを送ります
+//     BotUserID int64
+type Message struct {
+	DB        *sql.DB
+	Stream    chan *model.Event
+	BotUserID int64
+}
+
+// Create はuserの投稿としてmsgを保存し、保存したメッセージを返します
+//
+// msgのChannelIDが0の場合はgeneralに投稿します。返信の場合はスレッドの先頭メッセージにぶら下げ、チャンネルも返信先に揃えます。
+// 返信先がない場合はErrParentNotFoundを、チャンネルがない場合はErrChannelNotFoundを返します
+func (s *Message) Create(ctx context.Context, user *model.User, msg *model.Message) (*model.Message, error) {
+	// 投稿者は渡されたメッセージではなくuserにします
+	msg.UserID = user.ID
+	msg.Username = user.Name
+
+	// botの名前と返信の連鎖の深さは、botユーザーの投稿でだけ受け付けます
+	if s.BotUserID != 0 && user.ID == s.BotUserID {
+		msg.AuthorKind = model.AuthorBot
+		if msg.ChainDepth < 1 {
+			msg.ChainDepth = 1
+		}
+	} else {
+		msg.AuthorKind = model.AuthorUser
+		msg.BotName = ""
+		msg.ChainDepth = 0
+	}
+
+	if msg.ChannelID == 0 {
+		msg.ChannelID = model.DefaultChannelID
+	}
+
+	if msg.ParentID != 0 {
+		parent, err := model.MessageByID(s.DB, strconv.FormatInt(msg.ParentID, 10))
+		switch {
+		case err == sql.ErrNoRows:
+			return nil, ErrParentNotFound
+		case err != nil:
+			return nil, err
+		}
+		if parent.ParentID != 0 {
+			msg.ParentID = parent.ParentID
+		}
+		msg.ChannelID = parent.ChannelID
+	}
+	msg.ReplyCount = 0
+
+	_, err := model.ChannelByID(s.DB, msg.ChannelID)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, ErrChannelNotFound
+	case err != nil:
+		return nil, err
+	}
+
+	inserted, err := msg.Insert(s.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	// bot対応
+	s.publish(ctx, model.NewEvent(model.EventCreated, inserted))
+
+	return inserted, nil
+}
+
+// Update はmsgの本文をbodyに更新し、更新したメッセージを返します
+//
+// msgが取得した後に変更されていた場合はmodel.ErrConflictを返します
+func (s *Message) Update(ctx context.Context, msg *model.Message, body string) (*model.Message, error) {
+	msg.Body = body
+	updated, err := msg.Update(s.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	s.publish(ctx, model.NewEvent(model.EventUpdated, updated))
+
+	return updated, nil
+}
+
+// Delete はmsgを削除します。スレッドの先頭メッセージの場合は全ての返信も削除します
+//
+// msgが取得した後に変更されていた場合はmodel.ErrConflictを返します
+func (s *Message) Delete(ctx context.Context, msg *model.Message) error {
+	replies, err := msg.Delete(s.DB)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range replies {
+		s.publish(ctx, model.NewEvent(model.EventDeleted, r))
+	}
+	s.publish(ctx, model.NewEvent(model.EventDeleted, msg))
+
+	return nil
+}
+
+// AddReaction はmsgにuserのemojiのリアクションを付け、付けた後のメッセージを返します
+//
+// 既に同じリアクションを付けている場合は何もせずにmsgを返します
+func (s *Message) AddReaction(ctx context.Context, user *model.User, msg *model.Message, emoji string) (*model.Message, error) {
+	return s.react(ctx, model.EventReactionAdded, user, msg, emoji)
+}
+
+// RemoveReaction はmsgからuserのemojiのリアクションを取り消し、取り消した後のメッセージを返します
+//
+// 同じリアクションを付けていない場合は何もせずにmsgを返します
+func (s *Message) RemoveReaction(ctx context.Context, user *model.User, msg *model.Message, emoji string) (*model.Message, error) {
+	return s.react(ctx, model.EventReactionRemoved, user, msg, emoji)
+}
+
+// react はtの種類に応じてリアクションを付けるか取り消し、変更があった場合はeventを送ります
+func (s *Message) react(ctx context.Context, t model.EventType, user *model.User, msg *model.Message, emoji string) (*model.Message, error) {
+	reaction := &model.Reaction{
+		MessageID: msg.ID,
+		UserID:    user.ID,
+		Emoji:     emoji,
+	}
+	var changed bool
+	var err error
+	if t == model.EventReactionAdded {
+		changed, err = reaction.Insert(s.DB)
+	} else {
+		changed, err = reaction.Delete(s.DB)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return msg, nil
+	}
+
+	msg, err = model.MessageByID(s.DB, strconv.FormatInt(msg.ID, 10))
+	if err != nil {
+		return nil, err
+	}
+
+	s.publish(ctx, model.NewReactionEvent(t, msg, reaction))
+
+	return msg, nil
+}
+
+// publish はeをStreamに送ります。ctxが終了した場合は送らずに返します
+func (s *Message) publish(ctx context.Context, e *model.Event) {
+	select {
+	case s.Stream <- e:
+	case <-ctx.Done():
+	}
+}